@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+const adviseUsage = "advise file [-json]"
+
+/* 达到最大可节省内存的这个比例时就推荐，阈值越大操作 listpack 的耗时越长 */
+const ADVISE_SAVING_RATIO = 0.95
+
+/* 节省的内存不到默认配置的这个比例时不推荐修改 */
+const ADVISE_MIN_SAVING = 0.01
+
+/* redis 7 的默认配置 */
+const DEFAULT_HASH_ENTRIES = 128
+const DEFAULT_HASH_VALUE = 64
+const DEFAULT_ZSET_ENTRIES = 128
+const DEFAULT_ZSET_VALUE = 64
+const DEFAULT_INTSET_ENTRIES = 512
+const DEFAULT_LIST_SIZE = -2
+
+var adviseEntries = []int64{64, 128, 256, 512, 1024}
+var adviseValues = []int{32, 64, 128, 256}
+var adviseIntsetEntries = []int64{128, 256, 512, 1024, 2048, 4096, 8192}
+var adviseListSizes = []int{-1, -2, -3, -4, -5}
+
+/*
+* 单个key用于估算内存的特征，不保留具体的值
+* intWidth 集合所有成员都是整数时 intset 每个元素的字节数，否则为0
+ */
+type keyProfile struct {
+	objType  int
+	encType  int
+	count    int64
+	maxLen   int
+	sumLen   int64
+	intWidth int
+	nodes    int64
+}
+
+/*
+* 一组配置的估算结果
+ */
+type AdviseCandidate struct {
+	Entries     int64 `json:"entries"`
+	Value       int   `json:"value,omitempty"`
+	CompactKeys int64 `json:"compactKeys"`
+	Memory      int64 `json:"memory"`
+	Saving      int64 `json:"saving"`
+}
+
+/*
+* 一类配置的估算结果，saving 相对于 redis 默认配置
+ */
+type AdviseResult struct {
+	Settings    []string           `json:"settings"`
+	Keys        int64              `json:"keys"`
+	Stored      int64              `json:"stored"`
+	Default     int64              `json:"default"`
+	Candidates  []*AdviseCandidate `json:"candidates"`
+	Recommended *AdviseCandidate   `json:"recommended"`
+}
+
+func newKeyProfile(obj *RedisObject) *keyProfile {
+	p := &keyProfile{objType: obj.objType, encType: obj.encType, nodes: obj.nodes}
+	addLen := func(str string) {
+		p.sumLen += int64(len(str))
+		if len(str) > p.maxLen {
+			p.maxLen = len(str)
+		}
+	}
+
+	switch val := obj.objVal.(type) {
+	case map[string]string:
+		p.count = int64(len(val))
+		for field, value := range val {
+			addLen(field)
+			addLen(value)
+		}
+	case map[string]float64:
+		p.count = int64(len(val))
+		for member := range val {
+			addLen(member)
+		}
+	case map[string]int:
+		p.count = int64(len(val))
+		p.intWidth = 2
+		for member := range val {
+			addLen(member)
+			if p.intWidth > 0 {
+				p.intWidth = intsetWidth(member, p.intWidth)
+			}
+		}
+	case []string:
+		p.count = int64(len(val))
+		for _, item := range val {
+			addLen(item)
+		}
+	case string:
+		p.count = 1
+		addLen(val)
+	}
+
+	return p
+}
+
+/*
+* 计算集合成员放入 intset 需要的宽度，不是整数时返回0
+ */
+func intsetWidth(member string, width int) int {
+	intVal, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(intVal, 10) != member {
+		return 0
+	}
+
+	switch {
+	case intVal < -2147483648 || intVal > 2147483647:
+		return 8
+	case (intVal < -32768 || intVal > 32767) && width < 4:
+		return 4
+	}
+
+	return width
+}
+
+/*
+* jemalloc 实际分配的大小
+ */
+func mallocSize(size int64) int64 {
+	if size <= 8 {
+		return 8
+	}
+	if size <= 128 {
+		return (size + 15) / 16 * 16
+	}
+
+	// 每两倍之间分为4档
+	step := int64(32)
+	for step*8 < size {
+		step *= 2
+	}
+
+	return (size + step - 1) / step * step
+}
+
+func nextPower(size int64) int64 {
+	power := int64(4)
+	for power < size {
+		power *= 2
+	}
+
+	return power
+}
+
+func sdsSize(length int64) int64 {
+	return mallocSize(length + 4)
+}
+
+func avgLen(sumLen, count int64) int64 {
+	if count == 0 {
+		return 0
+	}
+
+	return sumLen / count
+}
+
+/*
+* listpack 的大小，每个元素按 1 字节编码头和 1 字节 backlen 估算
+ */
+func listpackSize(count, sumLen int64) int64 {
+	return mallocSize(7 + sumLen + count*2)
+}
+
+func dictSize(count int64) int64 {
+	return mallocSize(56) + mallocSize(8*nextPower(count)) + count*mallocSize(24)
+}
+
+func hashtableHashSize(p *keyProfile) int64 {
+	return dictSize(p.count) + 2*p.count*sdsSize(avgLen(p.sumLen, 2*p.count))
+}
+
+func hashtableSetSize(p *keyProfile) int64 {
+	return dictSize(p.count) + p.count*sdsSize(avgLen(p.sumLen, p.count))
+}
+
+func intsetSize(p *keyProfile) int64 {
+	return mallocSize(8 + p.count*int64(p.intWidth))
+}
+
+/*
+* 跳表节点平均 1.33 层，成员的 sds 由字典和跳表共用
+ */
+func skiplistSize(p *keyProfile) int64 {
+	return dictSize(p.count) + mallocSize(32) + mallocSize(24+32*16) + p.count*(mallocSize(24+21)+sdsSize(avgLen(p.sumLen, p.count)))
+}
+
+/*
+* zset 的 listpack 中成员和分数各占一个元素，分数按 4 字节估算
+ */
+func zsetListpackSize(p *keyProfile) int64 {
+	return listpackSize(2*p.count, p.sumLen+4*p.count)
+}
+
+/*
+* 按 list-max-listpack-size 估算 quicklist 的节点数
+* 负数表示单个节点的字节上限（-1 为 4KB，-5 为 64KB），正数表示单个节点的元素个数
+ */
+func quicklistNodes(p *keyProfile, fill int) int64 {
+	if p.count == 0 {
+		return 0
+	}
+
+	perNode := int64(fill)
+	if fill < 0 {
+		perNode = int64(4096<<uint(-fill-1)) / (avgLen(p.sumLen, p.count) + 2)
+	}
+	if perNode < 1 {
+		perNode = 1
+	}
+
+	return (p.count + perNode - 1) / perNode
+}
+
+func quicklistSize(p *keyProfile, nodes int64) int64 {
+	if nodes == 0 {
+		return mallocSize(40)
+	}
+
+	return mallocSize(40) + nodes*(mallocSize(32)+listpackSize(p.count/nodes, p.sumLen/nodes))
+}
+
+/*
+* 按 rdb 中实际的编码估算内存
+ */
+func storedSize(p *keyProfile) int64 {
+	encoding := encodingMap[p.encType]
+	switch p.objType {
+	case RDB_TYPE_HASH:
+		if encoding == "hashtable" {
+			return hashtableHashSize(p)
+		}
+		return listpackSize(2*p.count, p.sumLen)
+	case RDB_TYPE_ZSET:
+		if encoding == "skiplist" {
+			return skiplistSize(p)
+		}
+		return zsetListpackSize(p)
+	case RDB_TYPE_SET:
+		switch encoding {
+		case "intset":
+			return intsetSize(p)
+		case "listpack":
+			return listpackSize(p.count, p.sumLen)
+		}
+		return hashtableSetSize(p)
+	case RDB_TYPE_LIST:
+		nodes := p.nodes
+		if nodes == 0 {
+			nodes = quicklistNodes(p, DEFAULT_LIST_SIZE)
+		}
+		return quicklistSize(p, nodes)
+	}
+
+	return 0
+}
+
+/*
+* 估算一个key在 redis 中占用的内存：字典节点、key 的 sds、redisObject 以及 value
+* 整数字符串按共享对象或者直接存在 redisObject 中计算
+ */
+func estimateMemory(key string, obj *RedisObject) int64 {
+	size := mallocSize(24) + sdsSize(int64(len(key))) + mallocSize(16)
+	if obj.expireTime >= 0 {
+		size += mallocSize(24)
+	}
+
+	if str, ok := obj.objVal.(string); ok {
+		if _, err := strconv.ParseInt(str, 10, 64); err != nil || len(str) > 20 {
+			size += sdsSize(int64(len(str)))
+		}
+		return size
+	}
+
+	return size + storedSize(newKeyProfile(obj))
+}
+
+/*
+* 模拟 hash / zset 的 entries 和 value 配置
+ */
+func simulateCompact(profiles []*keyProfile, entries int64, value int, compact, full func(p *keyProfile) int64) *AdviseCandidate {
+	c := &AdviseCandidate{Entries: entries, Value: value}
+	for _, p := range profiles {
+		if p.count <= entries && p.maxLen <= value {
+			c.CompactKeys++
+			c.Memory += compact(p)
+		} else {
+			c.Memory += full(p)
+		}
+	}
+
+	return c
+}
+
+/*
+* 模拟 set-max-intset-entries，不能使用 intset 的集合保持 rdb 中的编码
+ */
+func simulateIntset(profiles []*keyProfile, entries int64) *AdviseCandidate {
+	c := &AdviseCandidate{Entries: entries}
+	for _, p := range profiles {
+		switch {
+		case p.intWidth > 0 && p.count <= entries:
+			c.CompactKeys++
+			c.Memory += intsetSize(p)
+		case p.intWidth > 0:
+			c.Memory += hashtableSetSize(p)
+		default:
+			c.Memory += storedSize(p)
+		}
+	}
+
+	return c
+}
+
+func simulateList(profiles []*keyProfile, fill int) *AdviseCandidate {
+	c := &AdviseCandidate{Entries: int64(fill)}
+	for _, p := range profiles {
+		nodes := quicklistNodes(p, fill)
+		c.CompactKeys += nodes
+		c.Memory += quicklistSize(p, nodes)
+	}
+
+	return c
+}
+
+/*
+* 计算相对默认配置节省的内存，选出达到最大节省量一定比例的最保守配置
+* candidates 需要按从保守到激进排序
+ */
+func newAdviseResult(settings []string, profiles []*keyProfile, candidates []*AdviseCandidate, defaultMemory int64) *AdviseResult {
+	result := &AdviseResult{Settings: settings, Keys: int64(len(profiles)), Default: defaultMemory, Candidates: candidates}
+	for _, p := range profiles {
+		result.Stored += storedSize(p)
+	}
+
+	var best int64
+	for _, c := range candidates {
+		c.Saving = defaultMemory - c.Memory
+		if c.Saving > best {
+			best = c.Saving
+		}
+	}
+	if best <= 0 || float64(best) < float64(defaultMemory)*ADVISE_MIN_SAVING {
+		return result
+	}
+
+	for _, c := range candidates {
+		if float64(c.Saving) >= float64(best)*ADVISE_SAVING_RATIO {
+			result.Recommended = c
+			break
+		}
+	}
+
+	return result
+}
+
+/*
+* 按不同的编码阈值配置估算内存，给出可以节省内存的配置
+ */
+func advise(profiles map[int][]*keyProfile) []*AdviseResult {
+	var results []*AdviseResult
+
+	hashes := profiles[RDB_TYPE_HASH]
+	hashLp := func(p *keyProfile) int64 { return listpackSize(2*p.count, p.sumLen) }
+	var candidates []*AdviseCandidate
+	for _, entries := range adviseEntries {
+		for _, value := range adviseValues {
+			candidates = append(candidates, simulateCompact(hashes, entries, value, hashLp, hashtableHashSize))
+		}
+	}
+	defaultMemory := simulateCompact(hashes, DEFAULT_HASH_ENTRIES, DEFAULT_HASH_VALUE, hashLp, hashtableHashSize).Memory
+	results = append(results, newAdviseResult([]string{"hash-max-listpack-entries", "hash-max-listpack-value"}, hashes, candidates, defaultMemory))
+
+	zsets := profiles[RDB_TYPE_ZSET]
+	candidates = nil
+	for _, entries := range adviseEntries {
+		for _, value := range adviseValues {
+			candidates = append(candidates, simulateCompact(zsets, entries, value, zsetListpackSize, skiplistSize))
+		}
+	}
+	defaultMemory = simulateCompact(zsets, DEFAULT_ZSET_ENTRIES, DEFAULT_ZSET_VALUE, zsetListpackSize, skiplistSize).Memory
+	results = append(results, newAdviseResult([]string{"zset-max-listpack-entries", "zset-max-listpack-value"}, zsets, candidates, defaultMemory))
+
+	sets := profiles[RDB_TYPE_SET]
+	candidates = nil
+	for _, entries := range adviseIntsetEntries {
+		candidates = append(candidates, simulateIntset(sets, entries))
+	}
+	defaultMemory = simulateIntset(sets, DEFAULT_INTSET_ENTRIES).Memory
+	results = append(results, newAdviseResult([]string{"set-max-intset-entries"}, sets, candidates, defaultMemory))
+
+	lists := profiles[RDB_TYPE_LIST]
+	candidates = nil
+	for _, fill := range adviseListSizes {
+		candidates = append(candidates, simulateList(lists, fill))
+	}
+	defaultMemory = simulateList(lists, DEFAULT_LIST_SIZE).Memory
+	results = append(results, newAdviseResult([]string{"list-max-listpack-size"}, lists, candidates, defaultMemory))
+
+	return results
+}
+
+func printAdviseResult(result *AdviseResult) {
+	fmt.Printf("%v: %d keys, %d bytes as stored, %d bytes with default config\n", result.Settings, result.Keys, result.Stored, result.Default)
+	if result.Keys == 0 {
+		fmt.Println()
+		return
+	}
+
+	compactName := "compact keys"
+	if result.Settings[0] == "list-max-listpack-size" {
+		compactName = "nodes"
+	}
+	if len(result.Settings) == 2 {
+		fmt.Printf("%-10s %-10s %14s %14s %14s\n", "entries", "value", compactName, "memory", "saving")
+	} else {
+		fmt.Printf("%-10s %14s %14s %14s\n", "setting", compactName, "memory", "saving")
+	}
+	for _, c := range result.Candidates {
+		if len(result.Settings) == 2 {
+			fmt.Printf("%-10d %-10d %14d %14d %14d\n", c.Entries, c.Value, c.CompactKeys, c.Memory, c.Saving)
+		} else {
+			fmt.Printf("%-10d %14d %14d %14d\n", c.Entries, c.CompactKeys, c.Memory, c.Saving)
+		}
+	}
+
+	c := result.Recommended
+	if c == nil {
+		fmt.Printf("recommended: keep the default config\n\n")
+		return
+	}
+
+	ratio := float64(c.Saving) * 100 / float64(result.Default)
+	if len(result.Settings) == 2 {
+		fmt.Printf("recommended: %s %d, %s %d (saves %d bytes, %.2f%%)\n\n", result.Settings[0], c.Entries, result.Settings[1], c.Value, c.Saving, ratio)
+	} else {
+		fmt.Printf("recommended: %s %d (saves %d bytes, %.2f%%)\n\n", result.Settings[0], c.Entries, c.Saving, ratio)
+	}
+}
+
+/*
+* 模拟不同的编码阈值配置，估算内存并给出建议
+ */
+func runAdvise(args []string) error {
+	fs := flag.NewFlagSet("advise", flag.ExitOnError)
+	asJson := fs.Bool("json", false, "output as json")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return errors.New("usage: decode " + adviseUsage)
+	}
+
+	profiles := make(map[int][]*keyProfile)
+	_, err = scanObjects(files[0], func(dbId int, key string, obj *RedisObject) error {
+		objType := obj.objType
+		if objType == RDB_TYPE_STRING {
+			return nil
+		}
+
+		profiles[objType] = append(profiles[objType], newKeyProfile(obj))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	results := advise(profiles)
+	if *asJson {
+		out, err := json.MarshalIndent(results, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	fmt.Println("Estimated memory of hash, zset, set and list values under different encoding settings.")
+	fmt.Printf("Recommended settings reach %.0f%% of the largest saving with the smallest thresholds.\n\n", ADVISE_SAVING_RATIO*100)
+	for _, result := range results {
+		printAdviseResult(result)
+	}
+
+	return nil
+}
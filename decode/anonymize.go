@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const anonymizeUsage = "anonymize dump.rdb -o masked.rdb [-salt secret] [-mode hash|fake] [-match user:*] [-fields email,phone] [-mask-fields] [-key-suffix] [-delim :] [-copy-unsupported]"
+
+const MASK_HASH = "hash"
+const MASK_FAKE = "fake"
+
+/* 脱敏结果重复时用不同的计数重新生成的次数，之后逐个递增直到不重复 */
+const MASK_RETRY = 16
+
+/*
+* 数据脱敏，相同的输入总是得到相同的输出，
+* 并且保持类型、元素个数、编码以及长度不变
+* 脱敏后的 key、集合成员、hash 字段在各自的范围内不重复，重复时重新生成
+ */
+type Masker struct {
+	salt       []byte
+	mode       string
+	keyRules   []string
+	fieldRules []string
+	maskFields bool
+	keySuffix  bool
+	delim      string
+	keysUsed   map[int]map[string]bool
+}
+
+/*
+* 生成 length 字节的伪随机数据，由 salt 和输入唯一确定
+ */
+func (m *Masker) stream(kind string, input []byte, length int) []byte {
+	out := make([]byte, 0, length+sha256.Size)
+	for counter := uint32(0); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, m.salt)
+		mac.Write([]byte(kind))
+		binary.Write(mac, binary.BigEndian, counter)
+		mac.Write(input)
+		out = mac.Sum(out)
+	}
+
+	return out[:length]
+}
+
+func matchRules(rules []string, str string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if globMatch(rule, str) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Masker) matchKey(key string) bool {
+	return matchRules(m.keyRules, key)
+}
+
+func (m *Masker) matchField(field string) bool {
+	return matchRules(m.fieldRules, field)
+}
+
+/*
+* 字符串脱敏，长度不变
+* hash 模式输出十六进制字符，fake 模式保持每个字符的类别(数字、字母)
+ */
+func (m *Masker) MaskString(str string) string {
+	return m.maskString(str, 0)
+}
+
+/*
+* attempt 大于0时为结果重复后的重新生成
+ */
+func attemptKind(kind string, attempt int) string {
+	if attempt == 0 {
+		return kind
+	}
+
+	return kind + strconv.Itoa(attempt)
+}
+
+func (m *Masker) maskString(str string, attempt int) string {
+	rand := m.stream(attemptKind("s", attempt), []byte(str), len(str))
+	masked := make([]byte, len(str))
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if m.mode == MASK_HASH {
+			masked[i] = "0123456789abcdef"[rand[i]&0x0f]
+			continue
+		}
+
+		switch {
+		case c >= '0' && c <= '9':
+			masked[i] = '0' + rand[i]%10
+		case c >= 'a' && c <= 'z':
+			masked[i] = 'a' + rand[i]%26
+		case c >= 'A' && c <= 'Z':
+			masked[i] = 'A' + rand[i]%26
+		case c < 0x80 && c >= 0x20:
+			masked[i] = c
+		default:
+			masked[i] = 'a' + rand[i]%26
+		}
+	}
+
+	return string(masked)
+}
+
+/*
+* 整数脱敏，结果落在 [min, max] 区间内
+ */
+func (m *Masker) MaskInt(intVal int64, min int64, max int64) int64 {
+	return m.maskInt(intVal, min, max, 0)
+}
+
+func (m *Masker) maskInt(intVal int64, min int64, max int64, attempt int) int64 {
+	rand := binary.BigEndian.Uint64(m.stream(attemptKind("i", attempt), []byte(strconv.FormatInt(intVal, 10)), 8))
+	span := uint64(max - min)
+	if span == math.MaxUint64 {
+		return int64(rand)
+	}
+
+	return min + int64(rand%(span+1))
+}
+
+/*
+* 在 used 中不重复的脱敏结果，used 为 nil 时不需要去重
+* 重复时用不同的计数重新生成，可选的字符用尽时把 fixed 之后的部分逐字节递增，
+* 原值互不相同，同样长度下总有没用过的值，最多尝试 len(used) 次
+ */
+func (m *Masker) unique(used map[string]bool, fixed int, derive func(attempt int) string) string {
+	masked := derive(0)
+	if used == nil {
+		return masked
+	}
+
+	for attempt := 1; used[masked] && attempt <= MASK_RETRY; attempt++ {
+		masked = derive(attempt)
+	}
+	for n := 0; used[masked] && n <= len(used); n++ {
+		masked = masked[:fixed] + nextBytes(masked[fixed:])
+	}
+	used[masked] = true
+
+	return masked
+}
+
+func nextBytes(str string) string {
+	buf := []byte(str)
+	for i := len(buf) - 1; i >= 0; i-- {
+		buf[i]++
+		if buf[i] != 0 {
+			break
+		}
+	}
+
+	return string(buf)
+}
+
+func (m *Masker) uniqueString(used map[string]bool, str string) string {
+	return m.unique(used, 0, func(attempt int) string { return m.maskString(str, attempt) })
+}
+
+/*
+* 整数脱敏并在 used 中去重，重复时重新生成，之后在 [min, max] 中循环递增
+ */
+func (m *Masker) uniqueInt(used map[string]bool, intVal int64, min int64, max int64) int64 {
+	masked := m.MaskInt(intVal, min, max)
+	if used == nil {
+		return masked
+	}
+
+	for attempt := 1; used[strconv.FormatInt(masked, 10)] && attempt <= MASK_RETRY; attempt++ {
+		masked = m.maskInt(intVal, min, max, attempt)
+	}
+	for n := 0; used[strconv.FormatInt(masked, 10)] && n <= len(used); n++ {
+		if masked == max {
+			masked = min
+		} else {
+			masked++
+		}
+	}
+	used[strconv.FormatInt(masked, 10)] = true
+
+	return masked
+}
+
+func (m *Masker) usedKeys(dbId int) map[string]bool {
+	if m.keysUsed == nil {
+		m.keysUsed = make(map[int]map[string]bool)
+	}
+	used, ok := m.keysUsed[dbId]
+	if !ok {
+		used = make(map[string]bool)
+		m.keysUsed[dbId] = used
+	}
+
+	return used
+}
+
+/*
+* 只对部分 key 脱敏时先记录不脱敏的 key，脱敏后的 key 不能和它们重复
+ */
+func (m *Masker) reserveKeys(path string) error {
+	if !m.keySuffix || len(m.keyRules) == 0 {
+		return nil
+	}
+
+	_, err := scanObjects(path, func(dbId int, key string, obj *RedisObject) error {
+		if !m.matchKey(key) {
+			m.usedKeys(dbId)[key] = true
+		}
+		return nil
+	})
+
+	return err
+}
+
+/*
+* key 脱敏，保留第一个分隔符之前的前缀以及所有分隔符，便于按前缀统计
+* 同一个 db 中脱敏后的 key 不重复
+ */
+func (m *Masker) MaskKey(dbId int, key string) string {
+	if !m.keySuffix {
+		return key
+	}
+
+	pos := strings.Index(key, m.delim)
+	if pos < 0 || m.delim == "" {
+		return key
+	}
+
+	prefix := key[:pos+len(m.delim)]
+	parts := strings.Split(key[len(prefix):], m.delim)
+
+	return m.unique(m.usedKeys(dbId), len(prefix), func(attempt int) string {
+		masked := make([]string, len(parts))
+		for i, part := range parts {
+			masked[i] = m.maskString(part, attempt)
+		}
+		return prefix + strings.Join(masked, m.delim)
+	})
+}
+
+/*
+* 对解析后的对象脱敏，用于导出，不修改原对象
+* 按排序后的顺序处理集合成员，重复时的重新生成结果是确定的
+ */
+func (m *Masker) MaskObject(obj *RedisObject) *RedisObject {
+	masked := *obj
+	switch val := obj.objVal.(type) {
+	case string:
+		masked.objVal = m.MaskString(val)
+	case []string:
+		list := make([]string, len(val))
+		for i, item := range val {
+			list[i] = m.MaskString(item)
+		}
+		masked.objVal = list
+	case map[string]string:
+		used := make(map[string]bool)
+		hash := make(map[string]string, len(val))
+		for _, elem := range sortedElements(obj) {
+			field, value := elem.Field, elem.Value
+			if m.matchField(field) {
+				value = m.MaskString(value)
+			}
+			if m.maskFields {
+				field = m.uniqueString(used, field)
+			}
+			hash[field] = value
+		}
+		masked.objVal = hash
+	case map[string]int:
+		used := make(map[string]bool)
+		set := make(map[string]int, len(val))
+		for _, elem := range sortedElements(obj) {
+			set[m.uniqueString(used, elem.Value)] = val[elem.Value]
+		}
+		masked.objVal = set
+	case map[string]float64:
+		used := make(map[string]bool)
+		zset := make(map[string]float64, len(val))
+		for _, elem := range sortedElements(obj) {
+			zset[m.uniqueString(used, elem.Value)] = *elem.Score
+		}
+		masked.objVal = zset
+	}
+
+	return &masked
+}
+
+/*
+* 读取一个字符串对象并写入输出，mask 为 true 时脱敏，used 不为 nil 时脱敏结果在 used 中不重复
+* 整数编码的字符串保持原来的整数宽度，LZF 压缩的字符串脱敏后不再压缩
+* 返回原始字符串
+ */
+func (m *Masker) copyStringObject(r *Rdb, raw []byte, rw *RdbWriter, mask bool, used map[string]bool) (string, error) {
+	start := r.curIndex
+	isEncoded := false
+	strLen, err := r.LoadLen(&isEncoded)
+	if err != nil {
+		return "", err
+	}
+
+	var str string
+	if isEncoded {
+		switch strLen {
+		case RDB_ENC_INT8, RDB_ENC_INT16, RDB_ENC_INT32:
+			str, err = r.LoadInteger(strLen)
+		case RDB_ENC_LZF:
+			str, err = r.LoadLzfString(strLen)
+		default:
+			err = fmt.Errorf("Unknown RDB string encoding type: %d", strLen)
+		}
+	} else {
+		var buf []byte
+		buf, err = r.ReadBuf(int64(strLen))
+		str = string(buf)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !mask {
+		_, err = rw.Write(raw[start:r.curIndex])
+		return str, err
+	}
+
+	if isEncoded && strLen != RDB_ENC_LZF {
+		intVal, _ := strconv.ParseInt(str, 10, 64)
+		width := uint(8) << uint(strLen)
+		min, max := int64(-1)<<(width-1), int64(1)<<(width-1)-1
+		masked := uint64(m.uniqueInt(used, intVal, min, max))
+		buf := []byte{RDB_ENCVAL<<6 | byte(strLen)}
+		for i := uint(0); i < width/8; i++ {
+			buf = append(buf, byte(masked>>(8*i)))
+		}
+		_, err = rw.Write(buf)
+		return str, err
+	}
+
+	return str, rw.WriteString(m.uniqueString(used, str))
+}
+
+/*
+* 根据元素下标及前一个元素决定是否脱敏，以及需要在哪个集合中去重，不需要去重时为 nil
+ */
+type maskEntryFunc func(i int, prev string) (bool, map[string]bool)
+
+/*
+* 对 ziplist 中的元素原地脱敏
+ */
+func (m *Masker) maskZipList(zl []byte, maskEntry maskEntryFunc) error {
+	if len(zl) < 11 {
+		return errors.New("ziplist too short")
+	}
+
+	prev := ""
+	pos := 10
+	for i := 0; pos < len(zl) && zl[pos] != 255; i++ {
+		// 读取元素原值
+		cur := pos
+		entry, err := (&Rdb{}).LoadZipListEntry(string(zl), &cur)
+		if err != nil {
+			return err
+		}
+
+		if zl[pos] == 254 {
+			pos += 5
+		} else {
+			pos++
+		}
+		flag := zl[pos]
+
+		if mask, used := maskEntry(i, prev); mask {
+			switch {
+			case flag>>6 == ZIP_STR_06B:
+				copy(zl[pos+1:], m.uniqueString(used, entry))
+			case flag>>6 == ZIP_STR_14B:
+				copy(zl[pos+2:], m.uniqueString(used, entry))
+			case flag>>6 == ZIP_STR_32B:
+				copy(zl[pos+5:], m.uniqueString(used, entry))
+			default:
+				m.maskZipListInt(zl[pos:cur], entry, used)
+			}
+		}
+
+		prev = entry
+		pos = cur
+	}
+
+	return nil
+}
+
+/*
+* ziplist 整数元素脱敏，保持原来的整数编码
+ */
+func (m *Masker) maskZipListInt(buf []byte, entry string, used map[string]bool) {
+	intVal, _ := strconv.ParseInt(entry, 10, 64)
+	flag := buf[0]
+	switch flag {
+	case ZIP_INT_8B:
+		buf[1] = byte(m.uniqueInt(used, intVal, math.MinInt8, math.MaxInt8))
+	case ZIP_INT_16B:
+		binary.LittleEndian.PutUint16(buf[1:], uint16(m.uniqueInt(used, intVal, math.MinInt16, math.MaxInt16)))
+	case ZIP_INT_24B:
+		masked := uint32(m.uniqueInt(used, intVal, -1<<23, 1<<23-1))
+		buf[1], buf[2], buf[3] = byte(masked), byte(masked>>8), byte(masked>>16)
+	case ZIP_INT_32B:
+		binary.LittleEndian.PutUint32(buf[1:], uint32(m.uniqueInt(used, intVal, math.MinInt32, math.MaxInt32)))
+	case ZIP_INT_64B:
+		binary.LittleEndian.PutUint64(buf[1:], uint64(m.uniqueInt(used, intVal, math.MinInt64, math.MaxInt64)))
+	default:
+		// 4 bit 立即数，取值 0 - 12
+		buf[0] = 0xF1 + byte(m.uniqueInt(used, intVal, 0, 12))
+	}
+}
+
+/*
+* 对 listpack 中的元素原地脱敏，整数保持原来的编码宽度，字符串长度不变
+ */
+func (m *Masker) maskListPack(lp []byte, maskEntry maskEntryFunc) error {
+	if len(lp) < 7 {
+		return errors.New("listpack too short")
+	}
+
+	prev := ""
+	pos := 6
+	for i := 0; pos < len(lp) && lp[pos] != 0xff; i++ {
+		entry, entryLen, err := listPackEntry(string(lp), pos)
+		if err != nil {
+			return err
+		}
+
+		if mask, used := maskEntry(i, prev); mask {
+			flag := lp[pos]
+			intVal, _ := strconv.ParseInt(entry, 10, 64)
+			switch {
+			case flag&0x80 == 0:
+				lp[pos] = byte(m.uniqueInt(used, intVal, 0, 127))
+			case flag&0xc0 == 0x80, flag&0xf0 == 0xe0, flag == 0xf0:
+				copy(lp[pos+entryLen-len(entry):], m.uniqueString(used, entry))
+			case flag&0xe0 == 0xc0:
+				masked := uint16(m.uniqueInt(used, intVal, -1<<12, 1<<12-1)) & 0x1fff
+				lp[pos], lp[pos+1] = 0xc0|byte(masked>>8), byte(masked)
+			default:
+				// 16/24/32/64 位整数，小端存储
+				width := uint(entryLen - 1)
+				masked := uint64(m.uniqueInt(used, intVal, int64(-1)<<(width*8-1), int64(1)<<(width*8-1)-1))
+				for b := uint(0); b < width; b++ {
+					lp[pos+1+int(b)] = byte(masked >> (8 * b))
+				}
+			}
+		}
+
+		prev = entry
+		pos += entryLen + backLenSize(entryLen)
+	}
+	if pos >= len(lp) {
+		return errors.New("listpack without end mark")
+	}
+
+	return nil
+}
+
+/*
+* intset 脱敏，保持编码宽度和元素个数，结果重新排序并去重
+ */
+func (m *Masker) maskIntSet(setBuf []byte) error {
+	if len(setBuf) < 8 {
+		return errors.New("intset too short")
+	}
+
+	encoding := int(binary.LittleEndian.Uint32(setBuf[0:4]))
+	members, err := (&Rdb{}).LoadIntSet(string(setBuf))
+	if err != nil {
+		return err
+	}
+
+	width := uint(encoding * 8)
+	min, max := int64(-1)<<(width-1), int64(1)<<(width-1)-1
+	used := make(map[string]bool)
+	masked := make([]int64, 0, len(members))
+	for _, member := range members {
+		intVal, _ := strconv.ParseInt(member, 10, 64)
+		masked = append(masked, m.uniqueInt(used, intVal, min, max))
+	}
+	sort.Slice(masked, func(i, j int) bool { return masked[i] < masked[j] })
+
+	for i, intVal := range masked {
+		valBuf := setBuf[8+i*encoding:]
+		switch encoding {
+		case 2:
+			binary.LittleEndian.PutUint16(valBuf, uint16(intVal))
+		case 4:
+			binary.LittleEndian.PutUint32(valBuf, uint32(intVal))
+		case 8:
+			binary.LittleEndian.PutUint64(valBuf, uint64(intVal))
+		}
+	}
+
+	return nil
+}
+
+/*
+* 对一个 value 的原始序列化数据脱敏，返回新的序列化数据
+ */
+func (m *Masker) MaskValue(valType byte, raw []byte) ([]byte, error) {
+	r := NewRdb(bytes.NewReader(raw))
+	var out bytes.Buffer
+	rw := NewRdbWriter(&out, 0)
+
+	// 集合成员、hash 字段在一个 value 中不能重复，列表元素可以重复
+	var used map[string]bool
+	if valType != RDB_TYPE_LIST {
+		used = make(map[string]bool)
+	}
+
+	var err error
+	switch valType {
+	case RDB_TYPE_STRING:
+		_, err = m.copyStringObject(r, raw, rw, true, nil)
+	case RDB_TYPE_LIST, RDB_TYPE_SET, RDB_TYPE_ZSET, RDB_TYPE_ZSET_2, RDB_TYPE_HASH:
+		var objLen int
+		objLen, err = r.LoadLen(nil)
+		if err != nil {
+			return nil, err
+		}
+		rw.WriteLen(uint64(objLen))
+
+		for i := 0; i < objLen && err == nil; i++ {
+			switch valType {
+			case RDB_TYPE_HASH:
+				var field string
+				field, err = m.copyStringObject(r, raw, rw, m.maskFields, used)
+				if err == nil {
+					_, err = m.copyStringObject(r, raw, rw, m.matchField(field), nil)
+				}
+			case RDB_TYPE_ZSET:
+				_, err = m.copyStringObject(r, raw, rw, true, used)
+				if err == nil {
+					start := r.curIndex
+					_, err = r.LoadDoubleValue()
+					rw.Write(raw[start:r.curIndex])
+				}
+			case RDB_TYPE_ZSET_2:
+				_, err = m.copyStringObject(r, raw, rw, true, used)
+				if err == nil {
+					var score []byte
+					score, err = r.ReadBuf(8)
+					rw.Write(score)
+				}
+			default:
+				_, err = m.copyStringObject(r, raw, rw, true, used)
+			}
+		}
+	case RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST, RDB_TYPE_SET_INTSET,
+		RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		err = m.maskEncodedString(r, rw, valType)
+	case RDB_TYPE_LIST_QUICKLIST:
+		var nodes int
+		nodes, err = r.LoadLen(nil)
+		if err != nil {
+			return nil, err
+		}
+		rw.WriteLen(uint64(nodes))
+
+		for i := 0; i < nodes && err == nil; i++ {
+			err = m.maskEncodedString(r, rw, RDB_TYPE_LIST_ZIPLIST)
+		}
+	case RDB_TYPE_LIST_QUICKLIST_2:
+		var nodes int
+		nodes, err = r.LoadLen(nil)
+		if err != nil {
+			return nil, err
+		}
+		rw.WriteLen(uint64(nodes))
+
+		for i := 0; i < nodes && err == nil; i++ {
+			var container int
+			container, err = r.LoadLen(nil)
+			if err != nil {
+				return nil, err
+			}
+			rw.WriteLen(uint64(container))
+
+			// 大元素单独存为一个节点
+			if container == QUICKLIST_NODE_CONTAINER_PLAIN {
+				_, err = m.copyStringObject(r, raw, rw, true, nil)
+			} else {
+				err = m.maskEncodedString(r, rw, RDB_TYPE_LIST_QUICKLIST_2)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("can not anonymize object type %d", valType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = rw.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+/*
+* ziplist / listpack / intset 序列化为一个字符串，解压后原地脱敏
+ */
+func (m *Masker) maskEncodedString(r *Rdb, rw *RdbWriter, valType byte) error {
+	encodedStr, err := r.LoadStringObject()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	// member, score 交替存储，只对 member 脱敏
+	zsetEntry := func(i int, prev string) (bool, map[string]bool) { return i%2 == 0, used }
+	hashEntry := func(i int, prev string) (bool, map[string]bool) {
+		if i%2 == 0 {
+			return m.maskFields, used
+		}
+		return m.matchField(prev), nil
+	}
+	setEntry := func(i int, prev string) (bool, map[string]bool) { return true, used }
+	listEntry := func(i int, prev string) (bool, map[string]bool) { return true, nil }
+
+	buf := []byte(encodedStr)
+	switch valType {
+	case RDB_TYPE_SET_INTSET:
+		err = m.maskIntSet(buf)
+	case RDB_TYPE_ZSET_ZIPLIST:
+		err = m.maskZipList(buf, zsetEntry)
+	case RDB_TYPE_HASH_ZIPLIST:
+		err = m.maskZipList(buf, hashEntry)
+	case RDB_TYPE_ZSET_LISTPACK:
+		err = m.maskListPack(buf, zsetEntry)
+	case RDB_TYPE_HASH_LISTPACK:
+		err = m.maskListPack(buf, hashEntry)
+	case RDB_TYPE_SET_LISTPACK:
+		err = m.maskListPack(buf, setEntry)
+	case RDB_TYPE_LIST_QUICKLIST_2:
+		err = m.maskListPack(buf, listEntry)
+	default:
+		err = m.maskZipList(buf, listEntry)
+	}
+	if err != nil {
+		return err
+	}
+
+	return rw.WriteString(string(buf))
+}
+
+/*
+* 生成脱敏后的rdb文件
+ */
+func runAnonymize(args []string) error {
+	fs := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	output := fs.String("o", "", "output rdb file")
+	copyUnsupported := fs.Bool("copy-unsupported", false, "copy stream, module and field expiring hash values unmasked instead of dropping them")
+	newMasker := maskFlags(fs)
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" || len(files) != 1 {
+		return errors.New("usage: decode " + anonymizeUsage)
+	}
+	m, err := newMasker()
+	if err != nil {
+		return err
+	}
+	err = m.reserveKeys(files[0])
+	if err != nil {
+		return err
+	}
+
+	rdb, file, err := openRdbFile(files[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var rw *RdbWriter
+	lastDb := -1
+	var masked, unsupported int64
+	rdb.visitor = func(entry *KeyEntry) error {
+		delete(rdb.mapObj, entry.key)
+
+		// stream、模块类型和带字段过期时间的 hash 没有解析，无法脱敏
+		if entry.obj == nil && m.matchKey(entry.key) {
+			unsupported++
+			if !*copyUnsupported {
+				return nil
+			}
+		}
+
+		if rw == nil {
+			rw = NewRdbWriter(out, rdb.version)
+			rw.WriteHeader()
+		}
+		if entry.dbId != lastDb {
+			rw.WriteSelectDb(entry.dbId)
+			lastDb = entry.dbId
+		}
+
+		rawVal, err := entry.RawValue(rdb.fp)
+		if err != nil {
+			return err
+		}
+
+		key := entry.key
+		if entry.obj != nil && m.matchKey(key) {
+			rawVal, err = m.MaskValue(entry.valType, rawVal)
+			if err != nil {
+				return fmt.Errorf("anonymize key %s: %s", key, err)
+			}
+			key = m.MaskKey(entry.dbId, key)
+			masked++
+		}
+
+		return rw.WriteRawKey(key, entry.valType, rawVal, entry.expireTime)
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return err
+	}
+
+	if rw == nil {
+		rw = NewRdbWriter(out, rdb.version)
+		rw.WriteHeader()
+	}
+	err = rw.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Anonymized %d keys into %s\n", masked, *output)
+	if unsupported > 0 && *copyUnsupported {
+		fmt.Printf("Copied %d stream, module and field expiring hash keys unmasked\n", unsupported)
+	} else if unsupported > 0 {
+		fmt.Printf("Dropped %d stream, module and field expiring hash keys that can not be anonymized, use -copy-unsupported to keep them unmasked\n", unsupported)
+	}
+	return nil
+}
+
+/*
+* anonymize 和 export 共用的脱敏选项，解析参数后调用返回的函数创建 Masker
+ */
+func maskFlags(fs *flag.FlagSet) func() (*Masker, error) {
+	salt := fs.String("salt", "", "secret mixed into the hash, keep it private")
+	mode := fs.String("mode", MASK_FAKE, "hash: hex digits, fake: keep digits, letters and punctuation")
+	match := fs.String("match", "", "comma separated glob patterns of keys to anonymize, default all keys")
+	fields := fs.String("fields", "", "comma separated glob patterns of hash fields to anonymize, default all fields")
+	maskFields := fs.Bool("mask-fields", false, "anonymize hash field names too")
+	keySuffix := fs.Bool("key-suffix", false, "anonymize the part of the key after the first delimiter")
+	delim := fs.String("delim", ":", "key delimiter")
+
+	return func() (*Masker, error) {
+		if *mode != MASK_HASH && *mode != MASK_FAKE {
+			return nil, fmt.Errorf("unknown mode: %s", *mode)
+		}
+
+		return &Masker{
+			salt:       []byte(*salt),
+			mode:       *mode,
+			keyRules:   splitList(*match),
+			fieldRules: splitList(*fields),
+			maskFields: *maskFields,
+			keySuffix:  *keySuffix,
+			delim:      *delim,
+		}, nil
+	}
+}
+
+/*
+* 逗号分隔的列表，忽略空项
+ */
+func splitList(str string) []string {
+	var list []string
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
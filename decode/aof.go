@@ -0,0 +1,1172 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* redis 7 multi part aof 的文件类型 */
+const AOF_BASE = "b"
+const AOF_HISTORY = "h"
+const AOF_INCR = "i"
+
+/* 回放结束时最多列出的值可能不正确的key */
+const AOF_UNTRUSTED_SHOWN = 20
+
+/*
+* 回放 aof 中的命令，构建与 DecodeRDBFile 相同的对象
+ */
+type Aof struct {
+	dbs       map[int]map[string]*RedisObject
+	dbId      int
+	commands  int64
+	unknown   map[string]int64
+	untrusted map[int]map[string]bool
+	version   int
+	aux       map[string]string
+}
+
+func NewAof() *Aof {
+	return &Aof{dbs: make(map[int]map[string]*RedisObject), unknown: make(map[string]int64), untrusted: make(map[int]map[string]bool), aux: make(map[string]string)}
+}
+
+/*
+* 判断是否是 aof 文件：目录、manifest、.aof 后缀或者不以 REDIS 开头的文件
+ */
+func isAofPath(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if info.IsDir() || strings.HasSuffix(path, ".manifest") || strings.HasSuffix(path, ".aof") {
+		return true
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(file, buf)
+
+	return err == nil && string(buf) != "REDIS"
+}
+
+/*
+* 加载 aof，path 可以是 aof 文件、manifest 文件或者 appenddirname 目录
+ */
+func (a *Aof) LoadPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if err != nil {
+			return err
+		}
+		if len(manifests) != 1 {
+			return fmt.Errorf("expect one manifest file in %s, found %d", path, len(manifests))
+		}
+		path = manifests[0]
+	}
+
+	if strings.HasSuffix(path, ".manifest") {
+		return a.loadManifest(path)
+	}
+
+	return a.loadFile(path, true)
+}
+
+/*
+* manifest 每行格式: file <name> seq <seq> type <b|h|i>
+* 先加载 base 文件，再按顺序加载 incr 文件
+ */
+func (a *Aof) loadManifest(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	type aofInfo struct {
+		name    string
+		seq     int
+		fileTyp string
+	}
+
+	var base *aofInfo
+	var incrs []*aofInfo
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields, err := splitArgs(line)
+		if err != nil || len(fields)%2 != 0 {
+			return fmt.Errorf("invalid manifest line: %s", line)
+		}
+
+		info := &aofInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				info.seq, err = strconv.Atoi(fields[i+1])
+			case "type":
+				info.fileTyp = fields[i+1]
+			}
+		}
+		if err != nil || info.name == "" {
+			return fmt.Errorf("invalid manifest line: %s", line)
+		}
+
+		switch info.fileTyp {
+		case AOF_BASE:
+			base = info
+		case AOF_INCR:
+			incrs = append(incrs, info)
+		case AOF_HISTORY:
+		default:
+			return fmt.Errorf("invalid manifest file type: %s", line)
+		}
+	}
+
+	dir := filepath.Dir(path)
+	if base != nil {
+		err = a.loadFile(filepath.Join(dir, base.name), len(incrs) == 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.SliceStable(incrs, func(i, j int) bool { return incrs[i].seq < incrs[j].seq })
+	for i, incr := range incrs {
+		err = a.loadFile(filepath.Join(dir, incr.name), i == len(incrs)-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 加载一个文件，可能是纯 rdb、带 rdb 前缀的 aof 或者纯 aof
+* allowTruncated 为 true 时允许最后一条命令不完整
+ */
+func (a *Aof) loadFile(path string, allowTruncated bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset := int64(0)
+	buf := make([]byte, 5)
+	n, _ := file.ReadAt(buf, 0)
+	if n == 5 && string(buf) == "REDIS" {
+		rdb := NewRdb(file)
+		rdb.visitor = func(entry *KeyEntry) error {
+			if entry.obj == nil {
+				// stream 和 module 类型没有解析
+				a.untrust(entry.dbId, entry.key)
+				return nil
+			}
+			a.selectDb(entry.dbId)[entry.key] = entry.obj
+			return nil
+		}
+		err = rdb.DecodeRDBFile()
+		if err != nil {
+			return err
+		}
+		if rdb.version > a.version {
+			a.version = rdb.version
+		}
+		for k, v := range rdb.meta.Aux {
+			a.aux[k] = v
+		}
+
+		// 解析结束时已经读过了末尾的校验和
+		offset = rdb.curIndex
+		a.dbId = 0
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return a.replay(bufio.NewReader(file), path, allowTruncated)
+}
+
+/*
+* 读取一条 RESP 格式的命令，忽略 #TS: 等注释行
+ */
+func readAofCommand(r *bufio.Reader) ([]string, error) {
+	conn := &RespConn{r: r}
+	for {
+		peek, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if peek[0] != '#' {
+			break
+		}
+		_, err = r.ReadString('\n')
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+
+	reply, err := conn.ReadReply()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, fmt.Errorf("invalid aof command: %v", reply)
+	}
+
+	args := make([]string, len(items))
+	for i, item := range items {
+		if args[i], ok = item.(string); !ok {
+			return nil, fmt.Errorf("invalid aof command argument: %v", item)
+		}
+	}
+
+	return args, nil
+}
+
+func (a *Aof) replay(r *bufio.Reader, path string, allowTruncated bool) error {
+	for {
+		args, err := readAofCommand(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF && allowTruncated {
+			fmt.Fprintf(os.Stderr, "%s: last command is truncated, ignored\n", path)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		a.commands++
+		err = a.Apply(args)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", path, strings.Join(args, " "), err)
+		}
+	}
+}
+
+func (a *Aof) selectDb(dbId int) map[string]*RedisObject {
+	a.dbId = dbId
+	db, ok := a.dbs[dbId]
+	if !ok {
+		db = make(map[string]*RedisObject)
+		a.dbs[dbId] = db
+	}
+
+	return db
+}
+
+/*
+* 查找当前db中的key，类型不一致时返回错误，key不存在返回nil
+ */
+func (a *Aof) lookup(key string, objType int) (*RedisObject, error) {
+	obj, ok := a.dbs[a.dbId][key]
+	if !ok {
+		return nil, nil
+	}
+	if objType >= 0 && obj.objType != objType {
+		return nil, errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+
+	return obj, nil
+}
+
+/*
+* 查找key，不存在时创建
+ */
+func (a *Aof) lookupOrCreate(key string, objType int) (*RedisObject, error) {
+	obj, err := a.lookup(key, objType)
+	if obj != nil || err != nil {
+		return obj, err
+	}
+
+	var val interface{}
+	switch objType {
+	case RDB_TYPE_LIST:
+		val = make([]string, 0)
+	case RDB_TYPE_SET:
+		val = make(map[string]int)
+	case RDB_TYPE_ZSET:
+		val = make(map[string]float64)
+	case RDB_TYPE_HASH:
+		val = make(map[string]string)
+	default:
+		val = ""
+	}
+
+	obj = NewRedisObject(objType, 0, val)
+	a.selectDb(a.dbId)[key] = obj
+
+	return obj, nil
+}
+
+/*
+* 集合为空时删除key
+ */
+func (a *Aof) deleteIfEmpty(key string, obj *RedisObject) {
+	empty := false
+	switch val := obj.objVal.(type) {
+	case []string:
+		empty = len(val) == 0
+	case map[string]int:
+		empty = len(val) == 0
+	case map[string]float64:
+		empty = len(val) == 0
+	case map[string]string:
+		empty = len(val) == 0
+	}
+
+	if empty {
+		delete(a.dbs[a.dbId], key)
+	}
+}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (a *Aof) setString(key string, val string, expireTime int64) {
+	obj := NewRedisObject(RDB_TYPE_STRING, 0, val)
+	obj.expireTime = expireTime
+	a.selectDb(a.dbId)[key] = obj
+	delete(a.untrusted[a.dbId], key)
+}
+
+func parseExpire(str string, unit int64, absolute bool) (int64, error) {
+	t, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, errors.New("value is not an integer or out of range")
+	}
+
+	if absolute {
+		return t * unit, nil
+	}
+
+	return nowMs() + t*unit, nil
+}
+
+/*
+* 回放一条命令
+ */
+func (a *Aof) Apply(args []string) error {
+	cmd := strings.ToUpper(args[0])
+	argc := len(args)
+	if minArgs, ok := aofCommandArity[cmd]; ok && argc < minArgs {
+		return errors.New("wrong number of arguments")
+	}
+
+	switch cmd {
+	case "SELECT":
+		dbId, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		a.selectDb(dbId)
+	case "MULTI", "EXEC", "PING":
+	case "FLUSHALL":
+		a.dbs = make(map[int]map[string]*RedisObject)
+		a.untrusted = make(map[int]map[string]bool)
+	case "FLUSHDB":
+		delete(a.dbs, a.dbId)
+		delete(a.untrusted, a.dbId)
+	case "SWAPDB":
+		db1, err1 := strconv.Atoi(args[1])
+		db2, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return errors.New("invalid DB index")
+		}
+		cur := a.dbId
+		a.dbs[db1], a.dbs[db2] = a.selectDb(db2), a.selectDb(db1)
+		a.untrusted[db1], a.untrusted[db2] = a.untrusted[db2], a.untrusted[db1]
+		a.dbId = cur
+	case "DEL", "UNLINK", "GETDEL":
+		for _, key := range args[1:] {
+			delete(a.dbs[a.dbId], key)
+			delete(a.untrusted[a.dbId], key)
+		}
+	case "SET":
+		return a.applySet(args)
+	case "SETNX", "SETEX", "PSETEX", "GETSET":
+		expireTime := int64(-1)
+		val := args[2]
+		if cmd == "SETNX" {
+			if obj, _ := a.lookup(args[1], -1); obj != nil {
+				return nil
+			}
+		} else if cmd == "SETEX" || cmd == "PSETEX" {
+			unit := int64(1000)
+			if cmd == "PSETEX" {
+				unit = 1
+			}
+			var err error
+			expireTime, err = parseExpire(args[2], unit, false)
+			if err != nil {
+				return err
+			}
+			val = args[3]
+		}
+		a.setString(args[1], val, expireTime)
+	case "MSET":
+		for i := 1; i+1 < argc; i += 2 {
+			a.setString(args[i], args[i+1], -1)
+		}
+	case "APPEND":
+		obj, err := a.lookupOrCreate(args[1], RDB_TYPE_STRING)
+		if err != nil {
+			return err
+		}
+		obj.objVal = obj.objVal.(string) + args[2]
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		obj, err := a.lookupOrCreate(args[1], RDB_TYPE_STRING)
+		if err != nil {
+			return err
+		}
+		cur := int64(0)
+		if obj.objVal.(string) != "" {
+			cur, err = strconv.ParseInt(obj.objVal.(string), 10, 64)
+			if err != nil {
+				return errors.New("value is not an integer or out of range")
+			}
+		}
+		incr := int64(1)
+		if argc > 2 {
+			incr, err = strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return errors.New("value is not an integer or out of range")
+			}
+		}
+		if cmd == "DECR" || cmd == "DECRBY" {
+			incr = -incr
+		}
+		obj.objVal = strconv.FormatInt(cur+incr, 10)
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT":
+		obj, err := a.lookup(args[1], -1)
+		if obj == nil || err != nil {
+			return err
+		}
+		unit := int64(1000)
+		if cmd[0] == 'P' {
+			unit = 1
+		}
+		obj.expireTime, err = parseExpire(args[2], unit, strings.HasSuffix(cmd, "AT"))
+		return err
+	case "PERSIST":
+		if obj, _ := a.lookup(args[1], -1); obj != nil {
+			obj.expireTime = -1
+		}
+	case "RENAME", "RENAMENX":
+		obj, _ := a.lookup(args[1], -1)
+		if obj == nil {
+			return nil
+		}
+		if cmd == "RENAMENX" {
+			if dst, _ := a.lookup(args[2], -1); dst != nil {
+				return nil
+			}
+		}
+		delete(a.dbs[a.dbId], args[1])
+		a.dbs[a.dbId][args[2]] = obj
+		delete(a.untrusted[a.dbId], args[2])
+		if a.untrusted[a.dbId][args[1]] {
+			delete(a.untrusted[a.dbId], args[1])
+			a.untrust(a.dbId, args[2])
+		}
+	case "RPUSH", "LPUSH", "RPUSHX", "LPUSHX":
+		if strings.HasSuffix(cmd, "X") {
+			if obj, err := a.lookup(args[1], RDB_TYPE_LIST); obj == nil || err != nil {
+				return err
+			}
+		}
+		obj, err := a.lookupOrCreate(args[1], RDB_TYPE_LIST)
+		if err != nil {
+			return err
+		}
+		list := obj.objVal.([]string)
+		for _, item := range args[2:] {
+			if cmd[0] == 'R' {
+				list = append(list, item)
+			} else {
+				list = append([]string{item}, list...)
+			}
+		}
+		obj.objVal = list
+	case "LPOP", "RPOP":
+		obj, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if obj == nil || err != nil {
+			return err
+		}
+		count := 1
+		if argc > 2 {
+			count, err = strconv.Atoi(args[2])
+			if err != nil {
+				return err
+			}
+		}
+		list := obj.objVal.([]string)
+		if count > len(list) {
+			count = len(list)
+		}
+		if cmd == "LPOP" {
+			obj.objVal = list[count:]
+		} else {
+			obj.objVal = list[:len(list)-count]
+		}
+		a.deleteIfEmpty(args[1], obj)
+	case "LSET":
+		obj, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if obj == nil || err != nil {
+			return errors.New("no such key")
+		}
+		list := obj.objVal.([]string)
+		index, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		if index < 0 {
+			index += len(list)
+		}
+		if index < 0 || index >= len(list) {
+			return errors.New("index out of range")
+		}
+		list[index] = args[3]
+	case "LTRIM":
+		obj, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if obj == nil || err != nil {
+			return err
+		}
+		list := obj.objVal.([]string)
+		start, end, err := listRange(args[2], args[3], len(list))
+		if err != nil {
+			return err
+		}
+		obj.objVal = append([]string(nil), list[start:end]...)
+		a.deleteIfEmpty(args[1], obj)
+	case "LREM":
+		obj, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if obj == nil || err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+		obj.objVal = listRemove(obj.objVal.([]string), count, args[3])
+		a.deleteIfEmpty(args[1], obj)
+	case "LINSERT":
+		obj, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if obj == nil || err != nil {
+			return err
+		}
+		list := obj.objVal.([]string)
+		for i, item := range list {
+			if item != args[3] {
+				continue
+			}
+			if strings.ToUpper(args[2]) == "AFTER" {
+				i++
+			}
+			list = append(list[:i], append([]string{args[4]}, list[i:]...)...)
+			break
+		}
+		obj.objVal = list
+	case "RPOPLPUSH", "LMOVE":
+		src, err := a.lookup(args[1], RDB_TYPE_LIST)
+		if src == nil || err != nil {
+			return err
+		}
+		from, to := "RIGHT", "LEFT"
+		if cmd == "LMOVE" {
+			from, to = strings.ToUpper(args[3]), strings.ToUpper(args[4])
+		}
+		list := src.objVal.([]string)
+		var item string
+		if from == "LEFT" {
+			item, src.objVal = list[0], list[1:]
+		} else {
+			item, src.objVal = list[len(list)-1], list[:len(list)-1]
+		}
+		a.deleteIfEmpty(args[1], src)
+		pushCmd := "RPUSH"
+		if to == "LEFT" {
+			pushCmd = "LPUSH"
+		}
+		return a.Apply([]string{pushCmd, args[2], item})
+	case "SADD", "SREM":
+		var obj *RedisObject
+		var err error
+		if cmd == "SADD" {
+			obj, err = a.lookupOrCreate(args[1], RDB_TYPE_SET)
+		} else {
+			obj, err = a.lookup(args[1], RDB_TYPE_SET)
+		}
+		if obj == nil || err != nil {
+			return err
+		}
+		set := obj.objVal.(map[string]int)
+		for _, member := range args[2:] {
+			if cmd == "SADD" {
+				set[member] = 1
+			} else {
+				delete(set, member)
+			}
+		}
+		a.deleteIfEmpty(args[1], obj)
+	case "SMOVE":
+		src, err := a.lookup(args[1], RDB_TYPE_SET)
+		if src == nil || err != nil {
+			return err
+		}
+		if _, ok := src.objVal.(map[string]int)[args[3]]; !ok {
+			return nil
+		}
+		err = a.Apply([]string{"SREM", args[1], args[3]})
+		if err != nil {
+			return err
+		}
+		return a.Apply([]string{"SADD", args[2], args[3]})
+	case "HSET", "HMSET", "HSETNX":
+		if argc%2 != 0 {
+			return errors.New("wrong number of arguments")
+		}
+		obj, err := a.lookupOrCreate(args[1], RDB_TYPE_HASH)
+		if err != nil {
+			return err
+		}
+		hash := obj.objVal.(map[string]string)
+		for i := 2; i+1 < argc; i += 2 {
+			if _, ok := hash[args[i]]; ok && cmd == "HSETNX" {
+				continue
+			}
+			hash[args[i]] = args[i+1]
+		}
+	case "HDEL":
+		obj, err := a.lookup(args[1], RDB_TYPE_HASH)
+		if obj == nil || err != nil {
+			return err
+		}
+		for _, field := range args[2:] {
+			delete(obj.objVal.(map[string]string), field)
+		}
+		a.deleteIfEmpty(args[1], obj)
+	case "HINCRBY":
+		obj, err := a.lookupOrCreate(args[1], RDB_TYPE_HASH)
+		if err != nil {
+			return err
+		}
+		hash := obj.objVal.(map[string]string)
+		cur := int64(0)
+		if val, ok := hash[args[2]]; ok {
+			cur, err = strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return errors.New("hash value is not an integer")
+			}
+		}
+		incr, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return errors.New("value is not an integer or out of range")
+		}
+		hash[args[2]] = strconv.FormatInt(cur+incr, 10)
+	case "ZADD":
+		return a.applyZadd(args)
+	case "ZINCRBY":
+		return a.applyZadd([]string{"ZADD", args[1], "INCR", args[2], args[3]})
+	case "ZREM":
+		obj, err := a.lookup(args[1], RDB_TYPE_ZSET)
+		if obj == nil || err != nil {
+			return err
+		}
+		for _, member := range args[2:] {
+			delete(obj.objVal.(map[string]float64), member)
+		}
+		a.deleteIfEmpty(args[1], obj)
+	default:
+		// 不认识的命令（例如新版本或者模块的命令）按第一个参数是key处理
+		untrust, ok := aofUnsupported[cmd]
+		if !ok {
+			untrust = untrustFirst
+		}
+		a.unknown[cmd]++
+		if argc > 1 {
+			untrust(a, args)
+		}
+	}
+
+	return nil
+}
+
+/*
+* 标记被不支持的命令修改过的key，回放结果中这些key的值可能不正确
+ */
+func (a *Aof) untrust(dbId int, key string) {
+	if a.untrusted[dbId] == nil {
+		a.untrusted[dbId] = make(map[string]bool)
+	}
+	a.untrusted[dbId][key] = true
+}
+
+func untrustFirst(a *Aof, args []string) {
+	a.untrust(a.dbId, args[1])
+}
+
+func untrustSecond(a *Aof, args []string) {
+	if len(args) > 2 {
+		a.untrust(a.dbId, args[2])
+	}
+}
+
+/*
+* 脚本和函数只能确定声明的key：EVAL script numkeys key...
+ */
+func untrustScriptKeys(a *Aof, args []string) {
+	if len(args) < 3 {
+		return
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil {
+		return
+	}
+	for i := 3; i < len(args) && i < 3+numKeys; i++ {
+		a.untrust(a.dbId, args[i])
+	}
+}
+
+func untrustNothing(a *Aof, args []string) {}
+
+/*
+* 不支持回放的写命令，以及标记它们修改的key的方法
+* 不在这里的命令无法确定修改了哪些key，只标记第一个参数
+ */
+var aofUnsupported = map[string]func(a *Aof, args []string){
+	"SETRANGE": untrustFirst, "SETBIT": untrustFirst, "BITFIELD": untrustFirst, "INCRBYFLOAT": untrustFirst,
+	"GETEX": untrustFirst, "HINCRBYFLOAT": untrustFirst, "RESTORE": untrustFirst, "PFADD": untrustFirst,
+	"SPOP": untrustFirst, "ZPOPMIN": untrustFirst, "ZPOPMAX": untrustFirst,
+	"ZREMRANGEBYSCORE": untrustFirst, "ZREMRANGEBYRANK": untrustFirst, "ZREMRANGEBYLEX": untrustFirst, "GEOADD": untrustFirst,
+	"HEXPIRE": untrustFirst, "HPEXPIRE": untrustFirst, "HEXPIREAT": untrustFirst, "HPEXPIREAT": untrustFirst, "HPERSIST": untrustFirst,
+	"SINTERSTORE": untrustFirst, "SUNIONSTORE": untrustFirst, "SDIFFSTORE": untrustFirst,
+	"ZINTERSTORE": untrustFirst, "ZUNIONSTORE": untrustFirst, "ZDIFFSTORE": untrustFirst, "ZRANGESTORE": untrustFirst,
+	"GEOSEARCHSTORE": untrustFirst, "PFMERGE": untrustFirst, "BITOP": untrustSecond,
+	"XADD": untrustFirst, "XDEL": untrustFirst, "XTRIM": untrustFirst, "XSETID": untrustFirst, "XACK": untrustFirst,
+	"XCLAIM": untrustFirst, "XAUTOCLAIM": untrustFirst, "XGROUP": untrustSecond,
+	"EVAL": untrustScriptKeys, "EVALSHA": untrustScriptKeys, "FCALL": untrustScriptKeys,
+	"FUNCTION": untrustNothing, "SCRIPT": untrustNothing,
+	"MSETNX": func(a *Aof, args []string) {
+		for i := 1; i < len(args); i += 2 {
+			a.untrust(a.dbId, args[i])
+		}
+	},
+	// COPY source destination [DB destination-db] [REPLACE]
+	"COPY": func(a *Aof, args []string) {
+		dbId := a.dbId
+		for i := 3; i+1 < len(args); i++ {
+			if strings.ToUpper(args[i]) == "DB" {
+				if n, err := strconv.Atoi(args[i+1]); err == nil {
+					dbId = n
+				}
+			}
+		}
+		if len(args) > 2 {
+			a.untrust(dbId, args[2])
+		}
+	},
+	// MOVE key db
+	"MOVE": func(a *Aof, args []string) {
+		a.untrust(a.dbId, args[1])
+		if len(args) > 2 {
+			if n, err := strconv.Atoi(args[2]); err == nil {
+				a.untrust(n, args[1])
+			}
+		}
+	},
+}
+
+/* 各命令的最少参数个数（包括命令本身） */
+var aofCommandArity = map[string]int{
+	"SELECT": 2, "SWAPDB": 3, "DEL": 2, "UNLINK": 2, "GETDEL": 2,
+	"SET": 3, "SETNX": 3, "SETEX": 4, "PSETEX": 4, "GETSET": 3, "MSET": 3, "APPEND": 3,
+	"INCR": 2, "DECR": 2, "INCRBY": 3, "DECRBY": 3,
+	"EXPIRE": 3, "PEXPIRE": 3, "EXPIREAT": 3, "PEXPIREAT": 3, "PERSIST": 2, "RENAME": 3, "RENAMENX": 3,
+	"RPUSH": 3, "LPUSH": 3, "RPUSHX": 3, "LPUSHX": 3, "LPOP": 2, "RPOP": 2, "LSET": 4, "LTRIM": 4,
+	"LREM": 4, "LINSERT": 5, "RPOPLPUSH": 3, "LMOVE": 5,
+	"SADD": 3, "SREM": 3, "SMOVE": 4,
+	"HSET": 4, "HMSET": 4, "HSETNX": 4, "HDEL": 3, "HINCRBY": 4,
+	"ZADD": 4, "ZINCRBY": 4, "ZREM": 3,
+}
+
+/*
+* SET key value [NX|XX] [GET] [EX s|PX ms|EXAT s|PXAT ms|KEEPTTL]
+ */
+func (a *Aof) applySet(args []string) error {
+	key := args[1]
+	expireTime := int64(-1)
+	keepTtl, nx, xx := false, false, false
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+		case "KEEPTTL":
+			keepTtl = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) {
+				return errors.New("syntax error")
+			}
+			unit := int64(1000)
+			if opt[0] == 'P' {
+				unit = 1
+			}
+			var err error
+			expireTime, err = parseExpire(args[i+1], unit, strings.HasSuffix(opt, "AT"))
+			if err != nil {
+				return err
+			}
+			i++
+		default:
+			return errors.New("syntax error")
+		}
+	}
+
+	old, _ := a.lookup(key, -1)
+	if (nx && old != nil) || (xx && old == nil) {
+		return nil
+	}
+	if keepTtl && old != nil {
+		expireTime = old.expireTime
+	}
+	a.setString(key, args[2], expireTime)
+
+	return nil
+}
+
+/*
+* ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+ */
+func (a *Aof) applyZadd(args []string) error {
+	nx, xx, gt, lt, incr := false, false, false, false, false
+	i := 2
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+		case "INCR":
+			incr = true
+		default:
+			goto members
+		}
+	}
+members:
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errors.New("syntax error")
+	}
+
+	obj, err := a.lookupOrCreate(args[1], RDB_TYPE_ZSET)
+	if err != nil {
+		return err
+	}
+	zset := obj.objVal.(map[string]float64)
+	for j := 0; j < len(pairs); j += 2 {
+		score, err := parseScore(pairs[j])
+		if err != nil {
+			return err
+		}
+
+		member := pairs[j+1]
+		cur, exists := zset[member]
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		if incr && exists {
+			score += cur
+		}
+		if exists && ((gt && score <= cur) || (lt && score >= cur)) {
+			continue
+		}
+		zset[member] = score
+	}
+	a.deleteIfEmpty(args[1], obj)
+
+	return nil
+}
+
+/*
+* 解析 redis 的浮点数，支持 inf, +inf, -inf
+ */
+func parseScore(str string) (float64, error) {
+	switch strings.ToLower(str) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+
+	score, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("value is not a valid float")
+	}
+
+	return score, nil
+}
+
+/*
+* 按 redis 的规则把 start, end 转换为切片下标，支持负数
+ */
+func listRange(startStr string, endStr string, length int) (int, int, error) {
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := strconv.Atoi(endStr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || start >= length {
+		return 0, 0, nil
+	}
+
+	return start, end + 1, nil
+}
+
+/*
+* LREM: count > 0 从头部删除 count 个，count < 0 从尾部删除，count = 0 删除全部
+ */
+func listRemove(list []string, count int, val string) []string {
+	result := make([]string, 0, len(list))
+	if count >= 0 {
+		removed := 0
+		for _, item := range list {
+			if item == val && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			result = append(result, item)
+		}
+		return result
+	}
+
+	removed := 0
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i] == val && removed < -count {
+			removed++
+			continue
+		}
+		result = append(result, list[i])
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+
+	return result
+}
+
+/*
+* 估算对象序列化后的长度，与 rdb 解析出的 objLen 含义相近
+ */
+func estimateObjLen(obj *RedisObject) int64 {
+	length := int64(0)
+	switch val := obj.objVal.(type) {
+	case string:
+		length = int64(len(val))
+	case []string:
+		for _, item := range val {
+			length += int64(len(item))
+		}
+	case map[string]int:
+		for member := range val {
+			length += int64(len(member))
+		}
+	case map[string]float64:
+		for member := range val {
+			length += int64(len(member)) + 8
+		}
+	case map[string]string:
+		for field, value := range val {
+			length += int64(len(field) + len(value))
+		}
+	}
+
+	return length
+}
+
+func (a *Aof) printSummary() {
+	fmt.Printf("Replayed %d commands\n", a.commands)
+	for cmd, count := range a.unknown {
+		if _, ok := aofUnsupported[cmd]; ok {
+			fmt.Printf("Unsupported command %s ignored %d times\n", cmd, count)
+		} else {
+			fmt.Printf("Unknown command %s ignored %d times, assuming its first argument is the key it modifies\n", cmd, count)
+		}
+	}
+
+	keys := a.untrustedKeys()
+	if len(keys) == 0 {
+		return
+	}
+	fmt.Printf("Warning: %d keys were modified by unsupported commands or not parsed, their values may be stale or missing:\n", len(keys))
+	for i, key := range keys {
+		if i == AOF_UNTRUSTED_SHOWN {
+			fmt.Printf("  ... and %d more\n", len(keys)-i)
+			break
+		}
+		fmt.Printf("  %s\n", key)
+	}
+}
+
+/*
+* 值可能不正确的key，按 db 和 key 排序，格式为 db:key
+ */
+func (a *Aof) untrustedKeys() []string {
+	dbIds := make([]int, 0, len(a.untrusted))
+	for dbId := range a.untrusted {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+
+	var keys []string
+	for _, dbId := range dbIds {
+		dbKeys := make([]string, 0, len(a.untrusted[dbId]))
+		for key := range a.untrusted[dbId] {
+			dbKeys = append(dbKeys, key)
+		}
+		sort.Strings(dbKeys)
+		for _, key := range dbKeys {
+			keys = append(keys, strconv.Itoa(dbId)+":"+key)
+		}
+	}
+
+	return keys
+}
+
+/*
+* 转换为 Rdb，不同 db 中同名的 key 以较大的 db 为准，与解析 rdb 文件时一致
+ */
+func (a *Aof) ToRdb() *Rdb {
+	rdb := NewRdb(nil)
+	rdb.version = a.version
+	rdb.meta.Version = a.version
+	for k, v := range a.aux {
+		rdb.meta.setAux(k, v)
+	}
+
+	dbIds := make([]int, 0, len(a.dbs))
+	for dbId := range a.dbs {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+
+	for _, dbId := range dbIds {
+		for key, obj := range a.dbs[dbId] {
+			obj.objLen = estimateObjLen(obj)
+			rdb.mapObj[key] = obj
+			rdb.meta.addKey(dbId, obj)
+		}
+	}
+
+	return rdb
+}
+
+/*
+* 按 redis 的规则拆分参数，支持双引号和单引号
+ */
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		if line[i] != '"' && line[i] != '\'' {
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			args = append(args, line[start:i])
+			continue
+		}
+
+		quote := line[i]
+		end := i + 1
+		for ; end < len(line); end++ {
+			if line[end] == '\\' && quote == '"' {
+				end++
+				continue
+			}
+			if line[end] == quote {
+				break
+			}
+		}
+		if end >= len(line) {
+			return nil, errors.New("unbalanced quotes")
+		}
+
+		arg := line[i+1 : end]
+		if quote == '"' {
+			var err error
+			arg, err = unescapeString(arg)
+			if err != nil {
+				return nil, err
+			}
+		}
+		args = append(args, arg)
+		i = end + 1
+	}
+}
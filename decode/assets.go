@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+/*
+* web页面编译进可执行文件，不依赖运行时的工作目录
+ */
+//go:embed www
+var wwwFiles embed.FS
+
+/* 全局选项：开发时直接读取这个目录下的页面，修改页面后不需要重新编译 */
+var serverWwwDir = ""
+
+/*
+* 静态资源的文件系统，设置了 -www 时使用磁盘上的目录
+ */
+func wwwFileSystem() (http.FileSystem, error) {
+	if serverWwwDir != "" {
+		return http.Dir(serverWwwDir), nil
+	}
+
+	sub, err := fs.Sub(wwwFiles, "www")
+	if err != nil {
+		return nil, err
+	}
+
+	return http.FS(sub), nil
+}
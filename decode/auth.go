@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const Unauthorized = 1005
+
+/* 登录凭据也可以通过环境变量设置，避免出现在进程列表中 */
+const AUTH_ENV = "RDB_DECODE_AUTH"
+const TOKEN_ENV = "RDB_DECODE_TOKEN"
+
+/* 浏览器中保存 token 的 cookie */
+const TOKEN_COOKIE = "rdb_token"
+
+/* 全局选项：basic auth 的 user:password 和访问 token */
+var serverAuth = ""
+var serverToken = ""
+
+/*
+* web服务的认证，同时设置 basic auth 和 token 时满足任意一个即可，都没有设置时不认证
+* token 可以放在 Authorization: Bearer 头、token 参数或者 cookie 中
+* 通过 token 参数访问后写入 cookie，之后浏览器的请求不需要再带参数
+ */
+type Authenticator struct {
+	user     string
+	password string
+	token    string
+	path     string
+}
+
+func NewAuthenticator(auth, token, base string) (*Authenticator, error) {
+	if auth == "" {
+		auth = os.Getenv(AUTH_ENV)
+	}
+	if token == "" {
+		token = os.Getenv(TOKEN_ENV)
+	}
+
+	a := &Authenticator{token: token, path: base + "/"}
+	if auth != "" {
+		pos := strings.Index(auth, ":")
+		if pos <= 0 {
+			return nil, errors.New("basic auth must be user:password")
+		}
+		a.user, a.password = auth[:pos], auth[pos+1:]
+	}
+
+	return a, nil
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a *Authenticator) checkBasic(r *http.Request) bool {
+	if a.user == "" {
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+
+	return ok && secureEqual(user, a.user) && secureEqual(password, a.password)
+}
+
+/*
+* 检查 token，通过 token 参数认证时返回 true 的同时需要写入 cookie
+ */
+func (a *Authenticator) checkToken(r *http.Request) (bool, bool) {
+	if a.token == "" {
+		return false, false
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") && secureEqual(strings.TrimPrefix(header, "Bearer "), a.token) {
+		return true, false
+	}
+	if cookie, err := r.Cookie(TOKEN_COOKIE); err == nil && secureEqual(cookie.Value, a.token) {
+		return true, false
+	}
+	if secureEqual(r.URL.Query().Get("token"), a.token) {
+		return true, true
+	}
+
+	return false, false
+}
+
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	if a.user == "" && a.token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, setCookie := a.checkToken(r)
+		if setCookie {
+			http.SetCookie(w, &http.Cookie{Name: TOKEN_COOKIE, Value: a.token, Path: a.path, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+		}
+		if ok || a.checkBasic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if a.user != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="redis rdb tools", charset="UTF-8"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		writeResult(w, &ReturnResult{Unauthorized, "unauthorized", nil})
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/* 全局选项：解析协程数和是否按文件顺序交付结果，默认顺序解析 */
+var decodeWorkers = 1
+var decodeUnordered = false
+
+/*
+* 子命令，参数为命令名之后的参数列表
+ */
+type Command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*Command{
+	"merge":     {mergeUsage, runMerge},
+	"split":     {splitUsage, runSplit},
+	"anonymize": {anonymizeUsage, runAnonymize},
+	"restore":   {restoreUsage, runRestore},
+	"dump":      {dumpUsage, runDump},
+	"undump":    {undumpUsage, runUndump},
+	"fetch":     {fetchUsage, runFetch},
+	"convert":   {convertUsage, runConvert},
+	"advise":    {adviseUsage, runAdvise},
+	"ttl":       {ttlUsage, runTtl},
+	"stats":     {statsUsage, runStats},
+	"index":     {indexUsage, runIndex},
+	"get":       {getUsage, runGet},
+	"info":      {infoUsage, runInfo},
+	"export":    {exportUsage, runExport},
+	"serve":     {serveUsage, runServe},
+}
+
+func printUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  decode [-workers n] [-unordered] [-upload] [-upload-limit mb] [-upload-dir dir] [name=]path[eg:/home/root/dump.rdb] [[name=]path ...]")
+	fmt.Println("         [-listen :5763] [-tls-cert file -tls-key file] [-base-path /rdb] [-auth user:password] [-token token] [-www dir]")
+	fmt.Println("  decode [-workers n] [-unordered] command args...")
+	for _, cmd := range commands {
+		fmt.Printf("  decode %s\n", cmd.usage)
+	}
+}
+
+/*
+* 解析参数，允许选项和位置参数混排，返回位置参数
+ */
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	return positional, nil
+}
+
+/*
+* 打开rdb文件
+ */
+func openRdbFile(rdbFile string) (*Rdb, *os.File, error) {
+	if !PathExists(rdbFile) {
+		return nil, nil, fmt.Errorf("File: %s not exists, please check your file path", rdbFile)
+	}
+
+	file, err := os.Open(rdbFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rdb := NewRdb(file)
+	rdb.SetWorkers(decodeWorkers, !decodeUnordered)
+
+	return rdb, file, nil
+}
+
+/*
+* 解析命令之前的全局选项，返回剩下的参数
+ */
+func parseGlobalArgs(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.IntVar(&decodeWorkers, "workers", decodeWorkers, "goroutines decoding values in parallel, 1 to decode sequentially")
+	fs.BoolVar(&decodeUnordered, "unordered", decodeUnordered, "deliver keys as soon as they are decoded instead of in file order")
+	fs.BoolVar(&uploadEnabled, "upload", uploadEnabled, "allow uploading rdb files in the web page")
+	fs.Int64Var(&uploadLimitMb, "upload-limit", uploadLimitMb, "max size in MB of an uploaded file, after decompression")
+	fs.StringVar(&uploadDir, "upload-dir", uploadDir, "directory for uploaded files while parsing, default is the system temp directory")
+	fs.StringVar(&serverListen, "listen", serverListen, "listen address of the web server")
+	fs.StringVar(&serverTlsCert, "tls-cert", serverTlsCert, "certificate file, serve https together with -tls-key")
+	fs.StringVar(&serverTlsKey, "tls-key", serverTlsKey, "private key file of the certificate")
+	fs.StringVar(&serverBasePath, "base-path", serverBasePath, "url path prefix when running behind a reverse proxy, eg: /rdb")
+	fs.StringVar(&serverAuth, "auth", serverAuth, "basic auth user:password, or set "+AUTH_ENV)
+	fs.StringVar(&serverToken, "token", serverToken, "access token in Authorization: Bearer header or token parameter, or set "+TOKEN_ENV)
+	fs.StringVar(&serverWwwDir, "www", serverWwwDir, "serve the web page from this directory instead of the embedded files, for development")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Args(), nil
+}
+
+/*
+* 遍历 rdb 或 aof 文件中的所有key，rdb 文件边解析边回调，不保留解析后的对象
+* @return 文件的元数据
+ */
+func scanObjects(path string, fn func(dbId int, key string, obj *RedisObject) error) (*Metadata, error) {
+	return scanKeys(path, fn, nil)
+}
+
+/*
+* 同 scanObjects，没有解析的 stream 和 module 类型的key回调 unparsed
+ */
+func scanKeys(path string, fn func(dbId int, key string, obj *RedisObject) error, unparsed func(entry *KeyEntry) error) (*Metadata, error) {
+	if isAofPath(path) {
+		aof := NewAof()
+		err := aof.LoadPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// ToRdb 会估算每个对象的大小
+		meta := aof.ToRdb().meta
+		for _, dbId := range sortedDbIds(aof.dbs) {
+			db := aof.dbs[dbId]
+			for _, key := range sortedObjKeys(db) {
+				err = fn(dbId, key, db[key])
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		return meta, nil
+	}
+
+	rdb, file, err := openRdbFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rdb.visitor = func(entry *KeyEntry) error {
+		delete(rdb.mapObj, entry.key)
+		if entry.obj == nil {
+			if unparsed != nil {
+				return unparsed(entry)
+			}
+			return nil
+		}
+
+		return fn(entry.dbId, entry.key, entry.obj)
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return rdb.meta, nil
+}
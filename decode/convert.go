@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const convertUsage = "convert input -o output -to rdb|aof [-batch 1000]"
+
+const FORMAT_RDB = "rdb"
+const FORMAT_AOF = "aof"
+
+/*
+* aof 与 rdb 相互转换
+* 输入为 aof 时先回放所有命令，输入为 rdb 时边解析边输出
+ */
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	output := fs.String("o", "", "output file")
+	to := fs.String("to", "", "output format: rdb or aof")
+	batch := fs.Int("batch", COMMAND_BATCH, "max elements per command when writing aof")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" || len(files) != 1 || (*to != FORMAT_RDB && *to != FORMAT_AOF) || *batch < 1 {
+		return errors.New("usage: decode " + convertUsage)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var keys int64
+	if isAofPath(files[0]) {
+		aof := NewAof()
+		err = aof.LoadPath(files[0])
+		if err != nil {
+			return err
+		}
+		aof.printSummary()
+
+		if *to == FORMAT_RDB {
+			keys, err = writeAofAsRdb(aof, out)
+		} else {
+			keys, err = writeAofAsAof(aof, out, *batch)
+		}
+	} else {
+		keys, err = convertRdb(files[0], out, *to, *batch)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Converted %d keys into %s\n", keys, *output)
+	return nil
+}
+
+func sortedDbIds(dbs map[int]map[string]*RedisObject) []int {
+	dbIds := make([]int, 0, len(dbs))
+	for dbId := range dbs {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+
+	return dbIds
+}
+
+func sortedObjKeys(db map[string]*RedisObject) []string {
+	keys := make([]string, 0, len(db))
+	for key := range db {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func writeAofAsRdb(aof *Aof, out *os.File) (int64, error) {
+	var keys int64
+	rw := NewRdbWriter(out, REDIS_VERSION)
+	rw.WriteHeader()
+	for _, dbId := range sortedDbIds(aof.dbs) {
+		db := aof.dbs[dbId]
+		if len(db) == 0 {
+			continue
+		}
+
+		expires := 0
+		for _, obj := range db {
+			if obj.expireTime >= 0 {
+				expires++
+			}
+		}
+		rw.WriteSelectDb(dbId)
+		rw.WriteResizeDb(len(db), expires)
+
+		for _, key := range sortedObjKeys(db) {
+			err := rw.WriteObject(key, db[key])
+			if err != nil {
+				return keys, err
+			}
+			keys++
+		}
+	}
+
+	return keys, rw.Close()
+}
+
+/*
+* 以 aof 格式输出对象，db 变化时写入 SELECT
+ */
+type AofWriter struct {
+	conn  *RespConn
+	dbId  int
+	batch int
+}
+
+func NewAofWriter(w io.Writer, batch int) *AofWriter {
+	return &AofWriter{&RespConn{w: bufio.NewWriter(w)}, -1, batch}
+}
+
+func (aw *AofWriter) WriteObject(dbId int, key string, obj *RedisObject) error {
+	if obj == nil {
+		// stream 和 module 类型没有解析
+		return nil
+	}
+	if dbId != aw.dbId {
+		aw.conn.WriteCommand("SELECT", strconv.Itoa(dbId))
+		aw.dbId = dbId
+	}
+
+	for _, cmd := range objectCommands(key, obj, obj.expireTime, aw.batch) {
+		err := aw.conn.WriteCommand(cmd...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (aw *AofWriter) Flush() error {
+	return aw.conn.Flush()
+}
+
+/*
+* 重写 aof，每个key只保留重建它所需的命令
+ */
+func writeAofAsAof(aof *Aof, out *os.File, batch int) (int64, error) {
+	var keys int64
+	aw := NewAofWriter(out, batch)
+	for _, dbId := range sortedDbIds(aof.dbs) {
+		db := aof.dbs[dbId]
+		for _, key := range sortedObjKeys(db) {
+			err := aw.WriteObject(dbId, key, db[key])
+			if err != nil {
+				return keys, err
+			}
+			keys++
+		}
+	}
+
+	return keys, aw.Flush()
+}
+
+/*
+* 边解析 rdb 边输出，输出 rdb 时直接复制 value 的序列化数据
+ */
+func convertRdb(rdbFile string, out *os.File, to string, batch int) (int64, error) {
+	rdb, file, err := openRdbFile(rdbFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var keys, skipped int64
+	var rw *RdbWriter
+	aw := NewAofWriter(out, batch)
+	lastDb := -1
+	rdb.visitor = func(entry *KeyEntry) error {
+		defer delete(rdb.mapObj, entry.key)
+
+		if to == FORMAT_AOF {
+			if entry.obj == nil {
+				// stream 和 module 类型没有解析，不能转换为命令
+				skipped++
+				return nil
+			}
+			keys++
+			return aw.WriteObject(entry.dbId, entry.key, entry.obj)
+		}
+		keys++
+
+		if rw == nil {
+			rw = NewRdbWriter(out, rdb.version)
+			rw.WriteHeader()
+		}
+		if entry.dbId != lastDb {
+			rw.WriteSelectDb(entry.dbId)
+			lastDb = entry.dbId
+		}
+
+		rawVal, err := entry.RawValue(rdb.fp)
+		if err != nil {
+			return err
+		}
+
+		return rw.WriteRawKey(entry.key, entry.valType, rawVal, entry.expireTime)
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return keys, err
+	}
+
+	if to == FORMAT_AOF {
+		if skipped > 0 {
+			fmt.Printf("Skipped %d stream, module or field expiring hash keys that can not be written as commands\n", skipped)
+		}
+		return keys, aw.Flush()
+	}
+
+	if rw == nil {
+		rw = NewRdbWriter(out, rdb.version)
+		rw.WriteHeader()
+	}
+
+	return keys, rw.Close()
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"hash/crc64"
+)
+
+/*
+* redis 使用的 crc64 (Jones 多项式，反射输入输出，初始值0，不做最终异或)
+* 标准库的 crc64 在计算前后都会取反，这里抵消掉
+ */
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Update(crc uint64, buf []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, buf)
+}
@@ -5,13 +5,30 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"strconv"
+	"time"
 )
 
 const REDIS_VERSION = 8
 
+/* 能解析的最高版本，redis 7 开始使用 listpack 编码，redis 7.4 的版本12增加了带字段过期时间的 hash */
+const RDB_MAX_VERSION = 12
+
+/* redis 7 的函数库，246 为正式版之前的格式 */
+const RDB_OPCODE_FUNCTION2 = 245
+const RDB_OPCODE_FUNCTION_PRE_GA = 246
+const RDB_OPCODE_MODULE_AUX = 247
+
+/* 集群模式下每个 slot 的key数量，redis 7.4 开始 */
+const RDB_OPCODE_SLOT_INFO = 244
+
+/* 下一个key的 LRU 空闲时间和 LFU 访问频率 */
+const RDB_OPCODE_IDLE = 248
+const RDB_OPCODE_FREQ = 249
+
 const RDB_OPCODE_AUX = 250
 const RDB_OPCODE_RESIZEDB = 251
 const RDB_OPCODE_EXPIRETIME_MS = 252
@@ -23,6 +40,10 @@ const RDB_6BITLEN = 0
 const RDB_14BITLEN = 1
 const RDB_32BITLEN = 0x80
 const RDB_64BITLEN = 0x81
+
+/* 大块数据分段读取的初始大小 */
+const RDB_READ_CHUNK = 1024 * 1024
+
 const RDB_ENCVAL = 3
 
 const RDB_ENC_INT8 = 0  /* 8 bit signed integer */
@@ -45,6 +66,53 @@ const RDB_TYPE_SET_INTSET = 11
 const RDB_TYPE_ZSET_ZIPLIST = 12
 const RDB_TYPE_HASH_ZIPLIST = 13
 const RDB_TYPE_LIST_QUICKLIST = 14
+const RDB_TYPE_STREAM_LISTPACKS = 15
+const RDB_TYPE_HASH_LISTPACK = 16
+const RDB_TYPE_ZSET_LISTPACK = 17
+const RDB_TYPE_LIST_QUICKLIST_2 = 18
+const RDB_TYPE_STREAM_LISTPACKS_2 = 19
+const RDB_TYPE_SET_LISTPACK = 20
+const RDB_TYPE_STREAM_LISTPACKS_3 = 21
+
+/* 带字段过期时间的 hash，PRE_GA 为 redis 7.4 正式版之前的格式 */
+const RDB_TYPE_HASH_METADATA_PRE_GA = 22
+const RDB_TYPE_HASH_LISTPACK_EX_PRE_GA = 23
+const RDB_TYPE_HASH_METADATA = 24
+const RDB_TYPE_HASH_LISTPACK_EX = 25
+
+func isStreamType(valType byte) bool {
+	return valType == RDB_TYPE_STREAM_LISTPACKS || valType == RDB_TYPE_STREAM_LISTPACKS_2 || valType == RDB_TYPE_STREAM_LISTPACKS_3
+}
+
+func isHashTtlType(valType byte) bool {
+	return valType >= RDB_TYPE_HASH_METADATA_PRE_GA && valType <= RDB_TYPE_HASH_LISTPACK_EX
+}
+
+/*
+* 检查 rdb 版本，不支持时说明能解析的版本范围
+ */
+func checkRdbVersion(version int) error {
+	if version < 1 || version > RDB_MAX_VERSION {
+		return fmt.Errorf("can't handle rdb format version %d, versions 1 - %d are supported", version, RDB_MAX_VERSION)
+	}
+
+	return nil
+}
+
+/* 模块序列化数据中每个值前面的类型 */
+const RDB_MODULE_OPCODE_EOF = 0
+const RDB_MODULE_OPCODE_SINT = 1
+const RDB_MODULE_OPCODE_UINT = 2
+const RDB_MODULE_OPCODE_FLOAT = 3
+const RDB_MODULE_OPCODE_DOUBLE = 4
+const RDB_MODULE_OPCODE_STRING = 5
+
+/* 模块辅助数据的保存时机，在所有key之后 */
+const RDB_MODULE_AUX_AFTER_RDB = 2
+
+/* quicklist 2 节点的存储方式 */
+const QUICKLIST_NODE_CONTAINER_PLAIN = 1
+const QUICKLIST_NODE_CONTAINER_PACKED = 2
 
 /* 字符串编码类型定义 */
 const ZIP_STR_06B = 0
@@ -66,21 +134,82 @@ type Rdb struct {
 	dbSize      int
 	expiresSize int
 	expireTime  int64
-	fp          *os.File
+	lruIdle     int64
+	lfuFreq     int
+	fp          io.ReaderAt
 	rdbType     int
 	mapObj      map[string]*RedisObject
 	loadingLen  int64
+	visitor     KeyVisitor
+	meta        *Metadata
+	crc         uint64
+	stats       *Stats
+	parallel    *parallelDecoder
+	records     []*RdbRecord
+	streamLen   int64
+}
+
+/*
+* 一个key在rdb文件中的位置及解析结果
+* valOffset, endOffset 为value序列化数据（不含类型和key）的起止位置
+* streamLen 为 stream 的消息数，stream 不解析，只从长度字段读取
+ */
+type KeyEntry struct {
+	dbId       int
+	key        string
+	expireTime int64
+	valType    byte
+	valOffset  int64
+	endOffset  int64
+	obj        *RedisObject
+	lruIdle    int64
+	lfuFreq    int
+	streamLen  int64
 }
 
-func checkErr(err error) {
+/*
+* 不属于任何key的记录：aux 字段、函数库和模块辅助数据
+* offset, endOffset 为 opcode 之后的数据的起止位置，合并文件时原样复制
+ */
+type RdbRecord struct {
+	opcode    byte
+	offset    int64
+	endOffset int64
+}
+
+/*
+* 每解析完一个key调用一次，返回错误时终止解析
+ */
+type KeyVisitor func(entry *KeyEntry) error
+
+func NewRdb(fp io.ReaderAt) *Rdb {
+	return &Rdb{fp: fp, expireTime: -1, lruIdle: -1, lfuFreq: -1, mapObj: make(map[string]*RedisObject), meta: NewMetadata()}
+}
+
+/*
+* 读取value的原始序列化数据
+ */
+func (e *KeyEntry) RawValue(fp io.ReaderAt) ([]byte, error) {
+	return readRange(fp, e.valOffset, e.endOffset)
+}
+
+func (rec *RdbRecord) RawValue(fp io.ReaderAt) ([]byte, error) {
+	return readRange(fp, rec.offset, rec.endOffset)
+}
+
+func readRange(fp io.ReaderAt, from int64, to int64) ([]byte, error) {
+	buf := make([]byte, to-from)
+	_, err := fp.ReadAt(buf, from)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		return nil, err
 	}
+
+	return buf, nil
 }
 
 func (r *Rdb) saveStrObj(redisKey string, strVal string) {
 	redisObj := NewRedisObject(RDB_TYPE_STRING, r.loadingLen, strVal)
+	redisObj.encType = r.rdbType
 	r.mapObj[redisKey] = redisObj
 }
 
@@ -89,6 +218,7 @@ func (r *Rdb) saveHash(hashKey string, hashField string, hashValue string) {
 	if !ok {
 		tmpMap := make(map[string]string)
 		item = NewRedisObject(RDB_TYPE_HASH, r.loadingLen, tmpMap)
+		item.encType = r.rdbType
 		r.mapObj[hashKey] = item
 	}
 
@@ -101,11 +231,11 @@ func (r *Rdb) saveListVal(listKey string, listVal string) {
 	if !ok {
 		tmpList := make([]string, 0)
 		item = NewRedisObject(RDB_TYPE_LIST, r.loadingLen, tmpList)
+		item.encType = r.rdbType
 		r.mapObj[listKey] = item
 	}
 
-	// prepend
-	item.objVal = append([]string{listVal}, item.objVal.([]string)...)
+	item.objVal = append(item.objVal.([]string), listVal)
 	r.mapObj[listKey] = item
 	item.objLen = r.loadingLen
 }
@@ -115,6 +245,7 @@ func (r *Rdb) saveZset(zsetKey string, member string, score float64) {
 	if !ok {
 		tmpZset := make(map[string]float64)
 		item = NewRedisObject(RDB_TYPE_ZSET, r.loadingLen, tmpZset)
+		item.encType = r.rdbType
 		r.mapObj[zsetKey] = item
 	}
 
@@ -127,24 +258,61 @@ func (r *Rdb) saveSet(setKey string, element string) {
 	if !ok {
 		tmpSet := make(map[string]int)
 		item = NewRedisObject(RDB_TYPE_SET, r.loadingLen, tmpSet)
+		item.encType = r.rdbType
 		r.mapObj[setKey] = item
 	}
 
-	item.objVal.(map[string]int)[setKey] = 1
+	item.objVal.(map[string]int)[element] = 1
 	item.objLen = r.loadingLen
 }
 
+/*
+* 记录 quicklist 的节点个数
+ */
+func (r *Rdb) saveNodes(listKey string, nodes int64) {
+	if item, ok := r.mapObj[listKey]; ok {
+		item.nodes = nodes
+	}
+}
+
 func (r *Rdb) ReadBuf(length int64) ([]byte, error) {
-	buf := make([]byte, length)
-	size, err := r.fp.ReadAt(buf[:length], r.curIndex)
-	checkErr(err)
+	if length < 0 {
+		return []byte{}, errors.New("invalid length")
+	}
+	// 空字符串不需要读取，bytes.Reader 在末尾读取0字节也会返回 EOF
+	if length == 0 {
+		return []byte{}, nil
+	}
 
-	if size < 0 {
-		fmt.Fprintf(os.Stderr, "cat: error reading: %s\n", err.Error())
+	// 长度来自文件内容，损坏的文件中可能很大，大块数据分段读取，读到文件末尾时不会按长度分配内存
+	chunk := length
+	if chunk > RDB_READ_CHUNK {
+		chunk = RDB_READ_CHUNK
+	}
+	buf := make([]byte, chunk)
+	size, err := r.fp.ReadAt(buf, r.curIndex)
+	for size == len(buf) && int64(size) < length {
+		next := int64(size) * 2
+		if next > length {
+			next = length
+		}
+		grown := make([]byte, next)
+		copy(grown, buf)
+		var n int
+		n, err = r.fp.ReadAt(grown[size:], r.curIndex+int64(size))
+		size += n
+		buf = grown
+	}
+
+	if int64(size) < length {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return []byte{}, err
 	} else {
 		r.curIndex += length
 		r.loadingLen += length
+		r.crc = crc64Update(r.crc, buf)
 		return buf, nil
 	}
 }
@@ -158,21 +326,21 @@ func (r *Rdb) LoadInteger(encType int) (string, error) {
 			return "", err
 		}
 
-		intVal = int(buf[0])
+		intVal = int(int8(buf[0]))
 	} else if encType == RDB_ENC_INT16 {
 		buf, err := r.ReadBuf(2)
 		if err != nil {
 			return "", err
 		}
 
-		intVal = int(buf[0]) | (int(buf[1]) << 8)
+		intVal = int(int16(binary.LittleEndian.Uint16(buf)))
 	} else if encType == RDB_ENC_INT32 {
 		buf, err := r.ReadBuf(4)
 		if err != nil {
 			return "", err
 		}
 
-		intVal = int(buf[0]) | (int(buf[1]) << 8) | (int(buf[2]) << 16) | (int(buf[3]) << 24)
+		intVal = int(int32(binary.LittleEndian.Uint32(buf)))
 	} else {
 		intVal = 0
 		return "", fmt.Errorf("Unknown RDB integer encoding type %d", encType)
@@ -181,12 +349,23 @@ func (r *Rdb) LoadInteger(encType int) (string, error) {
 	return strconv.Itoa(intVal), nil
 }
 
-func (r *Rdb) lzfDecompress(compressedBuf []byte, inLen int, strLen int) string {
+/* lzf 的一个回溯引用最多用3个字节表示264个字节，解压后的长度不会超过压缩长度的 88 倍 */
+const LZF_MAX_RATIO = 88
+
+func (r *Rdb) lzfDecompress(compressedBuf []byte, inLen int, strLen int) (string, error) {
+	if inLen > len(compressedBuf) || strLen < 0 || strLen > inLen*LZF_MAX_RATIO {
+		return "", errors.New("invalid lzf length")
+	}
+
+	errCorrupt := errors.New("corrupt lzf data")
 	decompressedRet := make([]byte, strLen)
 	for i, j := 0, 0; i < inLen; {
 		ctrl := int(compressedBuf[i])
 		i++
 		if ctrl < (1 << 5) {
+			if i+ctrl+1 > inLen || j+ctrl+1 > strLen {
+				return "", errCorrupt
+			}
 			for x := 0; x <= ctrl; x++ {
 				decompressedRet[j] = compressedBuf[i]
 				i++
@@ -195,11 +374,20 @@ func (r *Rdb) lzfDecompress(compressedBuf []byte, inLen int, strLen int) string
 		} else {
 			length := ctrl >> 5
 			if length == 7 {
+				if i >= inLen {
+					return "", errCorrupt
+				}
 				length = length + int(compressedBuf[i])
 				i++
 			}
+			if i >= inLen {
+				return "", errCorrupt
+			}
 			ref := j - ((ctrl & 0x1f) << 8) - int(compressedBuf[i]) - 1
 			i++
+			if ref < 0 || j+length+2 > strLen {
+				return "", errCorrupt
+			}
 			for x := 0; x <= length+1; x++ {
 				decompressedRet[j] = decompressedRet[ref]
 				ref++
@@ -208,18 +396,20 @@ func (r *Rdb) lzfDecompress(compressedBuf []byte, inLen int, strLen int) string
 		}
 	}
 
-	return string(decompressedRet)
+	return string(decompressedRet), nil
 }
 
 func (r *Rdb) LoadLzfString(encType int) (string, error) {
 	cLen, err := r.LoadLen(nil)
 	if err != nil {
 		fmt.Println("Fail to load len")
+		return "", err
 	}
 
 	sLen, err := r.LoadLen(nil)
 	if err != nil {
 		fmt.Println("Fail to load len")
+		return "", err
 	}
 
 	compressedBuf, err := r.ReadBuf(int64(cLen))
@@ -228,9 +418,7 @@ func (r *Rdb) LoadLzfString(encType int) (string, error) {
 		return "", err
 	}
 
-	deCompressedStr := r.lzfDecompress(compressedBuf, cLen, sLen)
-
-	return deCompressedStr, nil
+	return r.lzfDecompress(compressedBuf, cLen, sLen)
 }
 
 func (r *Rdb) LoadType() (byte, error) {
@@ -269,6 +457,14 @@ func (r *Rdb) LoadLen(isEncoded *bool) (int, error) {
 		}
 
 		return int(binary.BigEndian.Uint32(buf)), nil
+	} else if lenBuf[0] == RDB_64BITLEN {
+		/* Read a 64 bit len. */
+		buf, err := r.ReadBuf(8)
+		if err != nil {
+			return 0, err
+		}
+
+		return int(binary.BigEndian.Uint64(buf)), nil
 	} else if lenType == RDB_ENCVAL {
 		if isEncoded != nil {
 			*isEncoded = true
@@ -278,8 +474,6 @@ func (r *Rdb) LoadLen(isEncoded *bool) (int, error) {
 		fmt.Printf("Unknown length encoding %d in LoadLen()\n", lenType)
 		return -1, errors.New("Unknown length encoding")
 	}
-
-	return 0, nil
 }
 
 func (r *Rdb) LoadStringObject() (string, error) {
@@ -297,7 +491,7 @@ func (r *Rdb) LoadStringObject() (string, error) {
 		case RDB_ENC_LZF:
 			return r.LoadLzfString(strLen)
 		default:
-			return "", fmt.Errorf("Unknown RDB string encoding type: %s", strLen)
+			return "", fmt.Errorf("Unknown RDB string encoding type: %d", strLen)
 		}
 	}
 
@@ -321,8 +515,19 @@ func (r *Rdb) LoadMillisecondTime() (int64, error) {
 	return expireTime, nil
 }
 
+func (r *Rdb) LoadSecondTime() (int64, error) {
+	buf, err := r.ReadBuf(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(binary.LittleEndian.Uint32(buf)), nil
+}
+
 func (r *Rdb) LoadZSetSize(setBuf string) (int64, error) {
-	fmt.Printf("type: %d\n", r.rdbType)
+	if len(setBuf) < 10 {
+		return 0, errors.New("ziplist too short")
+	}
 	bufByte := []byte(setBuf[8:10])
 
 	return int64(binary.LittleEndian.Uint16(bufByte)), nil
@@ -351,6 +556,17 @@ func (r *Rdb) LoadZSetSize(setBuf string) (int64, error) {
 * 1111____              4 bytes Integer encoded as 24 bit signed (3 bytes)
  */
 func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
+	// 损坏的 ziplist 中长度可能超出范围，读取前检查剩余的字节数
+	need := func(n int) error {
+		if n < 0 || *curIndex+n > len(setBuf) {
+			return errors.New("ziplist entry out of range")
+		}
+		return nil
+	}
+
+	if err := need(1); err != nil {
+		return "", err
+	}
 	prevEntryLen := byte(setBuf[*curIndex])
 	*curIndex++
 
@@ -358,12 +574,18 @@ func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
 		*curIndex += 4
 	}
 
+	if err := need(1); err != nil {
+		return "", err
+	}
 	specialFlag := byte(setBuf[*curIndex])
 
 	*curIndex++
 	switch {
 	case specialFlag>>6 == ZIP_STR_06B:
 		strLen := int(specialFlag & 0x3f)
+		if err := need(strLen); err != nil {
+			return "", err
+		}
 
 		nextIndex := *curIndex + strLen
 		valBuf := setBuf[*curIndex:nextIndex]
@@ -372,30 +594,52 @@ func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
 
 		return valBuf, nil
 	case specialFlag>>6 == ZIP_STR_14B:
+		if err := need(1); err != nil {
+			return "", err
+		}
 		lenBuf := byte(setBuf[*curIndex])
 		*curIndex++
 
-		nextIndex := *curIndex + ((int(specialFlag&0x3f) << 8) | int(lenBuf))
+		strLen := (int(specialFlag&0x3f) << 8) | int(lenBuf)
+		if err := need(strLen); err != nil {
+			return "", err
+		}
+		nextIndex := *curIndex + strLen
 		valBuf := setBuf[*curIndex:nextIndex]
 
 		*curIndex = nextIndex
 
 		return valBuf, nil
 	case specialFlag>>6 == ZIP_STR_32B:
+		if err := need(4); err != nil {
+			return "", err
+		}
 		nextIndex := *curIndex + 4
 		lenBuf := []byte(setBuf[*curIndex:nextIndex])
 		*curIndex = nextIndex
 
-		nextIndex = int(binary.BigEndian.Uint32(lenBuf))
+		strLen := int(binary.BigEndian.Uint32(lenBuf))
+		if err := need(strLen); err != nil {
+			return "", err
+		}
+		nextIndex = *curIndex + strLen
+		valBuf := setBuf[*curIndex:nextIndex]
+
 		*curIndex = nextIndex
 
-		return setBuf[*curIndex:nextIndex], nil
+		return valBuf, nil
 	case specialFlag == ZIP_INT_8B:
+		if err := need(1); err != nil {
+			return "", err
+		}
 		valBuf := byte(setBuf[*curIndex])
 		*curIndex++
 
 		return strconv.FormatInt(int64(int8(valBuf)), 10), nil
 	case specialFlag == ZIP_INT_16B:
+		if err := need(2); err != nil {
+			return "", err
+		}
 		nextIndex := *curIndex + 2
 		valBuf := []byte(setBuf[*curIndex:nextIndex])
 
@@ -403,6 +647,9 @@ func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
 
 		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(valBuf))), 10), nil
 	case specialFlag == ZIP_INT_24B:
+		if err := need(3); err != nil {
+			return "", err
+		}
 		nextIndex := *curIndex + 3
 		valBuf := []byte(setBuf[*curIndex:nextIndex])
 
@@ -413,6 +660,9 @@ func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
 
 		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(valBuf))>>8), 10), nil
 	case specialFlag == ZIP_INT_32B:
+		if err := need(4); err != nil {
+			return "", err
+		}
 		nextIndex := *curIndex + 4
 		valBuf := []byte(setBuf[*curIndex:nextIndex])
 
@@ -420,6 +670,9 @@ func (r *Rdb) LoadZipListEntry(setBuf string, curIndex *int) (string, error) {
 
 		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(valBuf))), 10), nil
 	case specialFlag == ZIP_INT_64B:
+		if err := need(8); err != nil {
+			return "", err
+		}
 		nextIndex := *curIndex + 8
 		valBuf := []byte(setBuf[*curIndex:nextIndex])
 
@@ -506,6 +759,171 @@ func (r *Rdb) LoadZipList(redisKey string) error {
 	return nil
 }
 
+/*
+* listpack format
+* <total-bytes><num-elements><element-1>...<element-N><end>
+*       total-bytes: 4 byte 小端，整个 listpack 的字节数
+*       num-elements: 2 byte 小端，元素个数，65535 表示需要遍历才能得到
+*       end: 固定为 255
+*
+* 每个元素为 <encoding-type><element-data><element-tot-len>
+* 0xxxxxxx                 7 位无符号整数
+* 10xxxxxx                 长度不超过 63 的字符串
+* 110xxxxx yyyyyyyy        13 位有符号整数
+* 1110xxxx yyyyyyyy        长度不超过 4095 的字符串
+* 11110000 <4 bytes>       32 位长度的字符串
+* 11110001 ~ 11110100      16/24/32/64 位有符号整数
+* element-tot-len: 编码加数据的长度，按每字节7位存储，占 1 ~ 5 字节
+ */
+func (r *Rdb) LoadListPack(packBuf string) ([]string, error) {
+	if len(packBuf) < 7 {
+		return nil, errors.New("listpack too short")
+	}
+
+	var elements []string
+	curIndex := 6
+	for curIndex < len(packBuf) {
+		if packBuf[curIndex] == 0xff {
+			return elements, nil
+		}
+
+		element, entryLen, err := listPackEntry(packBuf, curIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		curIndex += entryLen + backLenSize(entryLen)
+		elements = append(elements, element)
+	}
+
+	return nil, errors.New("listpack without end mark")
+}
+
+/*
+* 解析 curIndex 处的一个元素，返回元素值以及编码加数据的长度
+ */
+func listPackEntry(packBuf string, curIndex int) (string, int, error) {
+	flag := packBuf[curIndex]
+
+	// 字符串元素的编码头长度和字符串长度
+	hdrLen, strLen := 0, 0
+	// 整数元素的数据宽度
+	width := 0
+	switch {
+	case flag&0x80 == 0:
+		hdrLen = 1
+	case flag&0xc0 == 0x80:
+		hdrLen, strLen = 1, int(flag&0x3f)
+	case flag&0xe0 == 0xc0:
+		width = 1
+	case flag&0xf0 == 0xe0:
+		if curIndex+2 > len(packBuf) {
+			return "", 0, errors.New("listpack entry out of range")
+		}
+		hdrLen, strLen = 2, int(flag&0x0f)<<8|int(packBuf[curIndex+1])
+	case flag == 0xf0:
+		if curIndex+5 > len(packBuf) {
+			return "", 0, errors.New("listpack entry out of range")
+		}
+		hdrLen, strLen = 5, int(binary.LittleEndian.Uint32([]byte(packBuf[curIndex+1:curIndex+5])))
+	case flag == 0xf1:
+		width = 2
+	case flag == 0xf2:
+		width = 3
+	case flag == 0xf3:
+		width = 4
+	case flag == 0xf4:
+		width = 8
+	default:
+		return "", 0, fmt.Errorf("unknown listpack encoding: %d", flag)
+	}
+
+	entryLen := hdrLen + strLen
+	if width > 0 {
+		entryLen = 1 + width
+	}
+	if curIndex+entryLen > len(packBuf) {
+		return "", 0, errors.New("listpack entry out of range")
+	}
+
+	var element string
+	switch {
+	case flag&0x80 == 0:
+		element = strconv.Itoa(int(flag & 0x7f))
+	case flag&0xe0 == 0xc0:
+		uval := uint16(flag&0x1f)<<8 | uint16(packBuf[curIndex+1])
+		// 13 位补码转为有符号数
+		element = strconv.Itoa(int(int16(uval<<3) >> 3))
+	case width > 0:
+		valBuf := make([]byte, 8)
+		copy(valBuf, packBuf[curIndex+1:curIndex+1+width])
+		// 高位做符号扩展
+		shift := uint(64 - width*8)
+		element = strconv.FormatInt(int64(binary.LittleEndian.Uint64(valBuf)<<shift)>>shift, 10)
+	default:
+		element = packBuf[curIndex+hdrLen : curIndex+entryLen]
+	}
+
+	return element, entryLen, nil
+}
+
+/*
+* listpack 元素末尾 element-tot-len 占用的字节数
+ */
+func backLenSize(entryLen int) int {
+	switch {
+	case entryLen <= 127:
+		return 1
+	case entryLen < 16383:
+		return 2
+	case entryLen < 2097151:
+		return 3
+	case entryLen < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+/*
+* intset format
+* <encoding><length><contents>
+*       encoding: 4 byte 小端，每个元素的字节数(2, 4, 8)
+*       length: 4 byte 小端，元素个数
+*       contents: 按编码宽度存储的有符号整数
+ */
+func (r *Rdb) LoadIntSet(setBuf string) ([]string, error) {
+	if len(setBuf) < 8 {
+		return nil, errors.New("intset too short")
+	}
+
+	encoding := int(binary.LittleEndian.Uint32([]byte(setBuf[0:4])))
+	length := int(binary.LittleEndian.Uint32([]byte(setBuf[4:8])))
+	if encoding != 2 && encoding != 4 && encoding != 8 {
+		return nil, fmt.Errorf("unknown intset encoding: %d", encoding)
+	}
+	if len(setBuf) < 8+encoding*length {
+		return nil, errors.New("intset too short")
+	}
+
+	members := make([]string, 0, length)
+	for i := 0; i < length; i++ {
+		valBuf := []byte(setBuf[8+i*encoding : 8+(i+1)*encoding])
+		var intVal int64
+		switch encoding {
+		case 2:
+			intVal = int64(int16(binary.LittleEndian.Uint16(valBuf)))
+		case 4:
+			intVal = int64(int32(binary.LittleEndian.Uint32(valBuf)))
+		case 8:
+			intVal = int64(binary.LittleEndian.Uint64(valBuf))
+		}
+		members = append(members, strconv.FormatInt(intVal, 10))
+	}
+
+	return members, nil
+}
+
 func (r *Rdb) LoadObject(redisKey string, objType byte) error {
 	r.rdbType = int(objType)
 	r.loadingLen = 0
@@ -620,13 +1038,20 @@ func (r *Rdb) LoadObject(redisKey string, objType byte) error {
 
 		return nil
 	case RDB_TYPE_SET_INTSET:
-		/*encodedStr, err := r.LoadStringObject()*/
-		//if err != nil {
-		//fmt.Println("Fail to load string")
-		//return err
-		/*}*/
+		encodedStr, err := r.LoadStringObject()
+		if err != nil {
+			fmt.Println("Fail to load string")
+			return err
+		}
+
+		members, err := r.LoadIntSet(encodedStr)
+		if err != nil {
+			return err
+		}
 
-		//fmt.Printf("INTSET encoded :%s\n", encodedStr)
+		for _, member := range members {
+			r.saveSet(redisKey, member)
+		}
 
 		return nil
 	case RDB_TYPE_SET:
@@ -689,8 +1114,26 @@ func (r *Rdb) LoadObject(redisKey string, objType byte) error {
 			//fmt.Printf("member %s score %.2f\n", setMember, score)
 		}
 
-		fmt.Printf("final loadingLen : %d", r.loadingLen)
 		return nil
+	case RDB_TYPE_LIST:
+		listLen, err := r.LoadLen(nil)
+		if err != nil {
+			fmt.Println("Fail to load LIST len")
+			return err
+		}
+
+		for i := 0; i < listLen; i++ {
+			listVal, err := r.LoadStringObject()
+			if err != nil {
+				return err
+			}
+
+			r.saveListVal(redisKey, listVal)
+		}
+
+		return nil
+	case RDB_TYPE_LIST_ZIPLIST:
+		return r.LoadZipList(redisKey)
 	case RDB_TYPE_LIST_QUICKLIST:
 		r.rdbType = RDB_TYPE_LIST_QUICKLIST
 		listLen, err := r.LoadLen(nil)
@@ -715,100 +1158,406 @@ func (r *Rdb) LoadObject(redisKey string, objType byte) error {
 			//fmt.Printf("list item: %s\n", listVal)
 		}
 
+		r.saveNodes(redisKey, int64(listLen))
+
 		return nil
-	default:
-		fmt.Printf("object type %d\n", objType)
-		os.Exit(-1)
+	case RDB_TYPE_LIST_QUICKLIST_2:
+		listLen, err := r.LoadLen(nil)
+		if err != nil {
+			fmt.Println("Fail to load QUICKLIST len")
+			return err
+		}
+
+		for i := 0; i < listLen; i++ {
+			container, err := r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+
+			nodeBuf, err := r.LoadStringObject()
+			if err != nil {
+				return err
+			}
+
+			// 大元素单独存为一个节点
+			if container == QUICKLIST_NODE_CONTAINER_PLAIN {
+				r.saveListVal(redisKey, nodeBuf)
+				continue
+			}
+
+			elements, err := r.LoadListPack(nodeBuf)
+			if err != nil {
+				return err
+			}
+			for _, element := range elements {
+				r.saveListVal(redisKey, element)
+			}
+		}
+
+		r.saveNodes(redisKey, int64(listLen))
+
+		return nil
+	case RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		encodedStr, err := r.LoadStringObject()
+		if err != nil {
+			fmt.Println("Fail to load string")
+			return err
+		}
+
+		elements, err := r.LoadListPack(encodedStr)
+		if err != nil {
+			return err
+		}
+
+		switch objType {
+		case RDB_TYPE_SET_LISTPACK:
+			for _, element := range elements {
+				r.saveSet(redisKey, element)
+			}
+		case RDB_TYPE_HASH_LISTPACK:
+			for i := 0; i+1 < len(elements); i += 2 {
+				r.saveHash(redisKey, elements[i], elements[i+1])
+			}
+		case RDB_TYPE_ZSET_LISTPACK:
+			for i := 0; i+1 < len(elements); i += 2 {
+				score, err := strconv.ParseFloat(elements[i+1], 64)
+				if err != nil {
+					return err
+				}
+				r.saveZset(redisKey, elements[i], score)
+			}
+		}
+
 		return nil
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		return r.skipStream(objType)
+	case RDB_TYPE_MODULE_2:
+		return r.skipModule()
+	case RDB_TYPE_HASH_METADATA_PRE_GA, RDB_TYPE_HASH_LISTPACK_EX_PRE_GA, RDB_TYPE_HASH_METADATA, RDB_TYPE_HASH_LISTPACK_EX:
+		return r.skipHashTtl(objType)
+	default:
+		return fmt.Errorf("unsupported object type %d", objType)
+	}
+}
+
+/*
+* 跳过带字段过期时间的 hash，正式版的格式先保存最早的过期时间
+* metadata 格式每个字段为过期时间、field、value，listpack 格式为一个 listpack
+ */
+func (r *Rdb) skipHashTtl(objType byte) error {
+	if objType == RDB_TYPE_HASH_METADATA || objType == RDB_TYPE_HASH_LISTPACK_EX {
+		_, err := r.ReadBuf(8)
+		if err != nil {
+			return err
+		}
+	}
+	if objType == RDB_TYPE_HASH_LISTPACK_EX_PRE_GA || objType == RDB_TYPE_HASH_LISTPACK_EX {
+		return r.skipString()
+	}
+
+	fields, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < fields; i++ {
+		_, err = r.LoadLen(nil)
+		if err == nil {
+			err = r.skipString()
+		}
+		if err == nil {
+			err = r.skipString()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 模块的辅助数据：模块ID、保存时机和序列化数据
+ */
+func (r *Rdb) skipModuleAux() error {
+	err := r.skipLens(3)
+	if err != nil {
+		return err
+	}
+
+	return r.skipModuleValues()
+}
+
+/*
+* 函数库，正式版之前的格式为名称、引擎、可选的描述和代码
+ */
+func (r *Rdb) skipFunction(opcode byte) error {
+	if opcode == RDB_OPCODE_FUNCTION2 {
+		return r.skipString()
+	}
+
+	for i := 0; i < 2; i++ {
+		err := r.skipString()
+		if err != nil {
+			return err
+		}
+	}
+	hasDesc, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+	if hasDesc != 0 {
+		err = r.skipString()
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.skipString()
+}
+
+/*
+* 解析整个文件，文件损坏或者 visitor 返回错误时停止解析并返回错误
+ */
+func (rdb *Rdb) DecodeRDBFile() error {
+	start := time.Now()
+	err := rdb.decodeRecords()
+	if rdb.parallel != nil && rdb.parallel.jobs != nil {
+		// 出错时不再等待还没有完成的 value
+		finishErr := rdb.parallel.finish(rdb, err == nil)
+		if err == nil {
+			err = finishErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if rdb.stats != nil {
+		rdb.stats.Finish()
+	}
+	rdb.meta.ParseMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	rdb.meta.FileSize = rdb.curIndex
+	if file, ok := rdb.fp.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			rdb.meta.FileSize = info.Size()
+		}
 	}
+
+	return nil
 }
 
-func (rdb *Rdb) DecodeRDBFile() {
+func (rdb *Rdb) decodeRecords() error {
 	// check redis rdb file signature
-	buf, _ := rdb.ReadBuf(int64(9))
+	buf, err := rdb.ReadBuf(int64(9))
+	if err != nil {
+		return err
+	}
 	if bytes.Compare([]byte("REDIS"), buf[0:5]) != 0 {
-		fmt.Println("Wrong signature file")
-		os.Exit(-1)
+		return errors.New("Wrong signature file")
 	}
 
 	// check redis rdb file version
 	version, err := strconv.Atoi(string(buf[5:]))
-	checkErr(err)
-	if version < 1 || version > REDIS_VERSION {
-		fmt.Printf("Can't handle RDB format version %s\n", version)
-		os.Exit(-1)
+	if err != nil {
+		return err
+	}
+	err = checkRdbVersion(version)
+	if err != nil {
+		return err
 	}
 	rdb.version = version
-
-	fmt.Printf("Rdb file version: %d\n", version)
+	rdb.meta.Version = version
+	if rdb.parallel != nil {
+		rdb.parallel.start(rdb)
+	}
 
 	for {
 		// load type
 		redisType, err := rdb.LoadType()
-		checkErr(err)
+		if err != nil {
+			return err
+		}
 
+		recordOffset := rdb.curIndex
 		if redisType == RDB_OPCODE_AUX {
 			auxKey, err := rdb.LoadStringObject()
-			checkErr(err)
+			if err != nil {
+				return err
+			}
 
 			auxVal, err := rdb.LoadStringObject()
-			checkErr(err)
-			fmt.Printf("%s: %s\n", auxKey, auxVal)
+			if err != nil {
+				return err
+			}
+			rdb.meta.setAux(auxKey, auxVal)
+			rdb.records = append(rdb.records, &RdbRecord{redisType, recordOffset, rdb.curIndex})
 
 			continue
 		} else if redisType == RDB_OPCODE_SELECTDB {
 			dbId, err := rdb.LoadLen(nil)
 			if err != nil {
-				fmt.Println("Fail to load dbId")
-				os.Exit(-1)
+				return errors.New("Fail to load dbId")
 			}
 
 			rdb.dbId = dbId
-			fmt.Printf("Selected DB: %d\n", rdb.dbId)
 
 			continue
 		} else if redisType == RDB_OPCODE_RESIZEDB {
 			dbSize, err := rdb.LoadLen(nil)
 			if err != nil {
-				fmt.Println("Fail to load dbSize")
-				os.Exit(-1)
+				return errors.New("Fail to load dbSize")
 			}
 
 			expiresSize, err := rdb.LoadLen(nil)
 			if err != nil {
-				fmt.Println("Fail to load expires size")
-				os.Exit(-1)
+				return errors.New("Fail to load expires size")
 			}
 
 			rdb.dbSize = dbSize
 			rdb.expiresSize = expiresSize
 
-			fmt.Printf("Rdb dbSize: %d\n", rdb.dbSize)
-			fmt.Printf("Rdb expiresSize: %d\n", rdb.expiresSize)
+			db := rdb.meta.db(rdb.dbId)
+			db.ResizeKeys = dbSize
+			db.ResizeExpires = expiresSize
 
 			continue
 		} else if redisType == RDB_OPCODE_EXPIRETIME_MS {
 			rdb.expireTime, err = rdb.LoadMillisecondTime()
 			if err != nil {
-				fmt.Println("Fail to load millisecondtime")
-				os.Exit(-1)
+				return errors.New("Fail to load millisecondtime")
+			}
+
+			// 过期时间之后还可能有 IDLE 或 FREQ
+			continue
+		} else if redisType == RDB_OPCODE_EXPIRETIME {
+			expireTime, err := rdb.LoadSecondTime()
+			if err != nil {
+				return errors.New("Fail to load secondtime")
+			}
+			rdb.expireTime = expireTime * 1000
+
+			continue
+		} else if redisType == RDB_OPCODE_IDLE {
+			idle, err := rdb.LoadLen(nil)
+			if err != nil {
+				return errors.New("Fail to load idle")
+			}
+			rdb.lruIdle = int64(idle)
+
+			continue
+		} else if redisType == RDB_OPCODE_FREQ {
+			freq, err := rdb.ReadBuf(1)
+			if err != nil {
+				return errors.New("Fail to load freq")
+			}
+			rdb.lfuFreq = int(freq[0])
+
+			continue
+		} else if redisType == RDB_OPCODE_FUNCTION2 || redisType == RDB_OPCODE_FUNCTION_PRE_GA {
+			err = rdb.skipFunction(redisType)
+			if err != nil {
+				return err
+			}
+			rdb.meta.Functions++
+			rdb.records = append(rdb.records, &RdbRecord{redisType, recordOffset, rdb.curIndex})
+
+			continue
+		} else if redisType == RDB_OPCODE_SLOT_INFO {
+			// slot、key 数量和有过期时间的key数量
+			err = rdb.skipLens(3)
+			if err != nil {
+				return err
+			}
+
+			continue
+		} else if redisType == RDB_OPCODE_MODULE_AUX {
+			err = rdb.skipModuleAux()
+			if err != nil {
+				return err
 			}
+			rdb.records = append(rdb.records, &RdbRecord{redisType, recordOffset, rdb.curIndex})
 
-			redisType, err = rdb.LoadType()
-			checkErr(err)
+			continue
 		} else if redisType == RDB_OPCODE_EOF {
-			fmt.Println("Reach file eof, parsing work finished")
-			break
+			return rdb.loadChecksum()
 		}
 
 		redisKey, err := rdb.LoadStringObject()
-		checkErr(err)
+		if err != nil {
+			return err
+		}
 
-		//fmt.Printf("key: %s\n", redisKey)
+		valOffset := rdb.curIndex
+		if rdb.parallel != nil {
+			// 只找出 value 的边界，交给解析协程
+			err = rdb.skipObject(redisType)
+			if err == nil {
+				err = rdb.parallel.submit(rdb, &KeyEntry{rdb.dbId, redisKey, rdb.expireTime, redisType, valOffset, rdb.curIndex, nil, rdb.lruIdle, rdb.lfuFreq, rdb.streamLen})
+			}
+			if err != nil {
+				return err
+			}
+			rdb.expireTime, rdb.lruIdle, rdb.lfuFreq, rdb.streamLen = -1, -1, -1, 0
+			continue
+		}
 
+		// 同名key可能出现在不同的db中，重新构建对象
+		delete(rdb.mapObj, redisKey)
 		err = rdb.LoadObject(redisKey, redisType)
-		checkErr(err)
+		if err != nil {
+			return err
+		}
+		err = rdb.finishKey(&KeyEntry{rdb.dbId, redisKey, rdb.expireTime, redisType, valOffset, rdb.curIndex, rdb.mapObj[redisKey], rdb.lruIdle, rdb.lfuFreq, rdb.streamLen})
+		if err != nil {
+			return err
+		}
+		rdb.expireTime, rdb.lruIdle, rdb.lfuFreq, rdb.streamLen = -1, -1, -1, 0
+	}
+}
+
+/*
+* 解析完一个key之后记录过期时间和统计信息，再交给 visitor
+ */
+func (rdb *Rdb) finishKey(entry *KeyEntry) error {
+	if entry.obj != nil {
+		entry.obj.expireTime = entry.expireTime
+		entry.obj.lruIdle, entry.obj.lfuFreq = entry.lruIdle, entry.lfuFreq
+		rdb.meta.addKey(entry.dbId, entry.obj)
+		if rdb.stats != nil {
+			rdb.stats.Add(entry.dbId, entry.key, entry.obj)
+		}
+	} else {
+		// stream、模块类型和带字段过期时间的 hash 只跳过，不解析
+		rdb.meta.Skipped++
+		if rdb.stats != nil && isStreamType(entry.valType) {
+			rdb.stats.AddStream(entry.dbId, entry.key, entry.streamLen, entry.endOffset-entry.valOffset)
+		}
+	}
 
-		//fmt.Printf("%s: %s\n", redisKey, redisVal)
+	if rdb.visitor != nil {
+		return rdb.visitor(entry)
 	}
+
+	return nil
+}
+
+/*
+* 读取文件末尾的 crc64 校验和（版本5开始），校验和为0表示生成时关闭了校验
+ */
+func (rdb *Rdb) loadChecksum() error {
+	if rdb.version < 5 {
+		return nil
+	}
+
+	expected := rdb.crc
+	buf, err := rdb.ReadBuf(8)
+	if err != nil {
+		return err
+	}
+
+	checksum := binary.LittleEndian.Uint64(buf)
+	rdb.meta.Checksum = fmt.Sprintf("%016x", checksum)
+	rdb.meta.ChecksumOk = checksum == 0 || checksum == expected
+
+	return nil
 }
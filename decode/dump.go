@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const dumpUsage = "dump dump.rdb key [key ...] [-db 0] [-format hex|escaped|raw]"
+const undumpUsage = "undump [payload] [-format hex|escaped|raw]"
+
+const DUMP_HEX = "hex"
+const DUMP_ESCAPED = "escaped"
+const DUMP_RAW = "raw"
+
+/*
+* 生成 DUMP 命令格式的序列化数据，可用于 RESTORE 命令
+* <type><value><2 byte rdb version><8 byte crc64>
+ */
+func CreateDumpPayload(valType byte, rawVal []byte, version int) []byte {
+	payload := make([]byte, 0, len(rawVal)+11)
+	payload = append(payload, valType)
+	payload = append(payload, rawVal...)
+	payload = append(payload, byte(version), byte(version>>8))
+
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, crc64Update(0, payload))
+
+	return append(payload, crc...)
+}
+
+/*
+* 解析 DUMP 命令的序列化数据，校验版本和 crc64 后使用 LoadObject 解析
+ */
+func ParseDumpPayload(payload []byte) (*RedisObject, error) {
+	if len(payload) < 11 {
+		return nil, errors.New("DUMP payload too short")
+	}
+
+	footer := payload[len(payload)-10:]
+	version := int(binary.LittleEndian.Uint16(footer[0:2]))
+	crc := binary.LittleEndian.Uint64(footer[2:])
+	if crc != 0 && crc != crc64Update(0, payload[:len(payload)-8]) {
+		return nil, errors.New("DUMP payload checksum mismatch")
+	}
+
+	rdb := NewRdb(bytes.NewReader(payload[:len(payload)-10]))
+	rdb.version = version
+	objType, err := rdb.LoadType()
+	if err != nil {
+		return nil, err
+	}
+
+	err = rdb.LoadObject("", objType)
+	if err != nil {
+		return nil, err
+	}
+	if rdb.curIndex != int64(len(payload)-10) {
+		return nil, fmt.Errorf("DUMP payload has %d trailing bytes", int64(len(payload)-10)-rdb.curIndex)
+	}
+
+	obj := rdb.mapObj[""]
+	if obj == nil {
+		return nil, fmt.Errorf("DUMP payload of type %d can not be parsed", objType)
+	}
+
+	return obj, nil
+}
+
+/*
+* 按 redis-cli 的方式转义，可以直接作为 redis-cli 的参数
+ */
+func escapeString(str string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch c {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\a':
+			buf.WriteString("\\a")
+		case '\b':
+			buf.WriteString("\\b")
+		default:
+			if c >= 0x20 && c < 0x7f {
+				buf.WriteByte(c)
+			} else {
+				fmt.Fprintf(&buf, "\\x%02x", c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
+
+/*
+* 解析 redis-cli 转义的字符串，如 "\x00\x0bhello world\t\x00..."
+ */
+func unescapeString(str string) (string, error) {
+	str = strings.TrimSpace(str)
+	if len(str) >= 2 && str[0] == '"' && str[len(str)-1] == '"' {
+		str = str[1 : len(str)-1]
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(str) {
+			return "", errors.New("unterminated escape sequence")
+		}
+		switch str[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'x':
+			if i+2 >= len(str) {
+				return "", errors.New("invalid \\x escape sequence")
+			}
+			c, err := strconv.ParseUint(str[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", errors.New("invalid \\x escape sequence")
+			}
+			buf.WriteByte(byte(c))
+			i += 2
+		default:
+			buf.WriteByte(str[i])
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func formatPayload(payload []byte, format string) (string, error) {
+	switch format {
+	case DUMP_HEX:
+		return hex.EncodeToString(payload), nil
+	case DUMP_ESCAPED:
+		return escapeString(string(payload)), nil
+	case DUMP_RAW:
+		return string(payload), nil
+	}
+
+	return "", fmt.Errorf("unknown format: %s", format)
+}
+
+func parsePayload(input string, format string) ([]byte, error) {
+	switch format {
+	case DUMP_HEX:
+		input = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" \t\r\n:", r) {
+				return -1
+			}
+			return r
+		}, strings.TrimPrefix(strings.TrimSpace(input), "0x"))
+		return hex.DecodeString(input)
+	case DUMP_ESCAPED:
+		str, err := unescapeString(input)
+		return []byte(str), err
+	case DUMP_RAW:
+		return []byte(input), nil
+	}
+
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+/*
+* 输出rdb文件中指定key的 DUMP 序列化数据
+ */
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	dbFilter := fs.Int("db", -1, "only dump keys of this db")
+	format := fs.String("format", DUMP_HEX, "output format: hex, escaped (redis-cli style) or raw")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) < 2 {
+		return errors.New("usage: decode " + dumpUsage)
+	}
+	if *format == DUMP_RAW && len(positional) != 2 {
+		return errors.New("raw format only supports a single key")
+	}
+
+	wanted := make(map[string]bool)
+	for _, key := range positional[1:] {
+		wanted[key] = true
+	}
+
+	rdb, file, err := openRdbFile(positional[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 不同 db 中可能有同名的key
+	payloads := make(map[string]map[int]string)
+	rdb.visitor = func(entry *KeyEntry) error {
+		delete(rdb.mapObj, entry.key)
+		if !wanted[entry.key] || (*dbFilter >= 0 && entry.dbId != *dbFilter) {
+			return nil
+		}
+
+		rawVal, err := entry.RawValue(rdb.fp)
+		if err != nil {
+			return err
+		}
+
+		payload, err := formatPayload(CreateDumpPayload(entry.valType, rawVal, rdb.version), *format)
+		if err != nil {
+			return err
+		}
+		if payloads[entry.key] == nil {
+			payloads[entry.key] = make(map[int]string)
+		}
+		payloads[entry.key][entry.dbId] = payload
+		return nil
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return err
+	}
+
+	// 找不到或者有歧义的key输出原因后继续，最后返回错误
+	failed := 0
+	for _, key := range positional[1:] {
+		dbIds := make([]int, 0, len(payloads[key]))
+		for dbId := range payloads[key] {
+			dbIds = append(dbIds, dbId)
+		}
+		if len(dbIds) == 0 {
+			fmt.Fprintf(os.Stderr, "key %s not exists\n", key)
+			failed++
+			continue
+		}
+		if len(dbIds) > 1 {
+			sort.Ints(dbIds)
+			names := make([]string, len(dbIds))
+			for i, dbId := range dbIds {
+				names[i] = strconv.Itoa(dbId)
+			}
+			fmt.Fprintf(os.Stderr, "key %s exists in db %s, please choose one with -db\n", key, strings.Join(names, ", "))
+			failed++
+			continue
+		}
+
+		payload := payloads[key][dbIds[0]]
+		if len(positional) == 2 {
+			fmt.Print(payload)
+			if *format != DUMP_RAW {
+				fmt.Println()
+			}
+		} else {
+			fmt.Printf("%s\t%s\n", key, payload)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d keys not dumped", failed, len(positional)-1)
+	}
+
+	return nil
+}
+
+/*
+* 解析 DUMP 序列化数据并以 json 输出，数据来自参数或者标准输入
+ */
+func runUndump(args []string) error {
+	fs := flag.NewFlagSet("undump", flag.ExitOnError)
+	format := fs.String("format", DUMP_HEX, "input format: hex, escaped (redis-cli style) or raw")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var input string
+	switch len(positional) {
+	case 0:
+		buf, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		input = string(buf)
+	case 1:
+		input = positional[0]
+	default:
+		return errors.New("usage: decode " + undumpUsage)
+	}
+
+	payload, err := parsePayload(input, *format)
+	if err != nil {
+		return err
+	}
+
+	obj, err := ParseDumpPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := json.MarshalIndent(newRetData(obj), "", " ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(response))
+	return nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const DumpNotExists = 1002
+const DumpLoading = 1003
+
+/* 加载任务的状态 */
+const LOAD_PARSING = "parsing"
+const LOAD_DONE = "done"
+const LOAD_FAILED = "failed"
+
+/* 汇总时默认返回的key和前缀数量，以及最大数量 */
+const AGGREGATE_COUNT = 100
+const AGGREGATE_MAX_COUNT = 10000
+
+/*
+* 同时加载的多个文件，例如集群的所有分片，或者不同时间的两份数据
+* names 保持加载顺序，第一个文件为默认文件，兼容不带 /dumps/{name} 前缀的接口
+* 文件在后台解析，解析完成后才加入，jobs 记录所有文件的解析进度
+ */
+type DumpSet struct {
+	mutex  sync.RWMutex
+	names  []string
+	dumps  map[string]*RdbHandler
+	nextId int
+	jobs   []*LoadJob
+	upload bool
+}
+
+func NewDumpSet() *DumpSet {
+	return &DumpSet{dumps: make(map[string]*RdbHandler)}
+}
+
+/*
+* 解析 name=path 形式的参数，没有指定名称时名称为空
+* 等号前面包含路径分隔符时认为是文件名的一部分
+ */
+func parseDumpArg(arg string) (string, string) {
+	pos := strings.Index(arg, "=")
+	if pos <= 0 || strings.ContainsAny(arg[:pos], "/\\") {
+		return "", arg
+	}
+
+	return arg[:pos], arg[pos+1:]
+}
+
+/*
+* 没有指定名称时使用去掉 .gz .rdb .aof 后缀的文件名
+ */
+func dumpName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".rdb", ".aof"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return name
+}
+
+/*
+* 加入一个文件，没有名称时使用去掉扩展名的文件名，重名时加上序号
+ */
+func (ds *DumpSet) Add(name string, rh *RdbHandler) string {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if name == "" {
+		name = dumpName(rh.path)
+	}
+
+	unique := name
+	for i := 2; ds.dumps[unique] != nil; i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+
+	rh.name = unique
+	ds.names = append(ds.names, unique)
+	ds.dumps[unique] = rh
+
+	return unique
+}
+
+/*
+* 按加载顺序返回所有文件
+ */
+func (ds *DumpSet) list() []*RdbHandler {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	dumps := make([]*RdbHandler, 0, len(ds.names))
+	for _, name := range ds.names {
+		dumps = append(dumps, ds.dumps[name])
+	}
+
+	return dumps
+}
+
+/*
+* 根据名称查找文件，名称为空时返回第一个文件
+ */
+func (ds *DumpSet) get(name string) (*RdbHandler, bool) {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	if name == "" {
+		if len(ds.names) == 0 {
+			return nil, false
+		}
+		name = ds.names[0]
+	}
+	rh, ok := ds.dumps[name]
+
+	return rh, ok
+}
+
+/*
+* 根据路由中的 name 找到对应的文件再调用处理函数，没有 name 时使用第一个文件
+ */
+func (ds *DumpSet) handle(fn func(*RdbHandler, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		rh, ok := ds.get(name)
+		if !ok && ds.loading(name) {
+			writeResult(w, &ReturnResult{DumpLoading, "dump is loading, see /status for progress", nil})
+			return
+		}
+		if !ok && name == "" {
+			writeResult(w, &ReturnResult{DumpNotExists, "no dump loaded", nil})
+			return
+		}
+		if !ok {
+			writeResult(w, &ReturnResult{DumpNotExists, fmt.Sprintf("dump %s not exists", name), nil})
+			return
+		}
+
+		fn(rh, w, r)
+	}
+}
+
+/*
+* 一个文件的解析任务，path 为实际解析的文件，fileName 为显示的文件名，上传的文件两者不同
+ */
+type LoadJob struct {
+	id       int
+	name     string
+	path     string
+	fileName string
+	size     int64
+	upload   bool
+	state    string
+	err      string
+	dump     string
+	progress *Progress
+}
+
+type LoadStatus struct {
+	Id       int     `json:"id"`
+	Name     string  `json:"name"`
+	FileName string  `json:"fileName"`
+	Upload   bool    `json:"upload"`
+	Size     int64   `json:"size"`
+	State    string  `json:"state"`
+	Bytes    int64   `json:"bytes"`
+	Keys     int64   `json:"keys"`
+	Percent  float64 `json:"percent"`
+	EtaMs    int64   `json:"etaMs"`
+	Error    string  `json:"error,omitempty"`
+	Dump     string  `json:"dump,omitempty"`
+}
+
+/*
+* 服务状态：是否允许上传，正在解析的文件个数和所有解析任务
+ */
+type ServerStatus struct {
+	Upload  bool          `json:"upload"`
+	Loading int           `json:"loading"`
+	Jobs    []*LoadStatus `json:"jobs"`
+}
+
+/*
+* rdb 文件的大小，作为解析进度的总量，aof 无法按字节计算进度，返回0
+ */
+func rdbFileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil || isAofPath(path) {
+		return 0
+	}
+
+	return info.Size()
+}
+
+/*
+* 创建一个解析任务，之后调用 Load 解析
+ */
+func (ds *DumpSet) NewJob(name, path, fileName string, size int64, upload bool) *LoadJob {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.nextId++
+	job := &LoadJob{id: ds.nextId, name: name, path: path, fileName: fileName, size: size, upload: upload, state: LOAD_PARSING, progress: NewProgress(size)}
+	ds.jobs = append(ds.jobs, job)
+
+	return job
+}
+
+/*
+* 解析文件，完成后加入 DumpSet，showProgress 为 true 时在 stderr 上显示进度条
+ */
+func (ds *DumpSet) Load(job *LoadJob, showProgress bool) {
+	if showProgress {
+		job.progress.Start(200 * time.Millisecond)
+	}
+	rh, err := safeLoadDump(job.path, job.progress)
+	if showProgress {
+		job.progress.Stop()
+	}
+
+	dump := ""
+	if err == nil {
+		rh.path = job.fileName
+		dump = ds.Add(job.name, rh)
+	} else {
+		fmt.Printf("load %s failed, errmsg: %s\n", job.fileName, err)
+	}
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if err != nil {
+		job.state = LOAD_FAILED
+		job.err = err.Error()
+		return
+	}
+	job.state = LOAD_DONE
+	job.dump = dump
+}
+
+/*
+* 解析损坏的文件时可能出现越界等异常，转换为错误，不影响服务中的其他文件
+ */
+func safeLoadDump(path string, progress *Progress) (rh *RdbHandler, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rh, err = nil, fmt.Errorf("parse failed: %v", r)
+		}
+	}()
+
+	return loadDump(path, progress)
+}
+
+/*
+* 名称对应的文件是否还在解析，名称为空时判断是否有文件在解析
+ */
+func (ds *DumpSet) loading(name string) bool {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	for _, job := range ds.jobs {
+		if job.state != LOAD_PARSING {
+			continue
+		}
+		// 没有指定名称的文件加载完成后使用 Add 中同样的规则命名
+		if name == "" || job.name == name || (job.name == "" && dumpName(job.fileName) == name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ds *DumpSet) status(job *LoadJob) *LoadStatus {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	status := &LoadStatus{Id: job.id, Name: job.name, FileName: job.fileName, Upload: job.upload, Size: job.size, State: job.state, Error: job.err, Dump: job.dump, EtaMs: -1}
+	var eta time.Duration
+	status.Bytes, status.Keys, status.Percent, eta = job.progress.state()
+	if eta >= 0 && job.state == LOAD_PARSING {
+		status.EtaMs = eta.Nanoseconds() / int64(time.Millisecond)
+	}
+
+	return status
+}
+
+/*
+* 所有文件的解析进度和错误
+ */
+func (ds *DumpSet) getStatus(w http.ResponseWriter, r *http.Request) {
+	ds.mutex.RLock()
+	jobs := make([]*LoadJob, len(ds.jobs))
+	copy(jobs, ds.jobs)
+	ds.mutex.RUnlock()
+
+	status := &ServerStatus{Upload: ds.upload, Jobs: make([]*LoadStatus, len(jobs))}
+	for i, job := range jobs {
+		status.Jobs[i] = ds.status(job)
+		if status.Jobs[i].State == LOAD_PARSING {
+			status.Loading++
+		}
+	}
+
+	writeResult(w, &ReturnResult{Success, "", status})
+}
+
+func writeResult(w http.ResponseWriter, result *ReturnResult) {
+	response, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+type DumpInfo struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Version  int    `json:"version"`
+	Keys     int64  `json:"keys"`
+	Expires  int64  `json:"expires"`
+	FileSize int64  `json:"fileSize"`
+	Memory   int64  `json:"memory"`
+}
+
+/*
+* 已加载的文件列表
+ */
+func (ds *DumpSet) getDumps(w http.ResponseWriter, r *http.Request) {
+	dumps := []*DumpInfo{}
+	for _, rh := range ds.list() {
+		meta := rh.rdb.meta
+		info := &DumpInfo{Name: rh.name, Path: rh.path, Version: meta.Version, Keys: meta.Keys, Expires: meta.Expires, FileSize: meta.FileSize}
+		for _, entry := range rh.entries {
+			info.Memory += entry.Memory
+		}
+		dumps = append(dumps, info)
+	}
+
+	writeResult(w, &ReturnResult{Success, "", dumps})
+}
+
+/*
+* 汇总参数中的返回数量
+ */
+func parseAggregateCount(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("count")
+	if v == "" {
+		return AGGREGATE_COUNT, nil
+	}
+
+	count, err := strconv.Atoi(v)
+	if err != nil || count < 1 || count > AGGREGATE_MAX_COUNT {
+		return 0, errors.New("count must be in 1 - " + strconv.Itoa(AGGREGATE_MAX_COUNT))
+	}
+
+	return count, nil
+}
+
+/*
+* 所有文件中占用内存最多的key，可以按类型过滤
+ */
+func (ds *DumpSet) getAggregateTop(w http.ResponseWriter, r *http.Request) {
+	count, err := parseAggregateCount(r)
+	if err != nil {
+		writeResult(w, &ReturnResult{InvalidParams, err.Error(), nil})
+		return
+	}
+
+	typeName := r.URL.Query().Get("type")
+	top := newTopKeys(count)
+	for _, rh := range ds.list() {
+		for _, entry := range rh.entries {
+			entryType := typeMap[rdbObjType[int(entry.Type)]]
+			if typeName != "" && entryType != typeName {
+				continue
+			}
+			if top.wants(entry.Memory) {
+				top.add(&KeySize{Dump: rh.name, Db: entry.Db, Key: entry.Key, Type: entryType, Size: entry.Memory})
+			}
+		}
+	}
+
+	writeResult(w, &ReturnResult{Success, "", top.sorted()})
+}
+
+type DumpPrefix struct {
+	Keys   int64 `json:"keys"`
+	Memory int64 `json:"memory"`
+}
+
+/*
+* 一个前缀在所有文件中的key数量和内存，dumps 为每个文件中的数量
+ */
+type AggregatePrefix struct {
+	Prefix string                 `json:"prefix"`
+	Keys   int64                  `json:"keys"`
+	Memory int64                  `json:"memory"`
+	Dumps  map[string]*DumpPrefix `json:"dumps"`
+}
+
+/*
+* 按前缀汇总所有文件的key，按内存从大到小返回
+ */
+func (ds *DumpSet) getAggregatePrefixes(w http.ResponseWriter, r *http.Request) {
+	count, err := parseAggregateCount(r)
+	if err != nil {
+		writeResult(w, &ReturnResult{InvalidParams, err.Error(), nil})
+		return
+	}
+
+	delim := r.URL.Query().Get("delim")
+	if delim == "" {
+		delim = ":"
+	}
+
+	prefixMap := make(map[string]*AggregatePrefix)
+	for _, rh := range ds.list() {
+		for _, entry := range rh.entries {
+			prefix := keyPrefix(entry.Key, delim)
+			stat, ok := prefixMap[prefix]
+			if !ok {
+				stat = &AggregatePrefix{Prefix: prefix, Dumps: make(map[string]*DumpPrefix)}
+				prefixMap[prefix] = stat
+			}
+			dump, ok := stat.Dumps[rh.name]
+			if !ok {
+				dump = &DumpPrefix{}
+				stat.Dumps[rh.name] = dump
+			}
+			stat.Keys++
+			stat.Memory += entry.Memory
+			dump.Keys++
+			dump.Memory += entry.Memory
+		}
+	}
+
+	prefixes := make([]*AggregatePrefix, 0, len(prefixMap))
+	for _, stat := range prefixMap {
+		prefixes = append(prefixes, stat)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Memory != prefixes[j].Memory {
+			return prefixes[i].Memory > prefixes[j].Memory
+		}
+		return prefixes[i].Prefix < prefixes[j].Prefix
+	})
+	if len(prefixes) > count {
+		prefixes = prefixes[:count]
+	}
+
+	writeResult(w, &ReturnResult{Success, "", prefixes})
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+/* 每次默认返回的元素个数和最大个数 */
+const ELEMENTS_LIMIT = 100
+const ELEMENTS_MAX_LIMIT = 10000
+
+/*
+* 集合中的一个元素
+* 列表和有序集合的 index 为下标（排名），hash 的 field 为字段名，有序集合的 score 为分值
+ */
+type Element struct {
+	Index *int64   `json:"index,omitempty"`
+	Field string   `json:"field,omitempty"`
+	Value string   `json:"value"`
+	Score *float64 `json:"score,omitempty"`
+}
+
+/*
+* 分页返回的元素，total 为过滤之后的元素个数
+ */
+type ElementsResult struct {
+	Type     int        `json:"type"`
+	TypeName string     `json:"typeName"`
+	Length   int64      `json:"length"`
+	Encoding string     `json:"encoding"`
+	Nodes    int64      `json:"nodes,omitempty"`
+	Total    int64      `json:"total"`
+	Offset   int        `json:"offset"`
+	Elements []*Element `json:"elements"`
+}
+
+/*
+* 分值区间的边界，同 ZRANGEBYSCORE：-inf +inf，( 开头表示不包含
+ */
+type scoreBound struct {
+	val       float64
+	exclusive bool
+}
+
+func parseScoreBound(str string) (scoreBound, error) {
+	// url 中未编码的 + 会变成空格
+	str = strings.TrimSpace(str)
+	bound := scoreBound{}
+	if strings.HasPrefix(str, "(") {
+		bound.exclusive = true
+		str = str[1:]
+	}
+
+	var err error
+	switch str {
+	case "-inf":
+		bound.val = math.Inf(-1)
+	case "+inf", "inf":
+		bound.val = math.Inf(1)
+	default:
+		bound.val, err = strconv.ParseFloat(str, 64)
+		if err != nil || math.IsNaN(bound.val) {
+			return bound, errors.New("invalid score: " + str)
+		}
+	}
+
+	return bound, nil
+}
+
+/*
+* 元素查询条件
+* byRank 时 start stop 同 LRANGE / ZRANGE，可以是负数；byScore 时 min max 同 ZRANGEBYSCORE
+* match 同 HSCAN / SSCAN / ZSCAN 的 MATCH，匹配 hash 的字段、集合成员和列表元素
+ */
+type ElementsQuery struct {
+	db      int
+	offset  int
+	limit   int
+	match   string
+	byRank  bool
+	start   int64
+	stop    int64
+	byScore bool
+	min     scoreBound
+	max     scoreBound
+}
+
+func parseElementsQuery(values url.Values) (*ElementsQuery, error) {
+	q := &ElementsQuery{db: -1, limit: ELEMENTS_LIMIT, match: values.Get("match"), stop: -1}
+	intParam := func(name string, val *int64) error {
+		if v := values.Get(name); v != "" {
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*val = parsed
+		}
+		return nil
+	}
+
+	var offset, limit int64 = 0, ELEMENTS_LIMIT
+	db := int64(-1)
+	err := intParam("db", &db)
+	if err == nil {
+		err = intParam("offset", &offset)
+	}
+	if err == nil {
+		err = intParam("limit", &limit)
+	}
+	if err == nil {
+		err = intParam("start", &q.start)
+	}
+	if err == nil {
+		err = intParam("stop", &q.stop)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if db < -1 {
+		return nil, fmt.Errorf("invalid db: %d", db)
+	}
+	q.db = int(db)
+	if offset < 0 || limit < 1 || limit > ELEMENTS_MAX_LIMIT {
+		return nil, errors.New("offset must not be negative and limit must be in 1 - " + strconv.Itoa(ELEMENTS_MAX_LIMIT))
+	}
+	q.offset, q.limit = int(offset), int(limit)
+
+	q.byRank = values.Get("byRank") != ""
+	q.byScore = values.Get("byScore") != ""
+	if q.byScore {
+		q.min, err = parseScoreBound(values.Get("min"))
+		if err != nil {
+			return nil, err
+		}
+		q.max, err = parseScoreBound(values.Get("max"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+func (b scoreBound) below(score float64) bool {
+	return b.val < score || (!b.exclusive && b.val == score)
+}
+
+func (b scoreBound) above(score float64) bool {
+	return b.val > score || (!b.exclusive && b.val == score)
+}
+
+func (q *ElementsQuery) matches(elem *Element) bool {
+	if q.byScore && elem.Score != nil && (!q.min.below(*elem.Score) || !q.max.above(*elem.Score)) {
+		return false
+	}
+	if q.match == "" {
+		return true
+	}
+	if elem.Field != "" {
+		return globMatch(q.match, elem.Field)
+	}
+
+	return globMatch(q.match, elem.Value)
+}
+
+/*
+* 把对象转为元素列表，hash 和集合按名称排序，有序集合按分值排序，保证分页稳定
+ */
+func sortedElements(obj *RedisObject) []*Element {
+	var elements []*Element
+	switch val := obj.objVal.(type) {
+	case string:
+		elements = []*Element{{Value: val}}
+	case []string:
+		elements = make([]*Element, len(val))
+		for i, item := range val {
+			index := int64(i)
+			elements[i] = &Element{Index: &index, Value: item}
+		}
+	case map[string]string:
+		elements = make([]*Element, 0, len(val))
+		for field, value := range val {
+			elements = append(elements, &Element{Field: field, Value: value})
+		}
+		sort.Slice(elements, func(i, j int) bool { return elements[i].Field < elements[j].Field })
+	case map[string]int:
+		elements = make([]*Element, 0, len(val))
+		for member := range val {
+			elements = append(elements, &Element{Value: member})
+		}
+		sort.Slice(elements, func(i, j int) bool { return elements[i].Value < elements[j].Value })
+	case map[string]float64:
+		elements = make([]*Element, 0, len(val))
+		for member, score := range val {
+			score := score
+			elements = append(elements, &Element{Value: member, Score: &score})
+		}
+		sort.Slice(elements, func(i, j int) bool {
+			if *elements[i].Score != *elements[j].Score {
+				return *elements[i].Score < *elements[j].Score
+			}
+			return elements[i].Value < elements[j].Value
+		})
+		for i, elem := range elements {
+			index := int64(i)
+			elem.Index = &index
+		}
+	}
+
+	return elements
+}
+
+/*
+* 下标区间转为切片的起止位置，负数从末尾开始计算
+ */
+func rankRange(start, stop int64, length int) (int, int) {
+	if start < 0 {
+		start += int64(length)
+	}
+	if stop < 0 {
+		stop += int64(length)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(length) {
+		stop = int64(length) - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+
+	return int(start), int(stop) + 1
+}
+
+/*
+* 过滤并分页
+ */
+func queryElements(elements []*Element, q *ElementsQuery) ([]*Element, int64) {
+	if q.byRank {
+		from, to := rankRange(q.start, q.stop, len(elements))
+		elements = elements[from:to]
+	}
+
+	// 没有过滤条件时直接截取，不需要遍历所有元素
+	if q.match == "" && !q.byScore {
+		// offset 可能接近 int 的最大值，先截断再加 limit，避免溢出
+		from := q.offset
+		if from > len(elements) {
+			from = len(elements)
+		}
+		to := from + q.limit
+		if to > len(elements) {
+			to = len(elements)
+		}
+		return elements[from:to], int64(len(elements))
+	}
+
+	page := []*Element{}
+	var total int64
+	for _, elem := range elements {
+		if !q.matches(elem) {
+			continue
+		}
+		if total >= int64(q.offset) && len(page) < q.limit {
+			page = append(page, elem)
+		}
+		total++
+	}
+
+	return page, total
+}
+
+/*
+* 最近访问的key排好序的元素，翻页时不需要重新读取和排序
+ */
+type elementsCache struct {
+	mutex    sync.Mutex
+	key      string
+	db       int
+	obj      *RedisObject
+	elements []*Element
+}
+
+func (c *elementsCache) get(rh *RdbHandler, key string, db int) (*RedisObject, []*Element, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.obj != nil && c.key == key && c.db == db {
+		return c.obj, c.elements, true
+	}
+
+	obj, ok := rh.loadObject(key, db)
+	if !ok {
+		return nil, nil, false
+	}
+	c.key, c.db, c.obj, c.elements = key, db, obj, sortedElements(obj)
+
+	return c.obj, c.elements, true
+}
+
+/*
+* 分页获取某个key的元素，避免一次返回很大的 value，db 参数指定不同 db 中的同名key
+* stream 类型目前不能解析，没有元素可以按 ID 区间读取，返回 ValueNotParsed
+ */
+func (rh *RdbHandler) getElements(w http.ResponseWriter, r *http.Request) {
+	keyVar := mux.Vars(r)["key"]
+
+	var result *ReturnResult
+	query, err := parseElementsQuery(r.URL.Query())
+	if err != nil {
+		result = &ReturnResult{InvalidParams, err.Error(), nil}
+	} else if obj, elements, ok := rh.elements.get(rh, keyVar, query.db); ok {
+		page, total := queryElements(elements, query)
+		retData := &ElementsResult{obj.objType, typeMap[obj.objType], obj.objLen, obj.encoding(), obj.nodes, total, query.offset, page}
+		result = &ReturnResult{Success, "", retData}
+	} else if valType, ok := rh.unparsedType(keyVar, query.db); ok {
+		result = &ReturnResult{ValueNotParsed, unparsedMessage(keyVar, valType), nil}
+	} else {
+		result = &ReturnResult{KeyNotExists, fmt.Sprintf("key %s not exists", keyVar), nil}
+	}
+
+	response, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+* rdb 文件写入，负责写入各种 opcode 并在结尾追加 crc64 校验和
+ */
+type RdbWriter struct {
+	w       *bufio.Writer
+	version int
+	crc     uint64
+	err     error
+}
+
+func NewRdbWriter(w io.Writer, version int) *RdbWriter {
+	return &RdbWriter{w: bufio.NewWriter(w), version: version}
+}
+
+func (rw *RdbWriter) Write(buf []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	rw.crc = crc64Update(rw.crc, buf)
+	n, err := rw.w.Write(buf)
+	rw.err = err
+
+	return n, err
+}
+
+func (rw *RdbWriter) WriteByte(b byte) error {
+	_, err := rw.Write([]byte{b})
+	return err
+}
+
+func (rw *RdbWriter) WriteHeader() error {
+	_, err := rw.Write([]byte(fmt.Sprintf("REDIS%04d", rw.version)))
+	return err
+}
+
+func (rw *RdbWriter) WriteLen(length uint64) error {
+	var buf []byte
+	switch {
+	case length < 1<<6:
+		buf = []byte{byte(length)}
+	case length < 1<<14:
+		buf = []byte{byte(length>>8) | RDB_14BITLEN<<6, byte(length)}
+	case length <= math.MaxUint32:
+		buf = make([]byte, 5)
+		buf[0] = RDB_32BITLEN
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	default:
+		buf = make([]byte, 9)
+		buf[0] = RDB_64BITLEN
+		binary.BigEndian.PutUint64(buf[1:], length)
+	}
+
+	_, err := rw.Write(buf)
+	return err
+}
+
+/*
+* 写入字符串，不做整数编码和压缩
+ */
+func (rw *RdbWriter) WriteString(str string) error {
+	if err := rw.WriteLen(uint64(len(str))); err != nil {
+		return err
+	}
+
+	_, err := rw.Write([]byte(str))
+	return err
+}
+
+func (rw *RdbWriter) WriteAux(auxKey string, auxVal string) error {
+	rw.WriteByte(RDB_OPCODE_AUX)
+	rw.WriteString(auxKey)
+	return rw.WriteString(auxVal)
+}
+
+/*
+* 写入 aux 字段、函数库等记录，rawVal 为 opcode 之后的原始数据
+ */
+func (rw *RdbWriter) WriteRawRecord(opcode byte, rawVal []byte) error {
+	rw.WriteByte(opcode)
+	_, err := rw.Write(rawVal)
+	return err
+}
+
+func (rw *RdbWriter) WriteSelectDb(dbId int) error {
+	rw.WriteByte(RDB_OPCODE_SELECTDB)
+	return rw.WriteLen(uint64(dbId))
+}
+
+func (rw *RdbWriter) WriteResizeDb(dbSize int, expiresSize int) error {
+	rw.WriteByte(RDB_OPCODE_RESIZEDB)
+	rw.WriteLen(uint64(dbSize))
+	return rw.WriteLen(uint64(expiresSize))
+}
+
+/*
+* 写入一个key，rawVal 为 value 的原始序列化数据
+* expireTime 为毫秒时间戳，-1 表示不过期
+ */
+func (rw *RdbWriter) WriteRawKey(key string, valType byte, rawVal []byte, expireTime int64) error {
+	if expireTime >= 0 {
+		buf := make([]byte, 9)
+		buf[0] = RDB_OPCODE_EXPIRETIME_MS
+		binary.LittleEndian.PutUint64(buf[1:], uint64(expireTime))
+		rw.Write(buf)
+	}
+
+	rw.WriteByte(valType)
+	rw.WriteString(key)
+	_, err := rw.Write(rawVal)
+
+	return err
+}
+
+/*
+* 序列化一个对象，使用不压缩的通用编码
+* 返回类型和 value 的序列化数据
+ */
+func EncodeObject(obj *RedisObject) (byte, []byte, error) {
+	var buf bytes.Buffer
+	vw := NewRdbWriter(&buf, 0)
+
+	var valType byte
+	switch val := obj.objVal.(type) {
+	case string:
+		valType = RDB_TYPE_STRING
+		vw.WriteString(val)
+	case []string:
+		valType = RDB_TYPE_LIST
+		vw.WriteLen(uint64(len(val)))
+		for _, item := range val {
+			vw.WriteString(item)
+		}
+	case map[string]int:
+		valType = RDB_TYPE_SET
+		vw.WriteLen(uint64(len(val)))
+		for member := range val {
+			vw.WriteString(member)
+		}
+	case map[string]float64:
+		valType = RDB_TYPE_ZSET_2
+		vw.WriteLen(uint64(len(val)))
+		scoreBuf := make([]byte, 8)
+		for member, score := range val {
+			vw.WriteString(member)
+			binary.LittleEndian.PutUint64(scoreBuf, math.Float64bits(score))
+			vw.Write(scoreBuf)
+		}
+	case map[string]string:
+		valType = RDB_TYPE_HASH
+		vw.WriteLen(uint64(len(val)))
+		for field, value := range val {
+			vw.WriteString(field)
+			vw.WriteString(value)
+		}
+	default:
+		return 0, nil, fmt.Errorf("can not encode object of type %d", obj.objType)
+	}
+
+	err := vw.Flush()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return valType, buf.Bytes(), nil
+}
+
+func (rw *RdbWriter) WriteObject(key string, obj *RedisObject) error {
+	valType, rawVal, err := EncodeObject(obj)
+	if err != nil {
+		return err
+	}
+
+	return rw.WriteRawKey(key, valType, rawVal, obj.expireTime)
+}
+
+func (rw *RdbWriter) Flush() error {
+	if rw.err != nil {
+		return rw.err
+	}
+
+	return rw.w.Flush()
+}
+
+/*
+* 写入 EOF 及校验和（版本5开始才有校验和）
+ */
+func (rw *RdbWriter) Close() error {
+	rw.WriteByte(RDB_OPCODE_EOF)
+	if rw.version >= 5 {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, rw.crc)
+		rw.Write(buf)
+	}
+	if rw.err != nil {
+		return rw.err
+	}
+
+	return rw.w.Flush()
+}
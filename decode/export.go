@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const exportUsage = "export file [-sql out.sql] [-parquet dir] [-rowgroup 100000] [-elements=false] [-anonymize [anonymize options]]"
+
+/* 每个事务包含的 insert 语句数 */
+const SQL_BATCH = 10000
+
+/*
+* 导出的表结构，sqlite 语法
+* keys 每个key一行，expire_at 为毫秒时间戳，没有过期时间时为 NULL
+* memory 为估算的 redis 内存占用，size 为 value 在 rdb 中的字节数
+* stream 类型没有解析，streams 只记录key、它在 rdb 中的字节数和消息数，不导出消息内容
+ */
+var sqlSchema = []string{
+	`CREATE TABLE keys (db INTEGER NOT NULL, key TEXT NOT NULL, type TEXT NOT NULL, encoding TEXT NOT NULL, expire_at INTEGER, memory INTEGER NOT NULL, elements INTEGER NOT NULL, size INTEGER NOT NULL, PRIMARY KEY (db, key));`,
+	`CREATE TABLE string_values (db INTEGER NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL);`,
+	`CREATE TABLE hash_fields (db INTEGER NOT NULL, key TEXT NOT NULL, field TEXT NOT NULL, value TEXT NOT NULL);`,
+	`CREATE TABLE list_items (db INTEGER NOT NULL, key TEXT NOT NULL, idx INTEGER NOT NULL, value TEXT NOT NULL);`,
+	`CREATE TABLE set_members (db INTEGER NOT NULL, key TEXT NOT NULL, member TEXT NOT NULL);`,
+	`CREATE TABLE zset_members (db INTEGER NOT NULL, key TEXT NOT NULL, member TEXT NOT NULL, score REAL NOT NULL);`,
+	`CREATE TABLE streams (db INTEGER NOT NULL, key TEXT NOT NULL, expire_at INTEGER, size INTEGER NOT NULL, entries INTEGER NOT NULL, PRIMARY KEY (db, key));`,
+}
+
+/* 元素表的索引在数据写入之后创建 */
+var sqlIndexes = []string{
+	`CREATE INDEX keys_type ON keys (type);`,
+	`CREATE INDEX string_values_key ON string_values (db, key);`,
+	`CREATE INDEX hash_fields_key ON hash_fields (db, key);`,
+	`CREATE INDEX list_items_key ON list_items (db, key, idx);`,
+	`CREATE INDEX set_members_key ON set_members (db, key);`,
+	`CREATE INDEX zset_members_key ON zset_members (db, key);`,
+}
+
+/*
+* 字符串转为 sql 字面量，不是合法 utf8 或者包含 \0 时使用 blob
+ */
+func sqlQuote(str string) string {
+	if !utf8.ValidString(str) || strings.IndexByte(str, 0) >= 0 {
+		return "X'" + hex.EncodeToString([]byte(str)) + "'"
+	}
+
+	return "'" + strings.Replace(str, "'", "''", -1) + "'"
+}
+
+func sqlFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+/*
+* 元素个数，字符串为1
+ */
+func elementCount(obj *RedisObject) int64 {
+	switch val := obj.objVal.(type) {
+	case []string:
+		return int64(len(val))
+	case map[string]string:
+		return int64(len(val))
+	case map[string]int:
+		return int64(len(val))
+	case map[string]float64:
+		return int64(len(val))
+	}
+
+	return 1
+}
+
+func sortedStrings(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+* 导出格式，scanKeys 遍历时依次写入每个key
+* addStream 写入没有解析的 stream，size 为 value 在 rdb 中的字节数，entries 为消息数
+ */
+type exporter interface {
+	add(dbId int, key string, obj *RedisObject) error
+	addStream(dbId int, key string, expireTime int64, size int64, entries int64) error
+	end() error
+	rows() int64
+}
+
+/*
+* 导出为 sql 脚本，可以用 sqlite3 out.db < out.sql 导入
+ */
+type sqlExporter struct {
+	file     *os.File
+	w        *bufio.Writer
+	elements bool
+	count    int64
+}
+
+func newSqlExporter(path string, elements bool) (*sqlExporter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &sqlExporter{file: file, w: bufio.NewWriter(file), elements: elements}
+	for _, stmt := range sqlSchema {
+		e.w.WriteString(stmt + "\n")
+	}
+	e.w.WriteString("BEGIN;\n")
+
+	return e, nil
+}
+
+/*
+* 写入一行，每 SQL_BATCH 行提交一次事务，同时检查之前的写入是否出错
+ */
+func (e *sqlExporter) insert(table string, values ...string) error {
+	e.w.WriteString("INSERT INTO " + table + " VALUES (" + strings.Join(values, ",") + ");\n")
+	e.count++
+	if e.count%SQL_BATCH == 0 {
+		_, err := e.w.WriteString("COMMIT;\nBEGIN;\n")
+		return err
+	}
+
+	return nil
+}
+
+func sqlExpireAt(expireTime int64) string {
+	if expireTime < 0 {
+		return "NULL"
+	}
+
+	return strconv.FormatInt(expireTime, 10)
+}
+
+func (e *sqlExporter) add(dbId int, key string, obj *RedisObject) error {
+	db := strconv.Itoa(dbId)
+	quoted := sqlQuote(key)
+	err := e.insert("keys", db, quoted, sqlQuote(typeMap[obj.objType]), sqlQuote(obj.encoding()), sqlExpireAt(obj.expireTime),
+		strconv.FormatInt(estimateMemory(key, obj), 10), strconv.FormatInt(elementCount(obj), 10), strconv.FormatInt(obj.objLen, 10))
+	if err != nil || !e.elements {
+		return err
+	}
+
+	switch val := obj.objVal.(type) {
+	case string:
+		err = e.insert("string_values", db, quoted, sqlQuote(val))
+	case []string:
+		for i, item := range val {
+			err = e.insert("list_items", db, quoted, strconv.Itoa(i), sqlQuote(item))
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		fields := make([]string, 0, len(val))
+		for field := range val {
+			fields = append(fields, field)
+		}
+		for _, field := range sortedStrings(fields) {
+			err = e.insert("hash_fields", db, quoted, sqlQuote(field), sqlQuote(val[field]))
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]int:
+		members := make([]string, 0, len(val))
+		for member := range val {
+			members = append(members, member)
+		}
+		for _, member := range sortedStrings(members) {
+			err = e.insert("set_members", db, quoted, sqlQuote(member))
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]float64:
+		members := make([]string, 0, len(val))
+		for member := range val {
+			members = append(members, member)
+		}
+		for _, member := range sortedStrings(members) {
+			err = e.insert("zset_members", db, quoted, sqlQuote(member), sqlFloat(val[member]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+func (e *sqlExporter) addStream(dbId int, key string, expireTime int64, size int64, entries int64) error {
+	return e.insert("streams", strconv.Itoa(dbId), sqlQuote(key), sqlExpireAt(expireTime), strconv.FormatInt(size, 10), strconv.FormatInt(entries, 10))
+}
+
+func (e *sqlExporter) end() error {
+	e.w.WriteString("COMMIT;\n")
+	for _, stmt := range sqlIndexes {
+		e.w.WriteString(stmt + "\n")
+	}
+
+	err := e.w.Flush()
+	if err != nil {
+		e.file.Close()
+		return err
+	}
+
+	return e.file.Close()
+}
+
+func (e *sqlExporter) rows() int64 {
+	return e.count
+}
+
+/*
+* 导出为 parquet 文件，schema 固定
+* keys.parquet 每个key一行，elements.parquet 每个元素一行：
+* 字符串的 value、列表的 idx 和 value、hash 的 field 和 value、集合的 field、有序集合的 field 和 score
+* key、field 和 value 可能是任意二进制数据，不标记为 UTF8，读取时按字节数组处理
+ */
+type parquetExporter struct {
+	keys     *ParquetWriter
+	elements *ParquetWriter
+}
+
+func parquetKeyColumns() []*ParquetColumn {
+	return []*ParquetColumn{
+		{Name: "db", Type: PARQUET_INT64, Converted: PARQUET_NONE},
+		{Name: "key", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_NONE},
+		{Name: "type", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_UTF8},
+		{Name: "encoding", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_UTF8},
+		{Name: "expire_at", Type: PARQUET_INT64, Converted: PARQUET_TIMESTAMP_MILLIS, Optional: true},
+		{Name: "memory", Type: PARQUET_INT64, Converted: PARQUET_NONE},
+		{Name: "elements", Type: PARQUET_INT64, Converted: PARQUET_NONE},
+		{Name: "size", Type: PARQUET_INT64, Converted: PARQUET_NONE},
+	}
+}
+
+func parquetElementColumns() []*ParquetColumn {
+	return []*ParquetColumn{
+		{Name: "db", Type: PARQUET_INT64, Converted: PARQUET_NONE},
+		{Name: "key", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_NONE},
+		{Name: "type", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_UTF8},
+		{Name: "idx", Type: PARQUET_INT64, Converted: PARQUET_NONE, Optional: true},
+		{Name: "field", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_NONE, Optional: true},
+		{Name: "value", Type: PARQUET_BYTE_ARRAY, Converted: PARQUET_NONE, Optional: true},
+		{Name: "score", Type: PARQUET_DOUBLE, Converted: PARQUET_NONE, Optional: true},
+	}
+}
+
+func newParquetExporter(dir string, groupRows int, elements bool) (*parquetExporter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &parquetExporter{}
+	e.keys, err = NewParquetWriter(filepath.Join(dir, "keys.parquet"), parquetKeyColumns(), groupRows)
+	if err != nil {
+		return nil, err
+	}
+	if elements {
+		e.elements, err = NewParquetWriter(filepath.Join(dir, "elements.parquet"), parquetElementColumns(), groupRows)
+		if err != nil {
+			e.keys.Close()
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func (e *parquetExporter) add(dbId int, key string, obj *RedisObject) error {
+	db := int64(dbId)
+	typeName := typeMap[obj.objType]
+	var expireAt interface{}
+	if obj.expireTime >= 0 {
+		expireAt = obj.expireTime
+	}
+	err := e.keys.WriteRow(db, key, typeName, obj.encoding(), expireAt, estimateMemory(key, obj), elementCount(obj), obj.objLen)
+	if err != nil || e.elements == nil {
+		return err
+	}
+
+	switch val := obj.objVal.(type) {
+	case string:
+		err = e.elements.WriteRow(db, key, typeName, nil, nil, val, nil)
+	case []string:
+		for i, item := range val {
+			err = e.elements.WriteRow(db, key, typeName, int64(i), nil, item, nil)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]string:
+		fields := make([]string, 0, len(val))
+		for field := range val {
+			fields = append(fields, field)
+		}
+		for _, field := range sortedStrings(fields) {
+			err = e.elements.WriteRow(db, key, typeName, nil, field, val[field], nil)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]int:
+		members := make([]string, 0, len(val))
+		for member := range val {
+			members = append(members, member)
+		}
+		for _, member := range sortedStrings(members) {
+			err = e.elements.WriteRow(db, key, typeName, nil, member, nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]float64:
+		members := make([]string, 0, len(val))
+		for member := range val {
+			members = append(members, member)
+		}
+		for _, member := range sortedStrings(members) {
+			err = e.elements.WriteRow(db, key, typeName, nil, member, nil, val[member])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+/*
+* parquet 的 schema 固定，不导出没有解析的 stream
+ */
+func (e *parquetExporter) addStream(dbId int, key string, expireTime int64, size int64, entries int64) error {
+	return nil
+}
+
+func (e *parquetExporter) end() error {
+	err := e.keys.Close()
+	if e.elements != nil {
+		elemErr := e.elements.Close()
+		if err == nil {
+			err = elemErr
+		}
+	}
+
+	return err
+}
+
+func (e *parquetExporter) rows() int64 {
+	rows := e.keys.Rows()
+	if e.elements != nil {
+		rows += e.elements.Rows()
+	}
+
+	return rows
+}
+
+/*
+* 导出所有key和元素，sql 脚本方便用 sqlite 做临时分析，parquet 文件可以导入数据仓库
+* stream 类型目前不能解析，sql 脚本中只在 streams 表记录key和消息数，没有消息内容
+* 模块类型和带字段过期时间的 hash 不导出，只输出跳过的个数
+ */
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	sqlFile := fs.String("sql", "", "output sql script, import with: sqlite3 out.db < out.sql; stream entries are not exported, the streams table only has the size and entry count of each stream")
+	parquetDir := fs.String("parquet", "", "output directory of keys.parquet and elements.parquet, streams are not exported")
+	groupRows := fs.Int("rowgroup", PARQUET_ROW_GROUP_ROWS, "max rows per parquet row group")
+	elements := fs.Bool("elements", true, "export strings, hash fields, list items, set and zset members")
+	anonymize := fs.Bool("anonymize", false, "mask keys and values the same way as the anonymize command")
+	newMasker := maskFlags(fs)
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || (*sqlFile == "" && *parquetDir == "") || *groupRows < 1 {
+		return errors.New("usage: decode " + exportUsage)
+	}
+
+	var m *Masker
+	if *anonymize {
+		m, err = newMasker()
+		if err == nil {
+			err = m.reserveKeys(files[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// 出错时关闭已经打开的文件
+	var exporters []exporter
+	closeAll := func() {
+		for _, e := range exporters {
+			e.end()
+		}
+	}
+	if *sqlFile != "" {
+		e, err := newSqlExporter(*sqlFile, *elements)
+		if err != nil {
+			return err
+		}
+		exporters = append(exporters, e)
+	}
+	if *parquetDir != "" {
+		e, err := newParquetExporter(*parquetDir, *groupRows, *elements)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		exporters = append(exporters, e)
+	}
+
+	var keys, skipped int64
+	_, err = scanKeys(files[0], func(dbId int, key string, obj *RedisObject) error {
+		keys++
+		if m != nil && m.matchKey(key) {
+			key, obj = m.MaskKey(dbId, key), m.MaskObject(obj)
+		}
+		for _, e := range exporters {
+			err := e.add(dbId, key, obj)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(entry *KeyEntry) error {
+		if !isStreamType(entry.valType) {
+			skipped++
+			return nil
+		}
+		keys++
+		key := entry.key
+		if m != nil && m.matchKey(key) {
+			key = m.MaskKey(entry.dbId, key)
+		}
+		for _, e := range exporters {
+			err := e.addStream(entry.dbId, key, entry.expireTime, entry.endOffset-entry.valOffset, entry.streamLen)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		closeAll()
+		return err
+	}
+
+	for _, e := range exporters {
+		endErr := e.end()
+		if err == nil {
+			err = endErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d keys", keys)
+	if *sqlFile != "" {
+		fmt.Printf(", %d rows into %s", exporters[0].rows(), *sqlFile)
+	}
+	if *parquetDir != "" {
+		fmt.Printf(", %d rows into %s", exporters[len(exporters)-1].rows(), *parquetDir)
+	}
+	fmt.Println()
+	if skipped > 0 {
+		fmt.Printf("Skipped %d module or field expiring hash keys that can not be exported\n", skipped)
+	}
+
+	return nil
+}
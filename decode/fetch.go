@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fetchUsage = "fetch -source host:port [-auth password] [-user name] [-o dump.rdb] [-serve]"
+
+/* 无盘复制时 rdb 数据以 40 字节的随机标记结尾 */
+const RDB_EOF_MARK_SIZE = 40
+
+/*
+* 边接收边解析，接收到的数据写入文件，
+* ReadAt 在数据还没有到达时阻塞等待
+ */
+type spoolReader struct {
+	file *os.File
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64
+	done bool
+	err  error
+}
+
+func newSpoolReader(file *os.File) *spoolReader {
+	s := &spoolReader{file: file}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+func (s *spoolReader) Write(buf []byte) (int, error) {
+	n, err := s.file.Write(buf)
+
+	s.mu.Lock()
+	s.size += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return n, err
+}
+
+/*
+* 接收结束，err 不为空表示接收失败
+ */
+func (s *spoolReader) finish(err error) {
+	s.mu.Lock()
+	s.done = true
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+func (s *spoolReader) ReadAt(buf []byte, off int64) (int, error) {
+	s.mu.Lock()
+	for s.size < off+int64(len(buf)) && !s.done && s.err == nil {
+		s.cond.Wait()
+	}
+	err := s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return s.file.ReadAt(buf, off)
+}
+
+/*
+* 作为从节点完成复制握手，返回 rdb 数据长度，
+* 无盘复制时长度为 -1 并返回结束标记
+ */
+func replicaHandshake(conn *RespConn, user string, auth string) (int64, []byte, error) {
+	if auth != "" {
+		args := []string{"AUTH", auth}
+		if user != "" {
+			args = []string{"AUTH", user, auth}
+		}
+		_, err := conn.Do(args...)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	_, err := conn.Do("PING")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// 老版本不支持时忽略错误
+	conn.Do("REPLCONF", "listening-port", "0")
+	conn.Do("REPLCONF", "capa", "eof", "capa", "psync2")
+
+	reply, err := conn.Do("PSYNC", "?", "-1")
+	if err != nil {
+		if _, ok := err.(RespError); !ok {
+			return 0, nil, err
+		}
+
+		// 2.8 之前的版本只支持 SYNC
+		err = conn.WriteCommand("SYNC")
+		if err == nil {
+			err = conn.Flush()
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	} else if status, ok := reply.(string); !ok || !strings.HasPrefix(status, "FULLRESYNC") {
+		return 0, nil, fmt.Errorf("unexpected PSYNC reply: %v", reply)
+	}
+
+	// 主节点生成 rdb 期间会发送换行保持连接
+	for {
+		line, err := conn.r.ReadString('\n')
+		if err != nil {
+			return 0, nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		if line[0] == '-' {
+			return 0, nil, RespError(line[1:])
+		}
+		if line[0] != '$' {
+			return 0, nil, fmt.Errorf("unexpected bulk header: %q", line)
+		}
+
+		if strings.HasPrefix(line, "$EOF:") {
+			mark := []byte(line[5:])
+			if len(mark) != RDB_EOF_MARK_SIZE {
+				return 0, nil, fmt.Errorf("invalid EOF mark: %q", line)
+			}
+			return -1, mark, nil
+		}
+
+		length, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return 0, nil, err
+		}
+		return length, nil, nil
+	}
+}
+
+/*
+* 接收以 mark 结尾的 rdb 数据，写入时去掉结尾的标记及之后的数据
+ */
+func receiveUntilMark(r io.Reader, w io.Writer, mark []byte, progress *Progress) (int64, error) {
+	buf := make([]byte, 64*1024)
+	var tail []byte
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		data := append(tail, buf[:n]...)
+		// 标记之后可能紧跟着复制流中的命令
+		if end := bytes.Index(data, mark); end >= 0 {
+			n, werr := w.Write(data[:end])
+			written += int64(n)
+			if progress != nil {
+				progress.Update(written, 0)
+			}
+			return written, werr
+		}
+
+		if len(data) > len(mark) {
+			n, werr := w.Write(data[:len(data)-len(mark)])
+			written += int64(n)
+			if werr != nil {
+				return written, werr
+			}
+			tail = append([]byte(nil), data[len(data)-len(mark):]...)
+		} else {
+			tail = data
+		}
+		if progress != nil {
+			progress.Update(written, 0)
+		}
+
+		if err == io.EOF {
+			return written, errors.New("connection closed before EOF mark")
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+/*
+* 接收固定长度的 rdb 数据
+ */
+func receiveLength(r io.Reader, w io.Writer, length int64, progress *Progress) (int64, error) {
+	buf := make([]byte, 64*1024)
+	var written int64
+	for written < length {
+		chunk := buf
+		if int64(len(chunk)) > length-written {
+			chunk = chunk[:length-written]
+		}
+
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			_, werr := w.Write(chunk[:n])
+			if werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if progress != nil {
+			progress.Update(written, 0)
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+/*
+* 通过主从复制从运行中的redis获取rdb数据
+ */
+func runFetch(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	source := fs.String("source", "", "redis address, eg: 127.0.0.1:6379")
+	user := fs.String("user", "", "redis ACL user")
+	auth := fs.String("auth", "", "redis password")
+	output := fs.String("o", "", "save the rdb file to this path")
+	serve := fs.Bool("serve", false, "decode while receiving and start the web server")
+	timeout := fs.Duration("timeout", 10*time.Second, "connect timeout")
+	showProgress := fs.Bool("progress", true, "show progress bar on stderr")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *source == "" || len(positional) != 0 || (*output == "" && !*serve) {
+		return errors.New("usage: decode " + fetchUsage)
+	}
+
+	conn, err := DialResp(*source, *timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	length, mark, err := replicaHandshake(conn, *user, *auth)
+	if err != nil {
+		return err
+	}
+
+	var file *os.File
+	if *output != "" {
+		file, err = os.Create(*output)
+	} else {
+		file, err = ioutil.TempFile("", "rdb-fetch-")
+		if err == nil {
+			defer os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var progress *Progress
+	if *showProgress {
+		progress = NewProgress(length)
+		progress.Start(200 * time.Millisecond)
+	}
+
+	spool := newSpoolReader(file)
+	received := make(chan int64, 1)
+	go func(r *bufio.Reader) {
+		var n int64
+		var err error
+		if mark != nil {
+			n, err = receiveUntilMark(r, spool, mark, progress)
+		} else {
+			n, err = receiveLength(r, spool, length, progress)
+		}
+		spool.finish(err)
+		received <- n
+	}(conn.r)
+
+	var rdb *Rdb
+	var decodeErr error
+	rh := &RdbHandler{path: *source}
+	if *serve {
+		rdb = NewRdb(spool)
+		rdb.stats = NewStats(STATS_TOP)
+		rh.collectEntries(rdb)
+		decodeErr = rdb.DecodeRDBFile()
+		if decodeErr != nil {
+			// 解析失败时不再继续接收
+			conn.Close()
+		}
+		sortIndexEntries(rh.entries)
+	}
+
+	n := <-received
+	if progress != nil {
+		progress.Stop()
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if spool.err != nil {
+		return spool.err
+	}
+	conn.Close()
+
+	if *output != "" {
+		fmt.Printf("Saved %d bytes to %s\n", n, *output)
+	}
+	if rdb != nil {
+		rh.rdb = rdb
+		dumps := NewDumpSet()
+		dumps.Add("", rh)
+		return startServer(dumps)
+	}
+
+	return nil
+}
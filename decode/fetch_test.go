@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const testEofMark = "0123456789abcdef0123456789abcdef01234567"
+
+/*
+* 测试用的主节点，完成复制握手后发送 rdb 数据
+* mark 为空时使用 $<len> 格式，否则使用无盘复制的 $EOF:<mark> 格式；psync 为 false 时模拟只支持 SYNC 的老版本
+ */
+func fakeMaster(t *testing.T, rdbData []byte, mark string, psync bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := NewRespConn(c)
+		defer conn.Close()
+
+		for {
+			args, err := conn.ReadCommand(RESP_MAX_ARGS, RESP_MAX_ARG_LEN)
+			if err != nil {
+				return
+			}
+
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				conn.WriteStatus("PONG")
+			case "AUTH", "REPLCONF":
+				conn.WriteStatus("OK")
+			case "PSYNC":
+				if !psync {
+					conn.WriteError("ERR unknown command 'PSYNC'")
+					break
+				}
+				conn.WriteStatus("FULLRESYNC " + strings.Repeat("a", 40) + " 0")
+				fallthrough
+			case "SYNC":
+				// 生成 rdb 期间发送的换行
+				conn.w.WriteString("\n\n")
+				if mark == "" {
+					conn.w.WriteString("$" + strconv.Itoa(len(rdbData)) + "\r\n")
+					conn.w.Write(rdbData)
+				} else {
+					conn.w.WriteString("$EOF:" + mark + "\r\n")
+					conn.w.Write(rdbData)
+					conn.w.WriteString(mark)
+				}
+				// 之后是复制流中的命令，不属于 rdb 数据
+				conn.WriteCommand("PING")
+			default:
+				conn.WriteError("ERR unknown command '" + args[0] + "'")
+			}
+			if conn.Flush() != nil {
+				return
+			}
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestFetch(t *testing.T) {
+	path := restoreTestRdb(t)
+	rdbData, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		mark  string
+		psync bool
+	}{
+		{"fullresync", "", true},
+		{"diskless", testEofMark, true},
+		{"sync", "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr := fakeMaster(t, rdbData, c.mark, c.psync)
+			output := filepath.Join(t.TempDir(), "fetched.rdb")
+			err := runFetch([]string{"-source", addr, "-auth", "secret", "-o", output, "-progress=false"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fetched, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fetched, rdbData) {
+				t.Fatalf("fetched %d bytes, expected %d bytes", len(fetched), len(rdbData))
+			}
+
+			rdb, file, err := openRdbFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			if err := rdb.DecodeRDBFile(); err != nil {
+				t.Fatal(err)
+			}
+			if len(rdb.mapObj) != 3 {
+				t.Errorf("decoded %d keys, expected 3", len(rdb.mapObj))
+			}
+		})
+	}
+}
+
+func TestReceiveUntilMarkSplit(t *testing.T) {
+	data := bytes.Repeat([]byte("rdb data "), 20)
+	stream := append(append(append([]byte(nil), data...), testEofMark...), "*1\r\n$4\r\nPING\r\n"...)
+
+	// 每次只读取一个字节，标记会被拆分到多次读取中
+	var out bytes.Buffer
+	n, err := receiveUntilMark(iotest.OneByteReader(bytes.NewReader(stream)), &out, []byte(testEofMark), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("received %q", out.Bytes())
+	}
+
+	_, err = receiveUntilMark(bytes.NewReader(data), &out, []byte(testEofMark), nil)
+	if err == nil {
+		t.Errorf("expected an error when the connection closes before the mark")
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const indexUsage = "index file"
+const getUsage = "get file key [-db n]"
+
+/* 索引文件的标识，最后两位是格式版本 */
+const INDEX_MAGIC = "RDBIDX02"
+
+/* 索引文件的后缀，索引总是保存在 rdb 文件旁边，加载时按这个路径查找 */
+const INDEX_SUFFIX = ".idx"
+
+/*
+* 索引中的一个key，offset 和 length 是 value 在 rdb 文件中的位置
+* memory 为估算的 redis 内存占用
+ */
+type IndexEntry struct {
+	Db         int    `json:"db"`
+	Key        string `json:"key"`
+	Type       byte   `json:"type"`
+	Offset     int64  `json:"offset"`
+	Length     int64  `json:"length"`
+	ExpireTime int64  `json:"expireTime"`
+	Memory     int64  `json:"memory"`
+}
+
+/*
+* rdb 文件的索引，key 按名称和 db 排序
+* 只保存 key 的位置，value 在需要时从 rdb 文件中读取解析
+* unparsed 为没有解析 value 的 stream、模块类型和带字段过期时间的 hash
+ */
+type RdbIndex struct {
+	fp         io.ReaderAt
+	sourceSize int64
+	sourceTime int64
+	version    int
+	meta       *Metadata
+	stats      *Stats
+	entries    []*IndexEntry
+	unparsed   []*IndexEntry
+	keys       []string
+}
+
+func indexPath(rdbFile string) string {
+	return rdbFile + INDEX_SUFFIX
+}
+
+func newIndexEntry(entry *KeyEntry) *IndexEntry {
+	return &IndexEntry{
+		Db:         entry.dbId,
+		Key:        entry.key,
+		Type:       entry.valType,
+		Offset:     entry.valOffset,
+		Length:     entry.endOffset - entry.valOffset,
+		ExpireTime: entry.expireTime,
+		Memory:     estimateMemory(entry.key, entry.obj),
+	}
+}
+
+/*
+* 没有解析的 value 无法估算内存，使用在 rdb 文件中的大小
+ */
+func newUnparsedEntry(entry *KeyEntry) *IndexEntry {
+	return &IndexEntry{
+		Db:         entry.dbId,
+		Key:        entry.key,
+		Type:       entry.valType,
+		Offset:     entry.valOffset,
+		Length:     entry.endOffset - entry.valOffset,
+		ExpireTime: entry.expireTime,
+		Memory:     entry.endOffset - entry.valOffset,
+	}
+}
+
+/*
+* 按 key 名称和 db 排序
+ */
+func sortIndexEntries(entries []*IndexEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Db < entries[j].Db
+	})
+}
+
+/*
+* 解析 rdb 文件生成索引，同时计算元数据和统计信息
+ */
+func BuildIndex(rdbFile string) (*RdbIndex, error) {
+	rdb, file, err := openRdbFile(rdbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	index := &RdbIndex{fp: file, sourceSize: info.Size(), sourceTime: info.ModTime().UnixNano()}
+	rdb.stats = NewStats(STATS_TOP)
+	rdb.visitor = func(entry *KeyEntry) error {
+		delete(rdb.mapObj, entry.key)
+		if entry.obj == nil {
+			index.unparsed = append(index.unparsed, newUnparsedEntry(entry))
+			return nil
+		}
+
+		index.entries = append(index.entries, newIndexEntry(entry))
+		return nil
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return nil, err
+	}
+
+	index.version = rdb.version
+	index.meta = rdb.meta
+	index.stats = rdb.stats
+	sortIndexEntries(index.entries)
+	sortIndexEntries(index.unparsed)
+	index.buildKeys()
+
+	return index, nil
+}
+
+/*
+* 索引文件格式，整数都是 varint
+* <magic><rdb size><rdb mtime><rdb version><meta json><stats json><count><entry>...<unparsed count><entry>...
+* entry: <db><type byte><key><offset><length><expire time><memory>
+ */
+func (index *RdbIndex) Save(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUint := func(val uint64) {
+		n := binary.PutUvarint(buf, val)
+		w.Write(buf[:n])
+	}
+	writeInt := func(val int64) {
+		n := binary.PutVarint(buf, val)
+		w.Write(buf[:n])
+	}
+	writeBytes := func(val []byte) {
+		writeUint(uint64(len(val)))
+		w.Write(val)
+	}
+
+	metaJson, err := json.Marshal(index.meta)
+	if err != nil {
+		return err
+	}
+	statsJson, err := json.Marshal(index.stats)
+	if err != nil {
+		return err
+	}
+
+	w.WriteString(INDEX_MAGIC)
+	writeInt(index.sourceSize)
+	writeInt(index.sourceTime)
+	writeUint(uint64(index.version))
+	writeBytes(metaJson)
+	writeBytes(statsJson)
+	for _, entries := range [][]*IndexEntry{index.entries, index.unparsed} {
+		writeUint(uint64(len(entries)))
+		for _, entry := range entries {
+			writeUint(uint64(entry.Db))
+			w.WriteByte(entry.Type)
+			writeBytes([]byte(entry.Key))
+			writeInt(entry.Offset)
+			writeInt(entry.Length)
+			writeInt(entry.ExpireTime)
+			writeInt(entry.Memory)
+		}
+	}
+
+	return w.Flush()
+}
+
+/*
+* 加载 rdb 文件的索引，索引不存在时返回 nil
+* rdb 文件的大小或者修改时间和生成索引时不一致时返回错误
+ */
+func LoadIndex(rdbFile string) (*RdbIndex, error) {
+	idxFile, err := os.Open(indexPath(rdbFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer idxFile.Close()
+
+	file, err := os.Open(rdbFile)
+	if err != nil {
+		return nil, err
+	}
+	info, err := idxFile.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	index, err := readIndex(idxFile, info.Size())
+	if err == nil {
+		err = index.check(file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", indexPath(rdbFile), err)
+	}
+	index.fp = file
+
+	return index, nil
+}
+
+/*
+* 读取索引文件，size 为文件大小
+* 长度和个数都来自文件内容，先和剩下的字节数比较再分配内存，避免损坏的索引导致 panic 或者内存耗尽
+ */
+func readIndex(file io.Reader, size int64) (*RdbIndex, error) {
+	limited := &io.LimitedReader{R: file, N: size}
+	r := bufio.NewReader(limited)
+	remaining := func() uint64 {
+		return uint64(limited.N) + uint64(r.Buffered())
+	}
+
+	magic := make([]byte, len(INDEX_MAGIC))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != INDEX_MAGIC {
+		return nil, errors.New("not an index file")
+	}
+
+	readBytes := func() ([]byte, error) {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if length > remaining() {
+			return nil, errors.New("index file is corrupted")
+		}
+		buf := make([]byte, length)
+		_, err = io.ReadFull(r, buf)
+		return buf, err
+	}
+
+	index := &RdbIndex{meta: NewMetadata()}
+	index.sourceSize, err = binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	index.sourceTime, err = binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	metaJson, err := readBytes()
+	if err != nil {
+		return nil, err
+	}
+	statsJson, err := readBytes()
+	if err != nil {
+		return nil, err
+	}
+	index.version = int(version)
+	err = json.Unmarshal(metaJson, index.meta)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(statsJson, &index.stats)
+	if err != nil {
+		return nil, err
+	}
+
+	readEntries := func() ([]*IndexEntry, error) {
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		// 每个 key 至少占用一个字节
+		if count > remaining() {
+			return nil, errors.New("index file is corrupted")
+		}
+
+		var entries []*IndexEntry
+		for i := uint64(0); i < count; i++ {
+			entry := &IndexEntry{}
+			db, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			entry.Db = int(db)
+
+			entry.Type, err = r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			key, err := readBytes()
+			if err != nil {
+				return nil, err
+			}
+			entry.Key = string(key)
+
+			for _, field := range []*int64{&entry.Offset, &entry.Length, &entry.ExpireTime, &entry.Memory} {
+				*field, err = binary.ReadVarint(r)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			entries = append(entries, entry)
+		}
+
+		return entries, nil
+	}
+	index.entries, err = readEntries()
+	if err != nil {
+		return nil, err
+	}
+	index.unparsed, err = readEntries()
+	if err != nil {
+		return nil, err
+	}
+	index.buildKeys()
+
+	return index, nil
+}
+
+/*
+* 检查索引是否和 rdb 文件匹配
+ */
+func (index *RdbIndex) check(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != index.sourceSize || info.ModTime().UnixNano() != index.sourceTime {
+		return errors.New("index is out of date, please rebuild it with the index command")
+	}
+
+	return nil
+}
+
+/*
+* 按名称查找key，db 小于0时返回 db 最小的一个
+ */
+func (index *RdbIndex) Lookup(key string, db int) *IndexEntry {
+	return lookupEntry(index.entries, key, db)
+}
+
+/*
+* 查找没有解析 value 的key
+ */
+func (index *RdbIndex) LookupUnparsed(key string, db int) *IndexEntry {
+	return lookupEntry(index.unparsed, key, db)
+}
+
+func lookupEntry(entries []*IndexEntry, key string, db int) *IndexEntry {
+	pos := sort.Search(len(entries), func(i int) bool { return entries[i].Key >= key })
+	for ; pos < len(entries) && entries[pos].Key == key; pos++ {
+		if db < 0 || entries[pos].Db == db {
+			return entries[pos]
+		}
+	}
+
+	return nil
+}
+
+/*
+* 从 rdb 文件中读取并解析单个key的 value
+ */
+func (index *RdbIndex) LoadObject(entry *IndexEntry) (*RedisObject, error) {
+	rdb := NewRdb(index.fp)
+	rdb.version = index.version
+	rdb.curIndex = entry.Offset
+
+	err := rdb.LoadObject(entry.Key, entry.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, ok := rdb.mapObj[entry.Key]
+	if !ok {
+		return nil, fmt.Errorf("key %s is empty", entry.Key)
+	}
+	obj.expireTime = entry.ExpireTime
+
+	return obj, nil
+}
+
+func (index *RdbIndex) buildKeys() {
+	index.keys = make([]string, 0, len(index.entries))
+	for _, entry := range index.entries {
+		index.keys = append(index.keys, entry.Key)
+	}
+}
+
+/*
+* 按名称排序的key列表
+ */
+func (index *RdbIndex) Keys() []string {
+	return index.keys
+}
+
+/*
+* 用索引构造只包含元数据和统计信息的 Rdb，key 由索引按需读取
+ */
+func (index *RdbIndex) Rdb() *Rdb {
+	rdb := NewRdb(index.fp)
+	rdb.version = index.version
+	rdb.meta = index.meta
+	rdb.stats = index.stats
+
+	return rdb
+}
+
+func (index *RdbIndex) Close() error {
+	if closer, ok := index.fp.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+/*
+* 生成 rdb 文件的索引，之后启动web服务和查询key时不需要重新解析整个文件
+ */
+func runIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || isAofPath(files[0]) {
+		return errors.New("usage: decode " + indexUsage)
+	}
+	output := indexPath(files[0])
+
+	start := time.Now()
+	index, err := BuildIndex(files[0])
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	err = index.Save(output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d keys into %s in %s\n", len(index.entries)+len(index.unparsed), output, time.Since(start))
+	return nil
+}
+
+/*
+* 通过索引读取单个key
+ */
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	db := fs.Int("db", -1, "db of the key, default the first db containing it")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: decode " + getUsage)
+	}
+
+	index, err := LoadIndex(positional[0])
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		return fmt.Errorf("index %s not exists, please build it with the index command", indexPath(positional[0]))
+	}
+	defer index.Close()
+
+	entry := index.Lookup(positional[1], *db)
+	if entry == nil {
+		if unparsed := index.LookupUnparsed(positional[1], *db); unparsed != nil {
+			return errors.New(unparsedMessage(positional[1], unparsed.Type))
+		}
+		return fmt.Errorf("key %s not exists", positional[1])
+	}
+
+	obj, err := index.LoadObject(entry)
+	if err != nil {
+		return err
+	}
+
+	response, err := json.MarshalIndent(newRetData(obj), "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(response))
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+func TestReadIndex(t *testing.T) {
+	path := restoreTestRdb(t)
+	index, err := BuildIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	err = index.Save(indexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(indexPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readIndex(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != 3 || loaded.Lookup("list", 0) == nil {
+		t.Errorf("unexpected entries: %v", loaded.entries)
+	}
+
+	// 截断的索引
+	for _, n := range []int{len(data) - 1, len(data) / 2, len(INDEX_MAGIC) + 1} {
+		if _, err := readIndex(bytes.NewReader(data[:n]), int64(n)); err == nil {
+			t.Errorf("expected an error for an index truncated to %d bytes", n)
+		}
+	}
+}
+
+func TestReadIndexCorruptLengths(t *testing.T) {
+	header := func(lengths ...uint64) []byte {
+		buf := []byte(INDEX_MAGIC)
+		buf = binary.AppendVarint(buf, 0)
+		buf = binary.AppendVarint(buf, 0)
+		buf = binary.AppendUvarint(buf, 9)
+		for _, length := range lengths {
+			buf = binary.AppendUvarint(buf, length)
+		}
+		return buf
+	}
+
+	cases := map[string][]byte{
+		"meta length":  header(1 << 62),
+		"stats length": binary.AppendUvarint(append(header(2), "{}"...), 1<<62),
+		"key count":    binary.AppendUvarint(append(header(2), "{}\x02{}"...), 1<<62),
+	}
+	for name, data := range cases {
+		data = append(data, bytes.Repeat([]byte{0}, 16)...)
+		if _, err := readIndex(bytes.NewReader(data), int64(len(data))); err == nil {
+			t.Errorf("%s: expected an error for a corrupted index", name)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const mergeUsage = "merge a.rdb b.rdb ... -o merged.rdb [-policy first|last|error|rename] [-suffix :dup] [-db-map 0:1,*:0]"
+
+const MERGE_FIRST = "first"
+const MERGE_LAST = "last"
+const MERGE_ERROR = "error"
+const MERGE_RENAME = "rename"
+
+type mergeItem struct {
+	fp    *os.File
+	entry *KeyEntry
+}
+
+type mergeDb struct {
+	keys    []string
+	items   map[string]*mergeItem
+	expires int
+}
+
+/*
+* 模块类型ID的前 54 位是用这些字符编码的 9 个字符的名称
+ */
+const MODULE_TYPE_NAME_CHARSET = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+/*
+* 输入文件中一条 key 以外的记录
+ */
+type mergeRecord struct {
+	opcode byte
+	raw    []byte
+	file   string
+}
+
+/*
+* 合并各个输入文件中 key 以外的记录
+* aux 字段只保留 lua 脚本（redis 7 之前的脚本缓存），其他字段描述的是原来的实例，不写入合并后的文件
+* 函数库按名称合并，同名但内容不同时按 policy 处理；模块辅助数据每个模块只保留第一个
+ */
+type mergeRecords struct {
+	policy     string
+	scripts    []*mergeRecord
+	functions  map[string]*mergeRecord
+	libraries  []string
+	moduleAux  map[int]*mergeRecord
+	modules    []int
+	seen       map[string]bool
+	droppedAux map[string]bool
+}
+
+func newMergeRecords(policy string) *mergeRecords {
+	return &mergeRecords{
+		policy:     policy,
+		functions:  make(map[string]*mergeRecord),
+		moduleAux:  make(map[int]*mergeRecord),
+		seen:       make(map[string]bool),
+		droppedAux: make(map[string]bool),
+	}
+}
+
+func (mr *mergeRecords) add(rdb *Rdb, fp io.ReaderAt, rdbFile string) error {
+	for _, rec := range rdb.records {
+		raw, err := rec.RawValue(fp)
+		if err != nil {
+			return err
+		}
+		item := &mergeRecord{rec.opcode, raw, rdbFile}
+		r := NewRdb(bytes.NewReader(raw))
+		r.version = rdb.version
+
+		switch rec.opcode {
+		case RDB_OPCODE_AUX:
+			auxKey, err := r.LoadStringObject()
+			if err != nil {
+				return err
+			}
+			if auxKey != "lua" {
+				mr.droppedAux[auxKey] = true
+			} else if !mr.seen[string(raw)] {
+				mr.seen[string(raw)] = true
+				mr.scripts = append(mr.scripts, item)
+			}
+		case RDB_OPCODE_FUNCTION2, RDB_OPCODE_FUNCTION_PRE_GA:
+			name, err := functionName(r, rec.opcode)
+			if err != nil {
+				return fmt.Errorf("%s: %s", rdbFile, err)
+			}
+			prev, ok := mr.functions[name]
+			if !ok {
+				mr.functions[name] = item
+				mr.libraries = append(mr.libraries, name)
+				continue
+			}
+			if bytes.Equal(prev.raw, raw) {
+				continue
+			}
+
+			switch mr.policy {
+			case MERGE_LAST:
+				fmt.Printf("Function library %s in %s replaces the one in %s\n", name, rdbFile, prev.file)
+				mr.functions[name] = item
+			case MERGE_ERROR:
+				return fmt.Errorf("function library %s in %s differs from the one in %s", name, rdbFile, prev.file)
+			default:
+				fmt.Printf("Dropped function library %s in %s, it differs from the one in %s\n", name, rdbFile, prev.file)
+			}
+		case RDB_OPCODE_MODULE_AUX:
+			moduleId, err := r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+			prev, ok := mr.moduleAux[moduleId]
+			if !ok {
+				mr.moduleAux[moduleId] = item
+				mr.modules = append(mr.modules, moduleId)
+			} else if !bytes.Equal(prev.raw, raw) {
+				fmt.Printf("Dropped aux data of module %s in %s, kept the one in %s\n", moduleTypeName(uint64(moduleId)), rdbFile, prev.file)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+* 写入 key 之前或之后的记录，模块辅助数据按原来的保存时机写入
+ */
+func (mr *mergeRecords) write(rw *RdbWriter, afterKeys bool) error {
+	var records []*mergeRecord
+	if !afterKeys {
+		records = append(records, mr.scripts...)
+	}
+	for _, moduleId := range mr.modules {
+		item := mr.moduleAux[moduleId]
+		r := NewRdb(bytes.NewReader(item.raw))
+		when := 0
+		for i := 0; i < 3; i++ {
+			val, err := r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+			when = val
+		}
+		if (when == RDB_MODULE_AUX_AFTER_RDB) == afterKeys {
+			records = append(records, item)
+		}
+	}
+	if !afterKeys {
+		for _, name := range mr.libraries {
+			records = append(records, mr.functions[name])
+		}
+	}
+
+	for _, item := range records {
+		err := rw.WriteRawRecord(item.opcode, item.raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (mr *mergeRecords) printDropped() {
+	if len(mr.droppedAux) == 0 {
+		return
+	}
+
+	auxKeys := make([]string, 0, len(mr.droppedAux))
+	for auxKey := range mr.droppedAux {
+		auxKeys = append(auxKeys, auxKey)
+	}
+	sort.Strings(auxKeys)
+	fmt.Printf("Dropped aux fields describing the input instances: %s\n", strings.Join(auxKeys, ", "))
+}
+
+/*
+* 函数库的名称，正式版之前的格式第一个字段就是名称，之后的格式在代码第一行，例如 #!lua name=mylib
+ */
+func functionName(r *Rdb, opcode byte) (string, error) {
+	if opcode == RDB_OPCODE_FUNCTION_PRE_GA {
+		return r.LoadStringObject()
+	}
+
+	code, err := r.LoadStringObject()
+	if err != nil {
+		return "", err
+	}
+	firstLine := strings.SplitN(code, "\n", 2)[0]
+	if strings.HasPrefix(firstLine, "#!") {
+		for _, field := range strings.Fields(firstLine)[1:] {
+			if strings.HasPrefix(field, "name=") {
+				return field[len("name="):], nil
+			}
+		}
+	}
+
+	return "", errors.New("function library without a name")
+}
+
+/*
+* 从模块类型ID中解出名称，低 10 位是编码版本
+ */
+func moduleTypeName(moduleId uint64) string {
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = MODULE_TYPE_NAME_CHARSET[(moduleId>>(10+uint(8-i)*6))&63]
+	}
+
+	return string(name)
+}
+
+/*
+* db 映射，"0:1,2:1" 表示 db0、db2 都写入 db1，"*:0" 表示其余所有db写入 db0
+ */
+type dbMap struct {
+	mapping  map[int]int
+	fallback int
+}
+
+func parseDbMap(str string) (*dbMap, error) {
+	dm := &dbMap{make(map[int]int), -1}
+	if str == "" {
+		return dm, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid db mapping: %s", pair)
+		}
+
+		dst, err := strconv.Atoi(parts[1])
+		if err != nil || dst < 0 {
+			return nil, fmt.Errorf("invalid db mapping: %s", pair)
+		}
+
+		if parts[0] == "*" {
+			dm.fallback = dst
+			continue
+		}
+
+		src, err := strconv.Atoi(parts[0])
+		if err != nil || src < 0 {
+			return nil, fmt.Errorf("invalid db mapping: %s", pair)
+		}
+		dm.mapping[src] = dst
+	}
+
+	return dm, nil
+}
+
+func (dm *dbMap) target(dbId int) int {
+	if dst, ok := dm.mapping[dbId]; ok {
+		return dst
+	}
+	if dm.fallback >= 0 {
+		return dm.fallback
+	}
+
+	return dbId
+}
+
+/*
+* 合并多个rdb文件
+ */
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := fs.String("o", "", "output rdb file")
+	policy := fs.String("policy", MERGE_ERROR, "duplicate key policy: first, last, error or rename")
+	suffix := fs.String("suffix", ":dup", "suffix appended to renamed keys, followed by the input number")
+	dbMapStr := fs.String("db-map", "", "db remapping, eg: 0:1,*:0")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" || len(files) == 0 {
+		return errors.New("usage: decode " + mergeUsage)
+	}
+	switch *policy {
+	case MERGE_FIRST, MERGE_LAST, MERGE_ERROR, MERGE_RENAME:
+	default:
+		return fmt.Errorf("unknown policy: %s", *policy)
+	}
+
+	dm, err := parseDbMap(*dbMapStr)
+	if err != nil {
+		return err
+	}
+
+	dbs := make(map[int]*mergeDb)
+	records := newMergeRecords(*policy)
+	version := 0
+	for i, rdbFile := range files {
+		rdb, file, err := openRdbFile(rdbFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		inputNo := i + 1
+		rdb.visitor = func(entry *KeyEntry) error {
+			// 只需要原始数据的位置，不保留解析出的对象
+			delete(rdb.mapObj, entry.key)
+			entry.obj = nil
+
+			dbId := dm.target(entry.dbId)
+			db, ok := dbs[dbId]
+			if !ok {
+				db = &mergeDb{items: make(map[string]*mergeItem)}
+				dbs[dbId] = db
+			}
+
+			key := entry.key
+			item := &mergeItem{file, entry}
+			if prev, ok := db.items[key]; ok {
+				switch *policy {
+				case MERGE_FIRST:
+					return nil
+				case MERGE_LAST:
+					if prev.entry.expireTime >= 0 {
+						db.expires--
+					}
+				case MERGE_ERROR:
+					return fmt.Errorf("duplicate key %s in db %d, found in %s", key, dbId, rdbFile)
+				case MERGE_RENAME:
+					key = fmt.Sprintf("%s%s%d", entry.key, *suffix, inputNo)
+					for n := 2; ; n++ {
+						if _, ok := db.items[key]; !ok {
+							break
+						}
+						key = fmt.Sprintf("%s%s%d_%d", entry.key, *suffix, inputNo, n)
+					}
+					db.keys = append(db.keys, key)
+				}
+			} else {
+				db.keys = append(db.keys, key)
+			}
+
+			if entry.expireTime >= 0 {
+				db.expires++
+			}
+			db.items[key] = item
+
+			return nil
+		}
+
+		err = rdb.DecodeRDBFile()
+		if err != nil {
+			return err
+		}
+		err = records.add(rdb, file, rdbFile)
+		if err != nil {
+			return err
+		}
+		if rdb.version > version {
+			version = rdb.version
+		}
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	dbIds := make([]int, 0, len(dbs))
+	for dbId := range dbs {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+
+	rw := NewRdbWriter(out, version)
+	rw.WriteHeader()
+	err = records.write(rw, false)
+	if err != nil {
+		return err
+	}
+	for _, dbId := range dbIds {
+		db := dbs[dbId]
+		rw.WriteSelectDb(dbId)
+		if version >= 7 {
+			rw.WriteResizeDb(len(db.keys), db.expires)
+		}
+
+		for _, key := range db.keys {
+			item := db.items[key]
+			rawVal, err := item.entry.RawValue(item.fp)
+			if err != nil {
+				return err
+			}
+
+			err = rw.WriteRawKey(key, item.entry.valType, rawVal, item.entry.expireTime)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = records.write(rw, true)
+	if err != nil {
+		return err
+	}
+	err = rw.Close()
+	if err != nil {
+		return err
+	}
+
+	records.printDropped()
+	fmt.Printf("Merged %d files into %s\n", len(files), *output)
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+* 编码一条记录的原始数据
+ */
+func encodeRecord(write func(rw *RdbWriter)) []byte {
+	var buf bytes.Buffer
+	rw := NewRdbWriter(&buf, 10)
+	write(rw)
+	rw.Flush()
+
+	return buf.Bytes()
+}
+
+func functionRecord(code string) []byte {
+	return encodeRecord(func(rw *RdbWriter) { rw.WriteString(code) })
+}
+
+/*
+* 模块辅助数据：模块ID、保存时机和一个字符串
+ */
+func moduleAuxRecord(moduleId uint64, when uint64, val string) []byte {
+	return encodeRecord(func(rw *RdbWriter) {
+		rw.WriteLen(moduleId)
+		rw.WriteLen(RDB_MODULE_OPCODE_UINT)
+		rw.WriteLen(when)
+		rw.WriteLen(RDB_MODULE_OPCODE_STRING)
+		rw.WriteString(val)
+		rw.WriteLen(RDB_MODULE_OPCODE_EOF)
+	})
+}
+
+func writeMergeInput(t *testing.T, name string, key string, records []*mergeRecord) string {
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rw := NewRdbWriter(file, 10)
+	rw.WriteHeader()
+	rw.WriteAux("redis-ver", "7.0.0")
+	for _, rec := range records {
+		rw.WriteRawRecord(rec.opcode, rec.raw)
+	}
+	rw.WriteSelectDb(0)
+	rw.WriteObject(key, NewRedisObject(RDB_TYPE_STRING, 1, "value"))
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMergeRecords(t *testing.T) {
+	// 模块名称 "mymodule-"，编码版本 1
+	var moduleId uint64
+	for _, c := range []byte("mymodule-") {
+		moduleId = moduleId<<6 | uint64(bytes.IndexByte([]byte(MODULE_TYPE_NAME_CHARSET), c))
+	}
+	moduleId = moduleId<<10 | 1
+	if name := moduleTypeName(moduleId); name != "mymodule-" {
+		t.Fatalf("unexpected module name %s", name)
+	}
+
+	lua := encodeRecord(func(rw *RdbWriter) { rw.WriteString("lua"); rw.WriteString("return 1") })
+	lib1 := functionRecord("#!lua name=lib1\nredis.register_function('f1', function() return 1 end)")
+	lib2 := functionRecord("#!lua name=lib2\nredis.register_function('f2', function() return 2 end)")
+	lib2Changed := functionRecord("#!lua name=lib2\nredis.register_function('f2', function() return 3 end)")
+	auxBefore := moduleAuxRecord(moduleId, 1, "first")
+	auxOther := moduleAuxRecord(moduleId, 1, "second")
+
+	a := writeMergeInput(t, "a.rdb", "a", []*mergeRecord{
+		{RDB_OPCODE_AUX, lua, ""}, {RDB_OPCODE_MODULE_AUX, auxBefore, ""},
+		{RDB_OPCODE_FUNCTION2, lib1, ""}, {RDB_OPCODE_FUNCTION2, lib2, ""},
+	})
+	b := writeMergeInput(t, "b.rdb", "b", []*mergeRecord{
+		{RDB_OPCODE_AUX, lua, ""}, {RDB_OPCODE_MODULE_AUX, auxOther, ""},
+		{RDB_OPCODE_FUNCTION2, lib1, ""}, {RDB_OPCODE_FUNCTION2, lib2Changed, ""},
+	})
+
+	cases := []struct {
+		policy string
+		lib2   []byte
+	}{
+		{MERGE_FIRST, lib2},
+		{MERGE_LAST, lib2Changed},
+	}
+	for _, c := range cases {
+		output := filepath.Join(t.TempDir(), "merged.rdb")
+		err := runMerge([]string{a, b, "-o", output, "-policy", c.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rdb, file, err := openRdbFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := rdb.DecodeRDBFile(); err != nil {
+			t.Fatal(err)
+		}
+		if len(rdb.mapObj) != 2 || rdb.meta.Aux["redis-ver"] != "" {
+			t.Errorf("%s: unexpected keys %v or aux %v", c.policy, rdb.mapObj, rdb.meta.Aux)
+		}
+
+		var opcodes []byte
+		var raws [][]byte
+		for _, rec := range rdb.records {
+			raw, err := rec.RawValue(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opcodes = append(opcodes, rec.opcode)
+			raws = append(raws, raw)
+		}
+		expected := []byte{RDB_OPCODE_AUX, RDB_OPCODE_MODULE_AUX, RDB_OPCODE_FUNCTION2, RDB_OPCODE_FUNCTION2}
+		if !reflect.DeepEqual(opcodes, expected) {
+			t.Fatalf("%s: unexpected records %v", c.policy, opcodes)
+		}
+		if !bytes.Equal(raws[1], auxBefore) || !bytes.Equal(raws[2], lib1) || !bytes.Equal(raws[3], c.lib2) {
+			t.Errorf("%s: unexpected records content", c.policy)
+		}
+	}
+
+	err := runMerge([]string{a, b, "-o", filepath.Join(t.TempDir(), "merged.rdb"), "-policy", MERGE_ERROR})
+	if err == nil {
+		t.Errorf("expected an error for conflicting function libraries")
+	}
+}
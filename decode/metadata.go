@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const infoUsage = "info file [-json]"
+
+/*
+* 单个 db 的统计信息，resize 字段来自 RESIZEDB 操作码
+ */
+type DbInfo struct {
+	Keys          int64 `json:"keys"`
+	Expires       int64 `json:"expires"`
+	ResizeKeys    int   `json:"resizeKeys"`
+	ResizeExpires int   `json:"resizeExpires"`
+}
+
+/*
+* rdb 文件的元数据：辅助字段、校验和以及各 db 的统计
+ */
+type Metadata struct {
+	Version    int               `json:"version"`
+	Aux        map[string]string `json:"aux"`
+	RedisVer   string            `json:"redisVer"`
+	RedisBits  int               `json:"redisBits"`
+	Ctime      int64             `json:"ctime"`
+	UsedMem    int64             `json:"usedMem"`
+	AofBase    bool              `json:"aofBase"`
+	ReplId     string            `json:"replId"`
+	ReplOffset int64             `json:"replOffset"`
+	Dbs        map[int]*DbInfo   `json:"dbs"`
+	Checksum   string            `json:"checksum"`
+	ChecksumOk bool              `json:"checksumOk"`
+	FileSize   int64             `json:"fileSize"`
+	ParseMs    int64             `json:"parseMs"`
+	Keys       int64             `json:"keys"`
+	Expires    int64             `json:"expires"`
+	Types      map[string]int64  `json:"types"`
+	Encodings  map[string]int64  `json:"encodings"`
+	// quicklist 节点总数，配合 list 的 key 数量估算平均每个节点的元素个数
+	QuicklistNodes int64 `json:"quicklistNodes"`
+	// 没有解析 value 的 key（stream、模块类型、带字段过期时间的 hash），不计入 Keys
+	Skipped   int64 `json:"skipped"`
+	Functions int64 `json:"functions"`
+}
+
+func NewMetadata() *Metadata {
+	return &Metadata{
+		Aux:       make(map[string]string),
+		Dbs:       make(map[int]*DbInfo),
+		Types:     make(map[string]int64),
+		Encodings: make(map[string]int64),
+	}
+}
+
+func (m *Metadata) db(dbId int) *DbInfo {
+	db, ok := m.Dbs[dbId]
+	if !ok {
+		db = &DbInfo{}
+		m.Dbs[dbId] = db
+	}
+
+	return db
+}
+
+/*
+* 记录辅助字段，常见字段单独解析出来
+ */
+func (m *Metadata) setAux(key, val string) {
+	m.Aux[key] = val
+
+	switch key {
+	case "redis-ver":
+		m.RedisVer = val
+	case "redis-bits":
+		m.RedisBits, _ = strconv.Atoi(val)
+	case "ctime":
+		m.Ctime, _ = strconv.ParseInt(val, 10, 64)
+	case "used-mem":
+		m.UsedMem, _ = strconv.ParseInt(val, 10, 64)
+	case "aof-base", "aof-preamble":
+		m.AofBase = val == "1"
+	case "repl-id":
+		m.ReplId = val
+	case "repl-offset":
+		m.ReplOffset, _ = strconv.ParseInt(val, 10, 64)
+	}
+}
+
+/*
+* 统计一个 key
+ */
+func (m *Metadata) addKey(dbId int, obj *RedisObject) {
+	db := m.db(dbId)
+	db.Keys++
+	m.Keys++
+	if obj.expireTime >= 0 {
+		db.Expires++
+		m.Expires++
+	}
+
+	typeName := typeMap[obj.objType]
+	m.Types[typeName]++
+	m.Encodings[typeName+"/"+obj.encoding()]++
+	if obj.nodes > 0 {
+		m.QuicklistNodes += obj.nodes
+	}
+}
+
+/*
+* 以文本形式输出元数据
+ */
+func (m *Metadata) Print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "rdb version:\t%d\n", m.Version)
+	if m.RedisVer != "" {
+		fmt.Fprintf(w, "redis version:\t%s\n", m.RedisVer)
+	}
+	if m.RedisBits > 0 {
+		fmt.Fprintf(w, "redis bits:\t%d\n", m.RedisBits)
+	}
+	if m.Ctime > 0 {
+		fmt.Fprintf(w, "created:\t%s\n", time.Unix(m.Ctime, 0).Format("2006-01-02 15:04:05"))
+	}
+	if m.UsedMem > 0 {
+		fmt.Fprintf(w, "used memory:\t%d\n", m.UsedMem)
+	}
+	if m.ReplId != "" {
+		fmt.Fprintf(w, "replication:\t%s offset %d\n", m.ReplId, m.ReplOffset)
+	}
+	fmt.Fprintf(w, "aof base:\t%t\n", m.AofBase)
+	if m.Checksum != "" {
+		status := "ok"
+		if !m.ChecksumOk {
+			status = "MISMATCH"
+		}
+		fmt.Fprintf(w, "checksum:\t%s (%s)\n", m.Checksum, status)
+	}
+	fmt.Fprintf(w, "file size:\t%d\n", m.FileSize)
+	fmt.Fprintf(w, "parse time:\t%dms\n", m.ParseMs)
+	fmt.Fprintf(w, "keys:\t%d (expires %d)\n", m.Keys, m.Expires)
+	if m.QuicklistNodes > 0 {
+		fmt.Fprintf(w, "quicklist nodes:\t%d\n", m.QuicklistNodes)
+	}
+	if m.Skipped > 0 {
+		fmt.Fprintf(w, "skipped keys:\t%d (stream, module and field expiring hash values are not parsed)\n", m.Skipped)
+	}
+	if m.Functions > 0 {
+		fmt.Fprintf(w, "functions:\t%d\n", m.Functions)
+	}
+	w.Flush()
+
+	var auxKeys []string
+	for k := range m.Aux {
+		auxKeys = append(auxKeys, k)
+	}
+	sort.Strings(auxKeys)
+	if len(auxKeys) > 0 {
+		fmt.Println("\naux fields:")
+		for _, k := range auxKeys {
+			fmt.Fprintf(w, "  %s\t%s\n", k, m.Aux[k])
+		}
+		w.Flush()
+	}
+
+	var dbIds []int
+	for dbId := range m.Dbs {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+	fmt.Println("\ndatabases:")
+	fmt.Fprintln(w, "  db\tkeys\texpires\tresize keys\tresize expires")
+	for _, dbId := range dbIds {
+		db := m.Dbs[dbId]
+		fmt.Fprintf(w, "  %d\t%d\t%d\t%d\t%d\n", dbId, db.Keys, db.Expires, db.ResizeKeys, db.ResizeExpires)
+	}
+	w.Flush()
+
+	var encodings []string
+	for k := range m.Encodings {
+		encodings = append(encodings, k)
+	}
+	sort.Strings(encodings)
+	fmt.Println("\nencodings:")
+	for _, k := range encodings {
+		fmt.Fprintf(w, "  %s\t%d\n", k, m.Encodings[k])
+	}
+	w.Flush()
+}
+
+/*
+* 输出 rdb / aof 文件的元数据
+ */
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJson := fs.Bool("json", false, "output as json")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("usage: decode %s", infoUsage)
+	}
+
+	var rdb *Rdb
+	if isAofPath(files[0]) {
+		aof := NewAof()
+		err = aof.LoadPath(files[0])
+		if err != nil {
+			return err
+		}
+		rdb = aof.ToRdb()
+	} else {
+		var file *os.File
+		rdb, file, err = openRdbFile(files[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		err = rdb.DecodeRDBFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if *asJson {
+		out, err := json.MarshalIndent(rdb.meta, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	rdb.meta.Print()
+	return nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+/* 每个解析协程最多积压的任务数，限制有序输出时缓存的结果 */
+const PARALLEL_BACKLOG = 64
+
+/*
+* 并行解析的任务：value 在文件中的位置，由解析协程读取并解析
+ */
+type decodeJob struct {
+	seq   int64
+	entry *KeyEntry
+	err   error
+}
+
+/*
+* 并行解析：扫描协程只跳过 value 找出每个key的边界，
+* 解压 lzf、遍历 ziplist 等工作交给多个解析协程完成
+* 结果始终在扫描协程中交给 visitor，ordered 时按文件中的顺序交付
+ */
+type parallelDecoder struct {
+	workers int
+	ordered bool
+	jobs    chan *decodeJob
+	results chan *decodeJob
+	nextSeq int64
+	doneSeq int64
+	pending map[int64]*decodeJob
+	// 已提交但还没有交给 visitor 的任务数，不超过 jobs 的容量，pending 中缓存的结果也受此限制
+	inflight int
+}
+
+/*
+* 开启并行解析，workers 小于2时按顺序解析
+ */
+func (rdb *Rdb) SetWorkers(workers int, ordered bool) {
+	if workers < 2 {
+		rdb.parallel = nil
+		return
+	}
+
+	rdb.parallel = &parallelDecoder{workers: workers, ordered: ordered}
+}
+
+/*
+* 跳过一个字符串，不解压
+ */
+func (r *Rdb) skipString() error {
+	isEncoded := false
+	length, err := r.LoadLen(&isEncoded)
+	if err != nil {
+		return err
+	}
+
+	if isEncoded {
+		switch length {
+		case RDB_ENC_INT8:
+			length = 1
+		case RDB_ENC_INT16:
+			length = 2
+		case RDB_ENC_INT32:
+			length = 4
+		case RDB_ENC_LZF:
+			length, err = r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+			// 解压后的长度
+			_, err = r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown RDB string encoding type: %d", length)
+		}
+	}
+
+	_, err = r.ReadBuf(int64(length))
+	return err
+}
+
+/*
+* 跳过字符串形式保存的浮点数
+ */
+func (r *Rdb) skipDouble() error {
+	lenBuf, err := r.ReadBuf(1)
+	if err != nil {
+		return err
+	}
+
+	// 253 ~ 255 表示 NaN 和正负无穷
+	if lenBuf[0] >= 253 {
+		return nil
+	}
+
+	_, err = r.ReadBuf(int64(lenBuf[0]))
+	return err
+}
+
+/*
+* 跳过一个 value，只读取长度信息
+ */
+func (r *Rdb) skipObject(objType byte) error {
+	// 每个元素包含的字符串个数
+	strings := 1
+	switch objType {
+	case RDB_TYPE_STRING, RDB_TYPE_HASH_ZIPMAP, RDB_TYPE_LIST_ZIPLIST, RDB_TYPE_SET_INTSET,
+		RDB_TYPE_ZSET_ZIPLIST, RDB_TYPE_HASH_ZIPLIST, RDB_TYPE_HASH_LISTPACK, RDB_TYPE_ZSET_LISTPACK, RDB_TYPE_SET_LISTPACK:
+		return r.skipString()
+	case RDB_TYPE_LIST, RDB_TYPE_SET, RDB_TYPE_LIST_QUICKLIST:
+	case RDB_TYPE_HASH:
+		strings = 2
+	case RDB_TYPE_ZSET, RDB_TYPE_ZSET_2, RDB_TYPE_LIST_QUICKLIST_2:
+	case RDB_TYPE_STREAM_LISTPACKS, RDB_TYPE_STREAM_LISTPACKS_2, RDB_TYPE_STREAM_LISTPACKS_3:
+		return r.skipStream(objType)
+	case RDB_TYPE_MODULE_2:
+		return r.skipModule()
+	case RDB_TYPE_HASH_METADATA_PRE_GA, RDB_TYPE_HASH_LISTPACK_EX_PRE_GA, RDB_TYPE_HASH_METADATA, RDB_TYPE_HASH_LISTPACK_EX:
+		return r.skipHashTtl(objType)
+	default:
+		return fmt.Errorf("unsupported object type %d", objType)
+	}
+
+	length, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < length; i++ {
+		// quicklist 2 的每个节点前有节点的存储方式
+		if objType == RDB_TYPE_LIST_QUICKLIST_2 {
+			_, err = r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		for j := 0; j < strings; j++ {
+			err = r.skipString()
+			if err != nil {
+				return err
+			}
+		}
+
+		switch objType {
+		case RDB_TYPE_ZSET:
+			err = r.skipDouble()
+		case RDB_TYPE_ZSET_2:
+			_, err = r.ReadBuf(8)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 跳过 n 个长度字段
+ */
+func (r *Rdb) skipLens(n int) error {
+	for i := 0; i < n; i++ {
+		_, err := r.LoadLen(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 跳过 stream，按版本依次读取 listpack、元数据、消费组及其 PEL 和消费者
+* 消息ID在 PEL 中以 16 字节的原始数据保存
+ */
+func (r *Rdb) skipStream(objType byte) error {
+	listpacks, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < listpacks*2 && err == nil; i++ {
+		// 节点的起始ID和 listpack
+		err = r.skipString()
+	}
+	if err != nil {
+		return err
+	}
+
+	// 消息数，之后是最后一个ID，版本2之后还有第一个ID、最大删除ID和写入总数
+	length, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+	r.streamLen = int64(length)
+	lens := 2
+	if objType != RDB_TYPE_STREAM_LISTPACKS {
+		lens += 5
+	}
+	err = r.skipLens(lens)
+	if err != nil {
+		return err
+	}
+
+	groups, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < groups; i++ {
+		err = r.skipString()
+		if err != nil {
+			return err
+		}
+		// 消费组的最后一个ID，版本2之后还有已读取的消息数
+		lens := 2
+		if objType != RDB_TYPE_STREAM_LISTPACKS {
+			lens++
+		}
+		err = r.skipLens(lens)
+		if err != nil {
+			return err
+		}
+
+		pending, err := r.LoadLen(nil)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < pending; j++ {
+			// 消息ID和投递时间，之后是投递次数
+			_, err = r.ReadBuf(16 + 8)
+			if err == nil {
+				_, err = r.LoadLen(nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		consumers, err := r.LoadLen(nil)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < consumers; j++ {
+			err = r.skipString()
+			if err != nil {
+				return err
+			}
+			// 最后一次出现的时间，版本3之后还有最后一次活跃的时间
+			times := 8
+			if objType == RDB_TYPE_STREAM_LISTPACKS_3 {
+				times += 8
+			}
+			_, err = r.ReadBuf(int64(times))
+			if err != nil {
+				return err
+			}
+
+			pending, err := r.LoadLen(nil)
+			if err != nil {
+				return err
+			}
+			_, err = r.ReadBuf(int64(pending) * 16)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+* 跳过模块序列化的数据，每个值前面有类型，直到 EOF
+ */
+func (r *Rdb) skipModuleValues() error {
+	for {
+		opcode, err := r.LoadLen(nil)
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case RDB_MODULE_OPCODE_EOF:
+			return nil
+		case RDB_MODULE_OPCODE_SINT, RDB_MODULE_OPCODE_UINT:
+			_, err = r.LoadLen(nil)
+		case RDB_MODULE_OPCODE_FLOAT:
+			_, err = r.ReadBuf(4)
+		case RDB_MODULE_OPCODE_DOUBLE:
+			_, err = r.ReadBuf(8)
+		case RDB_MODULE_OPCODE_STRING:
+			err = r.skipString()
+		default:
+			return fmt.Errorf("unknown module opcode %d", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+* 模块类型的 value：模块ID和序列化数据
+ */
+func (r *Rdb) skipModule() error {
+	_, err := r.LoadLen(nil)
+	if err != nil {
+		return err
+	}
+
+	return r.skipModuleValues()
+}
+
+/*
+* 解析协程：读取 value 的原始数据并解析
+ */
+func (p *parallelDecoder) work(fp io.ReaderAt, version int) {
+	for job := range p.jobs {
+		job.err = decodeEntry(fp, version, job.entry)
+		p.results <- job
+	}
+}
+
+/*
+* 解析一个 value，损坏的数据导致的异常转为错误，由扫描协程返回
+ */
+func decodeEntry(fp io.ReaderAt, version int, entry *KeyEntry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	rawVal, err := entry.RawValue(fp)
+	if err != nil {
+		return err
+	}
+
+	r := NewRdb(bytes.NewReader(rawVal))
+	r.version = version
+	err = r.LoadObject(entry.key, entry.valType)
+	entry.obj = r.mapObj[entry.key]
+
+	return err
+}
+
+func (p *parallelDecoder) start(rdb *Rdb) {
+	p.jobs = make(chan *decodeJob, p.workers*PARALLEL_BACKLOG)
+	p.results = make(chan *decodeJob, p.workers*PARALLEL_BACKLOG)
+	p.pending = make(map[int64]*decodeJob)
+	for i := 0; i < p.workers; i++ {
+		go p.work(rdb.fp, rdb.version)
+	}
+}
+
+/*
+* 提交一个key，等待期间交付已经完成的结果
+ */
+func (p *parallelDecoder) submit(rdb *Rdb, entry *KeyEntry) error {
+	job := &decodeJob{seq: p.nextSeq, entry: entry}
+	p.nextSeq++
+
+	for p.inflight >= cap(p.jobs) {
+		err := p.receive(rdb, <-p.results)
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case p.jobs <- job:
+			p.inflight++
+			return nil
+		case result := <-p.results:
+			err := p.receive(rdb, result)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+* 处理一个完成的任务，交付后才计为完成，有序输出时等待前面的任务完成前不会继续提交
+ */
+func (p *parallelDecoder) receive(rdb *Rdb, job *decodeJob) error {
+	if job.err != nil {
+		return fmt.Errorf("decode key %s: %s", job.entry.key, job.err)
+	}
+
+	if !p.ordered {
+		p.inflight--
+		return rdb.deliverKey(job.entry)
+	}
+
+	p.pending[job.seq] = job
+	for {
+		next, ok := p.pending[p.doneSeq]
+		if !ok {
+			break
+		}
+		delete(p.pending, p.doneSeq)
+		p.doneSeq++
+		p.inflight--
+		err := rdb.deliverKey(next.entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 结束解析协程，wait 为 true 时先等待所有任务完成
+* 不等待时结果 channel 的容量足够放下所有未完成的任务，解析协程不会阻塞
+ */
+func (p *parallelDecoder) finish(rdb *Rdb, wait bool) error {
+	defer close(p.jobs)
+
+	for wait && p.inflight > 0 {
+		err := p.receive(rdb, <-p.results)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* 并行解析的结果放回 mapObj
+ */
+func (rdb *Rdb) deliverKey(entry *KeyEntry) error {
+	if entry.obj != nil {
+		rdb.mapObj[entry.key] = entry.obj
+	} else {
+		delete(rdb.mapObj, entry.key)
+	}
+
+	return rdb.finishKey(entry)
+}
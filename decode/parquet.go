@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+)
+
+/* parquet 物理类型 */
+const PARQUET_INT64 = 2
+const PARQUET_DOUBLE = 5
+const PARQUET_BYTE_ARRAY = 6
+
+/* parquet 逻辑类型（converted type），-1 表示没有 */
+const PARQUET_NONE = -1
+const PARQUET_UTF8 = 0
+const PARQUET_TIMESTAMP_MILLIS = 9
+
+/* 列的重复类型 */
+const PARQUET_REQUIRED = 0
+const PARQUET_OPTIONAL = 1
+
+/* 编码方式，值使用 PLAIN，definition level 使用 RLE */
+const PARQUET_ENC_PLAIN = 0
+const PARQUET_ENC_RLE = 3
+
+const PARQUET_MAGIC = "PAR1"
+
+/* 每个 row group 默认的行数，以及缓存数据的上限 */
+const PARQUET_ROW_GROUP_ROWS = 100000
+const PARQUET_ROW_GROUP_BYTES = 64 * 1024 * 1024
+
+/* thrift compact 协议的字段类型 */
+const THRIFT_I32 = 5
+const THRIFT_I64 = 6
+const THRIFT_BINARY = 8
+const THRIFT_LIST = 9
+const THRIFT_STRUCT = 12
+
+/*
+* thrift compact 协议编码，parquet 的元数据和页头使用这种格式
+ */
+type thriftWriter struct {
+	buf    bytes.Buffer
+	lastId int16
+	stack  []int16
+}
+
+func (t *thriftWriter) varint(val uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], val)
+	t.buf.Write(buf[:n])
+}
+
+func (t *thriftWriter) zigzag(val int64) {
+	t.varint(uint64((val << 1) ^ (val >> 63)))
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	delta := id - t.lastId
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buf.WriteByte(fieldType)
+		t.zigzag(int64(id))
+	}
+	t.lastId = id
+}
+
+func (t *thriftWriter) i32Field(id int16, val int32) {
+	t.fieldHeader(id, THRIFT_I32)
+	t.zigzag(int64(val))
+}
+
+func (t *thriftWriter) i64Field(id int16, val int64) {
+	t.fieldHeader(id, THRIFT_I64)
+	t.zigzag(val)
+}
+
+func (t *thriftWriter) binary(val string) {
+	t.varint(uint64(len(val)))
+	t.buf.WriteString(val)
+}
+
+func (t *thriftWriter) binaryField(id int16, val string) {
+	t.fieldHeader(id, THRIFT_BINARY)
+	t.binary(val)
+}
+
+/*
+* 列表字段，之后依次写入 size 个元素
+ */
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, THRIFT_LIST)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+/*
+* 开始一个结构体，作为字段时先写字段头
+ */
+func (t *thriftWriter) structBegin() {
+	t.stack = append(t.stack, t.lastId)
+	t.lastId = 0
+}
+
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, THRIFT_STRUCT)
+	t.structBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf.WriteByte(0)
+	t.lastId = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+/*
+* 一列，缓存当前 row group 的数据
+* optional 列的 definition level 为1表示有值，空值不写入 values
+ */
+type ParquetColumn struct {
+	Name      string
+	Type      int
+	Converted int
+	Optional  bool
+
+	defs   []byte
+	values bytes.Buffer
+	count  int64
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+	count  int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []*parquetChunk
+}
+
+/*
+* 流式写入 parquet 文件，每列一个数据页，行数或缓存大小达到上限时写出一个 row group
+* 不压缩，不生成统计信息
+ */
+type ParquetWriter struct {
+	file      *os.File
+	w         *bufio.Writer
+	offset    int64
+	columns   []*ParquetColumn
+	groupRows int
+	rows      int
+	buffered  int
+	totalRows int64
+	groups    []*parquetRowGroup
+}
+
+func NewParquetWriter(path string, columns []*ParquetColumn, groupRows int) (*ParquetWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pw := &ParquetWriter{file: file, w: bufio.NewWriter(file), columns: columns, groupRows: groupRows}
+	pw.write([]byte(PARQUET_MAGIC))
+
+	return pw, nil
+}
+
+func (pw *ParquetWriter) write(buf []byte) {
+	pw.w.Write(buf)
+	pw.offset += int64(len(buf))
+}
+
+/*
+* 写入一行，值的顺序和列一致，nil 表示空值
+* INT64 列的值为 int64，DOUBLE 列为 float64，BYTE_ARRAY 列为 string
+ */
+func (pw *ParquetWriter) WriteRow(values ...interface{}) error {
+	if len(values) != len(pw.columns) {
+		return errors.New("parquet: column count mismatch")
+	}
+
+	for i, col := range pw.columns {
+		col.count++
+		if values[i] == nil {
+			if !col.Optional {
+				return errors.New("parquet: null value in required column " + col.Name)
+			}
+			col.defs = append(col.defs, 0)
+			continue
+		}
+		if col.Optional {
+			col.defs = append(col.defs, 1)
+		}
+
+		before := col.values.Len()
+		switch val := values[i].(type) {
+		case int64:
+			binary.Write(&col.values, binary.LittleEndian, val)
+		case float64:
+			binary.Write(&col.values, binary.LittleEndian, math.Float64bits(val))
+		case string:
+			binary.Write(&col.values, binary.LittleEndian, uint32(len(val)))
+			col.values.WriteString(val)
+		default:
+			return errors.New("parquet: unsupported value type in column " + col.Name)
+		}
+		pw.buffered += col.values.Len() - before
+	}
+
+	pw.rows++
+	if pw.rows >= pw.groupRows || pw.buffered >= PARQUET_ROW_GROUP_BYTES {
+		pw.flushRowGroup()
+	}
+
+	return nil
+}
+
+/*
+* definition level 的 RLE 编码，位宽为1，前面是4字节的长度
+ */
+func encodeDefLevels(defs []byte) []byte {
+	t := &thriftWriter{}
+	for i := 0; i < len(defs); {
+		j := i
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+		t.varint(uint64(j-i) << 1)
+		t.buf.WriteByte(defs[i])
+		i = j
+	}
+
+	buf := make([]byte, 4, 4+t.buf.Len())
+	binary.LittleEndian.PutUint32(buf, uint32(t.buf.Len()))
+	return append(buf, t.buf.Bytes()...)
+}
+
+func (pw *ParquetWriter) flushRowGroup() {
+	if pw.rows == 0 {
+		return
+	}
+
+	group := &parquetRowGroup{rows: int64(pw.rows)}
+	for _, col := range pw.columns {
+		var page []byte
+		if col.Optional {
+			page = encodeDefLevels(col.defs)
+		}
+		page = append(page, col.values.Bytes()...)
+
+		header := &thriftWriter{}
+		header.structBegin()
+		header.i32Field(1, 0)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(page)))
+		header.structField(5)
+		header.i32Field(1, int32(col.count))
+		header.i32Field(2, PARQUET_ENC_PLAIN)
+		header.i32Field(3, PARQUET_ENC_RLE)
+		header.i32Field(4, PARQUET_ENC_RLE)
+		header.structEnd()
+		header.structEnd()
+
+		chunk := &parquetChunk{offset: pw.offset, size: int64(header.buf.Len() + len(page)), count: col.count}
+		pw.write(header.buf.Bytes())
+		pw.write(page)
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+
+		col.defs = col.defs[:0]
+		col.values.Reset()
+		col.count = 0
+	}
+
+	pw.groups = append(pw.groups, group)
+	pw.totalRows += int64(pw.rows)
+	pw.rows = 0
+	pw.buffered = 0
+}
+
+/*
+* 文件尾部的元数据：schema 和每个 row group 中各列的位置
+ */
+func (pw *ParquetWriter) footer() []byte {
+	t := &thriftWriter{}
+	t.structBegin()
+	t.i32Field(1, 1)
+	t.listField(2, THRIFT_STRUCT, len(pw.columns)+1)
+	t.structBegin()
+	t.binaryField(4, "schema")
+	t.i32Field(5, int32(len(pw.columns)))
+	t.structEnd()
+	for _, col := range pw.columns {
+		t.structBegin()
+		t.i32Field(1, int32(col.Type))
+		if col.Optional {
+			t.i32Field(3, PARQUET_OPTIONAL)
+		} else {
+			t.i32Field(3, PARQUET_REQUIRED)
+		}
+		t.binaryField(4, col.Name)
+		if col.Converted != PARQUET_NONE {
+			t.i32Field(6, int32(col.Converted))
+		}
+		t.structEnd()
+	}
+	t.i64Field(3, pw.totalRows)
+	t.listField(4, THRIFT_STRUCT, len(pw.groups))
+	for _, group := range pw.groups {
+		t.structBegin()
+		t.listField(1, THRIFT_STRUCT, len(group.chunks))
+		for i, chunk := range group.chunks {
+			col := pw.columns[i]
+			t.structBegin()
+			t.i64Field(2, chunk.offset)
+			t.structField(3)
+			t.i32Field(1, int32(col.Type))
+			t.listField(2, THRIFT_I32, 2)
+			t.zigzag(PARQUET_ENC_PLAIN)
+			t.zigzag(PARQUET_ENC_RLE)
+			t.listField(3, THRIFT_BINARY, 1)
+			t.binary(col.Name)
+			t.i32Field(4, 0)
+			t.i64Field(5, chunk.count)
+			t.i64Field(6, chunk.size)
+			t.i64Field(7, chunk.size)
+			t.i64Field(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64Field(2, group.size)
+		t.i64Field(3, group.rows)
+		t.structEnd()
+	}
+	t.binaryField(6, "redis rdb decode")
+	t.structEnd()
+
+	return t.buf.Bytes()
+}
+
+/*
+* 写出剩余的数据和文件尾部，关闭文件
+ */
+func (pw *ParquetWriter) Close() error {
+	pw.flushRowGroup()
+	meta := pw.footer()
+	pw.write(meta)
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(meta)))
+	pw.write(length)
+	pw.write([]byte(PARQUET_MAGIC))
+
+	err := pw.w.Flush()
+	if err != nil {
+		pw.file.Close()
+		return err
+	}
+
+	return pw.file.Close()
+}
+
+/*
+* 写入的行数
+ */
+func (pw *ParquetWriter) Rows() int64 {
+	return pw.totalRows + int64(pw.rows)
+}
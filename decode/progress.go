@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PROGRESS_WIDTH = 30
+
+/*
+* 解析进度，在 stderr 上显示进度条
+ */
+type Progress struct {
+	total int64
+	bytes int64
+	keys  int64
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewProgress(total int64) *Progress {
+	return &Progress{total: total, start: time.Now(), done: make(chan struct{})}
+}
+
+/*
+* 更新已处理的字节数和key数量，可以在任意 goroutine 中调用
+ */
+func (p *Progress) Update(bytes int64, keys int64) {
+	atomic.StoreInt64(&p.bytes, bytes)
+	atomic.StoreInt64(&p.keys, keys)
+}
+
+func (p *Progress) Start(interval time.Duration) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.done:
+				p.print()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+}
+
+func (p *Progress) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+/*
+* 当前的字节数、key数量、完成比例和预计剩余时间，无法估算时剩余时间为-1
+ */
+func (p *Progress) state() (int64, int64, float64, time.Duration) {
+	bytes := atomic.LoadInt64(&p.bytes)
+	keys := atomic.LoadInt64(&p.keys)
+
+	percent := 0.0
+	if p.total > 0 {
+		percent = float64(bytes) / float64(p.total)
+	}
+	if percent > 1 {
+		percent = 1
+	}
+
+	eta := time.Duration(-1)
+	if p.total > 0 && bytes > 0 && percent < 1 {
+		eta = time.Duration(float64(time.Since(p.start)) * (float64(p.total-bytes) / float64(bytes)))
+	}
+
+	return bytes, keys, percent, eta
+}
+
+func (p *Progress) print() {
+	bytes, keys, percent, remaining := p.state()
+	elapsed := time.Since(p.start)
+
+	// 总大小未知时只显示已处理的字节数
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stderr, "\r%d bytes, %d keys, elapsed %s   ", bytes, keys, elapsed.Round(time.Second))
+		return
+	}
+
+	eta := "-"
+	if remaining >= 0 {
+		eta = remaining.Round(time.Second).String()
+	}
+
+	filled := int(percent * PROGRESS_WIDTH)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", PROGRESS_WIDTH-filled)
+	fmt.Fprintf(os.Stderr, "\r[%s] %5.1f%% %d keys, elapsed %s, eta %s   ", bar, percent*100, keys, elapsed.Round(time.Second), eta)
+}
+
+/*
+* 记录读取到的最大位置，作为解析进度
+ */
+type progressReaderAt struct {
+	fp     io.ReaderAt
+	offset int64
+}
+
+func (p *progressReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	n, err := p.fp.ReadAt(buf, off)
+	end := off + int64(n)
+	for {
+		cur := atomic.LoadInt64(&p.offset)
+		if end <= cur || atomic.CompareAndSwapInt64(&p.offset, cur, end) {
+			break
+		}
+	}
+
+	return n, err
+}
@@ -4,13 +4,73 @@ package main
  * store redis object
  * type int
  * val  interface
+ * expireTime 过期时间（毫秒时间戳），-1 表示不过期
+ * encType rdb 文件中的类型字节，用来区分 ziplist、intset 等紧凑编码
+ * nodes quicklist 的节点个数
+ * lruIdle 空闲时间(秒)，lfuFreq LFU 访问频率，rdb 中没有记录时为 -1
  */
 type RedisObject struct {
-	objType int
-	objLen  int64
-	objVal  interface{}
+	objType    int
+	objLen     int64
+	objVal     interface{}
+	expireTime int64
+	encType    int
+	nodes      int64
+	lruIdle    int64
+	lfuFreq    int
 }
 
 func NewRedisObject(objType int, objLen int64, objVal interface{}) *RedisObject {
-	return &RedisObject{objType, objLen, objVal}
+	return &RedisObject{objType, objLen, objVal, -1, objType, 0, -1, -1}
+}
+
+/*
+* rdb 类型字节对应的编码名称
+ */
+var encodingMap = map[int]string{
+	RDB_TYPE_STRING:           "string",
+	RDB_TYPE_LIST:             "linkedlist",
+	RDB_TYPE_SET:              "hashtable",
+	RDB_TYPE_ZSET:             "skiplist",
+	RDB_TYPE_HASH:             "hashtable",
+	RDB_TYPE_ZSET_2:           "skiplist",
+	RDB_TYPE_HASH_ZIPMAP:      "zipmap",
+	RDB_TYPE_LIST_ZIPLIST:     "ziplist",
+	RDB_TYPE_SET_INTSET:       "intset",
+	RDB_TYPE_ZSET_ZIPLIST:     "ziplist",
+	RDB_TYPE_HASH_ZIPLIST:     "ziplist",
+	RDB_TYPE_LIST_QUICKLIST:   "quicklist",
+	RDB_TYPE_HASH_LISTPACK:    "listpack",
+	RDB_TYPE_ZSET_LISTPACK:    "listpack",
+	RDB_TYPE_LIST_QUICKLIST_2: "quicklist",
+	RDB_TYPE_SET_LISTPACK:     "listpack",
+}
+
+/*
+* rdb 类型字节对应的对象类型，用来从索引中的类型得到类型名称
+ */
+var rdbObjType = map[int]int{
+	RDB_TYPE_STRING:           RDB_TYPE_STRING,
+	RDB_TYPE_LIST:             RDB_TYPE_LIST,
+	RDB_TYPE_SET:              RDB_TYPE_SET,
+	RDB_TYPE_ZSET:             RDB_TYPE_ZSET,
+	RDB_TYPE_HASH:             RDB_TYPE_HASH,
+	RDB_TYPE_ZSET_2:           RDB_TYPE_ZSET,
+	RDB_TYPE_HASH_ZIPMAP:      RDB_TYPE_HASH,
+	RDB_TYPE_LIST_ZIPLIST:     RDB_TYPE_LIST,
+	RDB_TYPE_SET_INTSET:       RDB_TYPE_SET,
+	RDB_TYPE_ZSET_ZIPLIST:     RDB_TYPE_ZSET,
+	RDB_TYPE_HASH_ZIPLIST:     RDB_TYPE_HASH,
+	RDB_TYPE_LIST_QUICKLIST:   RDB_TYPE_LIST,
+	RDB_TYPE_HASH_LISTPACK:    RDB_TYPE_HASH,
+	RDB_TYPE_ZSET_LISTPACK:    RDB_TYPE_ZSET,
+	RDB_TYPE_LIST_QUICKLIST_2: RDB_TYPE_LIST,
+	RDB_TYPE_SET_LISTPACK:     RDB_TYPE_SET,
+}
+
+/*
+* 对象在 rdb 文件中的编码名称
+ */
+func (o *RedisObject) encoding() string {
+	return encodingMap[o.encType]
 }
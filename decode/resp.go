@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* 和 redis 的 proto-max-bulk-len 一样，批量字符串最大 512MB，数组最多 1M 个元素 */
+const RESP_MAX_BULK_LEN = 512 * 1024 * 1024
+const RESP_MAX_ARRAY_LEN = 1024 * 1024
+
+/* 服务端只处理只读命令，命令的参数个数和长度用小得多的上限 */
+const RESP_MAX_ARGS = 4096
+const RESP_MAX_ARG_LEN = 64 * 1024
+
+/* 开启密码认证后，认证之前只接受很短的命令，和 redis 对未认证连接的限制一样 */
+const RESP_MAX_UNAUTHED_ARGS = 10
+const RESP_MAX_UNAUTHED_ARG_LEN = 16 * 1024
+
+/*
+* redis 返回的错误
+ */
+type RespError string
+
+func (e RespError) Error() string {
+	return string(e)
+}
+
+/*
+* RESP 协议连接
+ */
+type RespConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func NewRespConn(conn net.Conn) *RespConn {
+	return &RespConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+}
+
+func DialResp(addr string, timeout time.Duration) (*RespConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRespConn(conn), nil
+}
+
+func (c *RespConn) Close() error {
+	return c.conn.Close()
+}
+
+/*
+* 写入一条命令，需要调用 Flush 才会发送
+ */
+func (c *RespConn) WriteCommand(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.WriteString(arg)
+		_, err := c.w.WriteString("\r\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *RespConn) Flush() error {
+	return c.w.Flush()
+}
+
+func (c *RespConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return trimRespLine(line)
+}
+
+/*
+* 读取一行，超过 max 个字节时返回错误，不等对端发完整行
+ */
+func (c *RespConn) readLineLimit(max int) (string, error) {
+	var line []byte
+	for {
+		part, err := c.r.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > max+2 {
+			return "", fmt.Errorf("RESP line exceeds the limit %d", max)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return trimRespLine(string(line))
+	}
+}
+
+func trimRespLine(line string) (string, error) {
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("invalid RESP line: %q", line)
+	}
+
+	return line[:len(line)-2], nil
+}
+
+/*
+* 解析批量字符串和数组的长度，超过上限时返回错误，避免按对端给出的长度分配过大的内存
+ */
+func parseRespLen(line string, max int) (int, error) {
+	length, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid RESP length: %q", line)
+	}
+	if length > max {
+		return 0, fmt.Errorf("RESP length %d exceeds the limit %d", length, max)
+	}
+
+	return length, nil
+}
+
+func (c *RespConn) readBulkBody(length int) (string, error) {
+	buf := make([]byte, length+2)
+	_, err := io.ReadFull(c.r, buf)
+	if err != nil {
+		return "", err
+	}
+	if buf[length] != '\r' || buf[length+1] != '\n' {
+		return "", errors.New("invalid RESP bulk string")
+	}
+
+	return string(buf[:length]), nil
+}
+
+/*
+* 读取一个回复
+* 简单字符串和批量字符串返回 string，空批量字符串返回 nil，
+* 整数返回 int64，数组返回 []interface{}，错误返回 RespError
+ */
+func (c *RespConn) ReadReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty RESP line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RespError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := parseRespLen(line, RESP_MAX_BULK_LEN)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+
+		return c.readBulkBody(length)
+	case '*':
+		length, err := parseRespLen(line, RESP_MAX_ARRAY_LEN)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, length)
+		for i := range items {
+			items[i], err = c.ReadReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("unknown RESP type: %q", line)
+}
+
+/*
+* 发送一条命令并等待回复，redis 返回的错误也作为 error 返回
+ */
+func (c *RespConn) Do(args ...string) (interface{}, error) {
+	err := c.WriteCommand(args...)
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.ReadReply()
+	if err != nil {
+		return nil, err
+	}
+	if respErr, ok := reply.(RespError); ok {
+		return nil, respErr
+	}
+
+	return reply, nil
+}
+
+/*
+* 服务端读取一条命令，支持 RESP 数组和 telnet 风格的内联命令
+* maxArgs 和 maxArgLen 限制参数个数和每个参数的长度，内联命令整行的长度不超过 maxArgLen
+ */
+func (c *RespConn) ReadCommand(maxArgs int, maxArgLen int) ([]string, error) {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := c.readLineLimit(maxArgLen)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	line, err := c.readLineLimit(maxArgLen)
+	if err != nil {
+		return nil, err
+	}
+	length, err := parseRespLen(line, maxArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 命令只能是批量字符串组成的数组，不接受嵌套的数组
+	var args []string
+	for i := 0; i < length; i++ {
+		line, err := c.readLineLimit(maxArgLen)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("invalid RESP command argument")
+		}
+		argLen, err := parseRespLen(line, maxArgLen)
+		if err != nil {
+			return nil, err
+		}
+		if argLen < 0 {
+			return nil, errors.New("invalid RESP command argument")
+		}
+		arg, err := c.readBulkBody(argLen)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	return args, nil
+}
+
+func (c *RespConn) WriteStatus(status string) {
+	c.w.WriteString("+" + status + "\r\n")
+}
+
+func (c *RespConn) WriteError(msg string) {
+	c.w.WriteString("-" + msg + "\r\n")
+}
+
+func (c *RespConn) WriteInteger(val int64) {
+	c.w.WriteString(":" + strconv.FormatInt(val, 10) + "\r\n")
+}
+
+func (c *RespConn) WriteBulk(val string) {
+	c.w.WriteString("$" + strconv.Itoa(len(val)) + "\r\n")
+	c.w.WriteString(val)
+	c.w.WriteString("\r\n")
+}
+
+func (c *RespConn) WriteNil() {
+	c.w.WriteString("$-1\r\n")
+}
+
+/*
+* 数组的长度，之后依次写入元素
+ */
+func (c *RespConn) WriteArray(length int) {
+	c.w.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+func (c *RespConn) WriteBulks(vals []string) {
+	c.WriteArray(len(vals))
+	for _, val := range vals {
+		c.WriteBulk(val)
+	}
+}
@@ -0,0 +1,1190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const serveUsage = "serve file [-resp 127.0.0.1:6380] [-requirepass password]"
+
+/* SCAN 系列命令默认每次检查的元素个数 */
+const RESP_SCAN_COUNT = 10
+
+const RESP_WRONGTYPE = "WRONGTYPE Operation against a key holding the wrong kind of value"
+const RESP_SYNTAX = "ERR syntax error"
+const RESP_NOT_INTEGER = "ERR value is not an integer or out of range"
+
+/* 写命令返回只读错误，其他不支持的命令返回未知命令 */
+var respWriteCommands = []string{
+	"set", "setex", "psetex", "setnx", "mset", "append", "incr", "incrby", "decr", "decrby", "del", "unlink",
+	"expire", "pexpire", "expireat", "persist", "rename", "hset", "hmset", "hdel", "hincrby", "lpush", "rpush",
+	"lpop", "rpop", "lset", "lrem", "ltrim", "sadd", "srem", "spop", "zadd", "zrem", "zincrby", "flushdb", "flushall",
+}
+
+/*
+* 一个 db 中按名称排序的key，使用索引时 objs 为空，value 按需从 rdb 文件读取
+* unparsed 为没有解析 value 的 stream、模块类型和带字段过期时间的 hash，只能查询类型和过期时间
+ */
+type respDb struct {
+	keys     []string
+	objs     map[string]*RedisObject
+	unparsed map[string]*IndexEntry
+}
+
+/*
+* 只读的 redis 协议服务，可以用 redis-cli 等客户端浏览备份文件
+* now 为计算 TTL 的参考时间，使用 rdb 文件的生成时间，看到的是备份时的剩余时间
+ */
+type RespServer struct {
+	dbs      map[int]*respDb
+	index    *RdbIndex
+	meta     *Metadata
+	now      int64
+	password string
+}
+
+func (s *RespServer) db(dbId int) *respDb {
+	d, ok := s.dbs[dbId]
+	if !ok {
+		d = &respDb{objs: make(map[string]*RedisObject), unparsed: make(map[string]*IndexEntry)}
+		s.dbs[dbId] = d
+	}
+
+	return d
+}
+
+/*
+* 加载 aof 或者 rdb 文件，rdb 文件有索引时不需要解析整个文件
+ */
+func NewRespServer(path string) (*RespServer, error) {
+	s := &RespServer{dbs: make(map[int]*respDb)}
+	if isAofPath(path) {
+		aof := NewAof()
+		err := aof.LoadPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		s.meta = aof.ToRdb().meta
+		for dbId, objs := range aof.dbs {
+			s.dbs[dbId] = &respDb{keys: sortedObjKeys(objs), objs: objs}
+		}
+	} else if index, err := LoadIndex(path); index != nil {
+		fmt.Printf("Using index %s\n", indexPath(path))
+		s.index = index
+		s.meta = index.meta
+		for _, entry := range index.entries {
+			d := s.db(entry.Db)
+			d.keys = append(d.keys, entry.Key)
+		}
+		for _, entry := range index.unparsed {
+			s.db(entry.Db).unparsed[entry.Key] = entry
+		}
+	} else {
+		if err != nil {
+			fmt.Printf("Ignore index, errmsg: %s\n", err)
+		}
+
+		rdb, file, err := openRdbFile(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		rdb.visitor = func(entry *KeyEntry) error {
+			delete(rdb.mapObj, entry.key)
+			if entry.obj != nil {
+				s.db(entry.dbId).objs[entry.key] = entry.obj
+			} else {
+				s.db(entry.dbId).unparsed[entry.key] = newUnparsedEntry(entry)
+			}
+			return nil
+		}
+		err = rdb.DecodeRDBFile()
+		if err != nil {
+			return nil, err
+		}
+		s.meta = rdb.meta
+		for _, d := range s.dbs {
+			d.keys = sortedObjKeys(d.objs)
+		}
+	}
+
+	// 没有解析的key也出现在 SCAN 和 KEYS 的结果中
+	for _, d := range s.dbs {
+		if len(d.unparsed) == 0 {
+			continue
+		}
+		for key := range d.unparsed {
+			d.keys = append(d.keys, key)
+		}
+		sort.Strings(d.keys)
+	}
+
+	s.now = nowMs()
+	if s.meta.Ctime > 0 {
+		s.now = s.meta.Ctime * 1000
+	}
+
+	return s, nil
+}
+
+func (s *RespServer) lookup(dbId int, key string) (*RedisObject, bool) {
+	if s.index == nil {
+		d, ok := s.dbs[dbId]
+		if !ok {
+			return nil, false
+		}
+		obj, ok := d.objs[key]
+		return obj, ok
+	}
+
+	entry := s.index.Lookup(key, dbId)
+	if entry == nil {
+		return nil, false
+	}
+	obj, err := s.index.LoadObject(entry)
+	if err != nil {
+		fmt.Printf("load key %s failed, errmsg: %s\n", key, err)
+		return nil, false
+	}
+
+	return obj, true
+}
+
+/*
+* 没有解析 value 的key
+ */
+func (s *RespServer) unparsed(dbId int, key string) (*IndexEntry, bool) {
+	d, ok := s.dbs[dbId]
+	if !ok {
+		return nil, false
+	}
+	entry, ok := d.unparsed[key]
+
+	return entry, ok
+}
+
+/*
+* 没有解析的key的类型名称
+ */
+func unparsedTypeName(valType byte) string {
+	if isStreamType(valType) {
+		return "stream"
+	}
+	if isHashTtlType(valType) {
+		return "hash"
+	}
+
+	return "module"
+}
+
+/*
+* key 的类型名称，使用索引时直接读取索引中的类型，不需要解析 value
+ */
+func (s *RespServer) keyType(dbId int, key string) string {
+	if entry, ok := s.unparsed(dbId, key); ok {
+		return unparsedTypeName(entry.Type)
+	}
+	if s.index != nil {
+		entry := s.index.Lookup(key, dbId)
+		if entry == nil {
+			return ""
+		}
+		return typeMap[rdbObjType[int(entry.Type)]]
+	}
+
+	obj, ok := s.lookup(dbId, key)
+	if !ok {
+		return ""
+	}
+
+	return typeMap[obj.objType]
+}
+
+func (s *RespServer) Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("Serving RESP on %s (read only)\n", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *RespServer) handle(conn net.Conn) {
+	defer conn.Close()
+	// 解析异常的数据时出错只关闭当前连接
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("RESP connection %s closed, errmsg: %v\n", conn.RemoteAddr(), err)
+		}
+	}()
+
+	session := &respSession{server: s, conn: NewRespConn(conn)}
+	for {
+		maxArgs, maxArgLen := RESP_MAX_ARGS, RESP_MAX_ARG_LEN
+		if s.password != "" && !session.authed {
+			maxArgs, maxArgLen = RESP_MAX_UNAUTHED_ARGS, RESP_MAX_UNAUTHED_ARG_LEN
+		}
+		args, err := session.conn.ReadCommand(maxArgs, maxArgLen)
+		if err != nil {
+			if err != io.EOF {
+				session.conn.WriteError("ERR Protocol error: " + err.Error())
+				session.conn.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := session.execute(args)
+		// 管道中的命令全部处理完再发送
+		if quit || session.conn.r.Buffered() == 0 {
+			err = session.conn.Flush()
+			if err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+/*
+* 一个客户端连接，记录选择的 db 和最近访问的key
+ */
+type respSession struct {
+	server *RespServer
+	conn   *RespConn
+	db     int
+	authed bool
+
+	cacheDb       int
+	cacheKey      string
+	cacheObj      *RedisObject
+	cacheElements []*Element
+}
+
+func (s *respSession) object(key string) (*RedisObject, bool) {
+	if s.cacheObj != nil && s.cacheDb == s.db && s.cacheKey == key {
+		return s.cacheObj, true
+	}
+
+	obj, ok := s.server.lookup(s.db, key)
+	if ok {
+		s.cacheDb, s.cacheKey, s.cacheObj, s.cacheElements = s.db, key, obj, nil
+	}
+
+	return obj, ok
+}
+
+/*
+* 排好序的元素，用于范围查询和 SCAN 系列命令
+ */
+func (s *respSession) elements(key string, obj *RedisObject) []*Element {
+	if s.cacheObj != obj {
+		s.cacheDb, s.cacheKey, s.cacheObj = s.db, key, obj
+		s.cacheElements = nil
+	}
+	if s.cacheElements == nil {
+		s.cacheElements = sortedElements(obj)
+	}
+
+	return s.cacheElements
+}
+
+/*
+* 查找指定类型的key，类型不符时返回错误，不存在时返回 nil
+ */
+func (s *respSession) typedObject(key string, objType int) (*RedisObject, error) {
+	obj, ok := s.object(key)
+	if !ok {
+		if _, unparsed := s.server.unparsed(s.db, key); unparsed {
+			return nil, errors.New(RESP_WRONGTYPE)
+		}
+		return nil, nil
+	}
+	if obj.objType != objType && !(objType == RDB_TYPE_ZSET && obj.objType == RDB_TYPE_ZSET_2) {
+		return nil, errors.New(RESP_WRONGTYPE)
+	}
+
+	return obj, nil
+}
+
+type respCommand struct {
+	// 参数个数（包含命令名），负数表示至少
+	arity int
+	run   func(s *respSession, args []string) error
+}
+
+var respCommands = map[string]*respCommand{
+	"ping":             {-1, respPing},
+	"echo":             {2, respEcho},
+	"select":           {2, respSelect},
+	"dbsize":           {1, respDbsize},
+	"info":             {-1, respInfo},
+	"command":          {-1, respEmpty},
+	"client":           {-2, respOk},
+	"config":           {-2, respConfig},
+	"exists":           {-2, respExists},
+	"type":             {2, respType},
+	"ttl":              {2, respTtl},
+	"pttl":             {2, respTtl},
+	"object":           {-2, respObject},
+	"memory":           {-2, respMemory},
+	"scan":             {-2, respScan},
+	"keys":             {2, respKeys},
+	"get":              {2, respGet},
+	"mget":             {-2, respMget},
+	"strlen":           {2, respStrlen},
+	"hget":             {3, respHget},
+	"hmget":            {-3, respHmget},
+	"hgetall":          {2, respHgetall},
+	"hkeys":            {2, respHgetall},
+	"hvals":            {2, respHgetall},
+	"hlen":             {2, respLen},
+	"hexists":          {3, respHexists},
+	"hscan":            {-3, respElementScan},
+	"lrange":           {4, respLrange},
+	"lindex":           {3, respLindex},
+	"llen":             {2, respLen},
+	"smembers":         {2, respSmembers},
+	"sismember":        {3, respSismember},
+	"scard":            {2, respLen},
+	"sscan":            {-3, respElementScan},
+	"zrange":           {-4, respZrange},
+	"zrevrange":        {-4, respZrange},
+	"zrangebyscore":    {-4, respZrange},
+	"zrevrangebyscore": {-4, respZrange},
+	"zscore":           {3, respZscore},
+	"zcard":            {2, respLen},
+	"zscan":            {-3, respElementScan},
+}
+
+/*
+* 执行一条命令，返回是否需要关闭连接
+ */
+func (s *respSession) execute(args []string) bool {
+	name := strings.ToLower(args[0])
+	if name == "quit" {
+		s.conn.WriteStatus("OK")
+		return true
+	}
+
+	if name == "auth" {
+		s.auth(args)
+		return false
+	}
+	if s.server.password != "" && !s.authed {
+		s.conn.WriteError("NOAUTH Authentication required.")
+		return false
+	}
+
+	cmd, ok := respCommands[name]
+	if !ok {
+		for _, writeCmd := range respWriteCommands {
+			if name == writeCmd {
+				s.conn.WriteError("READONLY You can't write against a read only dump.")
+				return false
+			}
+		}
+		s.conn.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		s.conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+
+	err := cmd.run(s, args)
+	if err != nil {
+		s.conn.WriteError(err.Error())
+	}
+
+	return false
+}
+
+/*
+* AUTH [username] password，只有 default 用户
+ */
+func (s *respSession) auth(args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		s.conn.WriteError("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if s.server.password == "" {
+		s.conn.WriteError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+
+	password := args[len(args)-1]
+	if (len(args) == 3 && args[1] != "default") || !secureEqual(password, s.server.password) {
+		s.authed = false
+		s.conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	s.authed = true
+	s.conn.WriteStatus("OK")
+}
+
+func respPing(s *respSession, args []string) error {
+	if len(args) > 1 {
+		s.conn.WriteBulk(args[1])
+	} else {
+		s.conn.WriteStatus("PONG")
+	}
+	return nil
+}
+
+func respEcho(s *respSession, args []string) error {
+	s.conn.WriteBulk(args[1])
+	return nil
+}
+
+func respOk(s *respSession, args []string) error {
+	s.conn.WriteStatus("OK")
+	return nil
+}
+
+func respEmpty(s *respSession, args []string) error {
+	s.conn.WriteArray(0)
+	return nil
+}
+
+func respSelect(s *respSession, args []string) error {
+	db, err := strconv.Atoi(args[1])
+	if err != nil || db < 0 {
+		return errors.New("ERR DB index is out of range")
+	}
+
+	s.db = db
+	s.conn.WriteStatus("OK")
+	return nil
+}
+
+func respDbsize(s *respSession, args []string) error {
+	var size int64
+	if d, ok := s.server.dbs[s.db]; ok {
+		size = int64(len(d.keys))
+	}
+
+	s.conn.WriteInteger(size)
+	return nil
+}
+
+func respInfo(s *respSession, args []string) error {
+	meta := s.server.meta
+	var info strings.Builder
+	info.WriteString("# Server\r\n")
+	info.WriteString("redis_version:" + meta.RedisVer + "\r\n")
+	info.WriteString("redis_mode:standalone\r\n")
+	info.WriteString("rdb_version:" + strconv.Itoa(meta.Version) + "\r\n")
+	info.WriteString("\r\n# Keyspace\r\n")
+
+	dbIds := make([]int, 0, len(meta.Dbs))
+	for dbId := range meta.Dbs {
+		dbIds = append(dbIds, dbId)
+	}
+	sort.Ints(dbIds)
+	for _, dbId := range dbIds {
+		db := meta.Dbs[dbId]
+		info.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=0\r\n", dbId, db.Keys, db.Expires))
+	}
+
+	s.conn.WriteBulk(info.String())
+	return nil
+}
+
+/*
+* 客户端启动时常用 CONFIG GET databases 获取 db 数量
+ */
+func respConfig(s *respSession, args []string) error {
+	if len(args) == 3 && strings.ToLower(args[1]) == "get" && strings.ToLower(args[2]) == "databases" {
+		databases := 16
+		for dbId := range s.server.dbs {
+			if dbId >= databases {
+				databases = dbId + 1
+			}
+		}
+		s.conn.WriteBulks([]string{"databases", strconv.Itoa(databases)})
+		return nil
+	}
+
+	s.conn.WriteArray(0)
+	return nil
+}
+
+func respExists(s *respSession, args []string) error {
+	var count int64
+	for _, key := range args[1:] {
+		if _, ok := s.object(key); ok {
+			count++
+		} else if _, ok := s.server.unparsed(s.db, key); ok {
+			count++
+		}
+	}
+
+	s.conn.WriteInteger(count)
+	return nil
+}
+
+func respType(s *respSession, args []string) error {
+	obj, ok := s.object(args[1])
+	if !ok {
+		if entry, unparsed := s.server.unparsed(s.db, args[1]); unparsed {
+			s.conn.WriteStatus(unparsedTypeName(entry.Type))
+		} else {
+			s.conn.WriteStatus("none")
+		}
+		return nil
+	}
+
+	s.conn.WriteStatus(typeMap[obj.objType])
+	return nil
+}
+
+/*
+* 剩余时间相对 rdb 文件的生成时间计算
+ */
+func respTtl(s *respSession, args []string) error {
+	var expireTime int64
+	if obj, ok := s.object(args[1]); ok {
+		expireTime = obj.expireTime
+	} else if entry, ok := s.server.unparsed(s.db, args[1]); ok {
+		expireTime = entry.ExpireTime
+	} else {
+		s.conn.WriteInteger(-2)
+		return nil
+	}
+	if expireTime < 0 {
+		s.conn.WriteInteger(-1)
+		return nil
+	}
+
+	remain := expireTime - s.server.now
+	if remain < 0 {
+		remain = 0
+	}
+	if strings.ToLower(args[0]) == "ttl" {
+		remain = (remain + 500) / 1000
+	}
+
+	s.conn.WriteInteger(remain)
+	return nil
+}
+
+/*
+* redis 中的编码名称，字符串区分 int embstr raw
+ */
+func respEncoding(obj *RedisObject) string {
+	str, ok := obj.objVal.(string)
+	if !ok {
+		return obj.encoding()
+	}
+
+	if _, err := strconv.ParseInt(str, 10, 64); err == nil && len(str) <= 20 {
+		return "int"
+	}
+	if len(str) <= 44 {
+		return "embstr"
+	}
+
+	return "raw"
+}
+
+func respObject(s *respSession, args []string) error {
+	if strings.ToLower(args[1]) != "encoding" || len(args) != 3 {
+		return errors.New("ERR only OBJECT ENCODING is supported")
+	}
+
+	obj, ok := s.object(args[2])
+	if !ok {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteBulk(respEncoding(obj))
+	return nil
+}
+
+func respMemory(s *respSession, args []string) error {
+	if strings.ToLower(args[1]) != "usage" || len(args) < 3 {
+		return errors.New("ERR only MEMORY USAGE is supported")
+	}
+
+	obj, ok := s.object(args[2])
+	if !ok {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteInteger(estimateMemory(args[2], obj))
+	return nil
+}
+
+/*
+* SCAN 系列命令的 MATCH COUNT TYPE 参数
+ */
+func parseScanOpts(opts []string) (string, int, string, error) {
+	match, count, typeName := "", RESP_SCAN_COUNT, ""
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return "", 0, "", errors.New(RESP_SYNTAX)
+		}
+		switch strings.ToLower(opts[i]) {
+		case "match":
+			match = opts[i+1]
+		case "count":
+			var err error
+			count, err = strconv.Atoi(opts[i+1])
+			if err != nil || count < 1 {
+				return "", 0, "", errors.New(RESP_SYNTAX)
+			}
+		case "type":
+			typeName = strings.ToLower(opts[i+1])
+		default:
+			return "", 0, "", errors.New(RESP_SYNTAX)
+		}
+	}
+
+	return match, count, typeName, nil
+}
+
+func parseCursor(str string) (int, error) {
+	cursor, err := strconv.Atoi(str)
+	if err != nil || cursor < 0 {
+		return 0, errors.New("ERR invalid cursor")
+	}
+
+	return cursor, nil
+}
+
+/*
+* 游标为 key 在排序后列表中的位置，和 redis 一样 COUNT 是检查的个数
+ */
+func respScan(s *respSession, args []string) error {
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return err
+	}
+	match, count, typeName, err := parseScanOpts(args[2:])
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	if d, ok := s.server.dbs[s.db]; ok {
+		keys = d.keys
+	}
+
+	found := []string{}
+	pos := cursor
+	for ; pos < len(keys) && pos < cursor+count; pos++ {
+		key := keys[pos]
+		if match != "" && !globMatch(match, key) {
+			continue
+		}
+		if typeName != "" && s.server.keyType(s.db, key) != typeName {
+			continue
+		}
+		found = append(found, key)
+	}
+	if pos >= len(keys) {
+		pos = 0
+	}
+
+	s.conn.WriteArray(2)
+	s.conn.WriteBulk(strconv.Itoa(pos))
+	s.conn.WriteBulks(found)
+	return nil
+}
+
+func respKeys(s *respSession, args []string) error {
+	found := []string{}
+	if d, ok := s.server.dbs[s.db]; ok {
+		for _, key := range d.keys {
+			if globMatch(args[1], key) {
+				found = append(found, key)
+			}
+		}
+	}
+
+	s.conn.WriteBulks(found)
+	return nil
+}
+
+func respGet(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_STRING)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteBulk(obj.objVal.(string))
+	return nil
+}
+
+func respMget(s *respSession, args []string) error {
+	s.conn.WriteArray(len(args) - 1)
+	for _, key := range args[1:] {
+		obj, ok := s.object(key)
+		if !ok {
+			s.conn.WriteNil()
+			continue
+		}
+		if str, isStr := obj.objVal.(string); isStr {
+			s.conn.WriteBulk(str)
+		} else {
+			s.conn.WriteNil()
+		}
+	}
+
+	return nil
+}
+
+func respStrlen(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_STRING)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteInteger(0)
+		return nil
+	}
+
+	s.conn.WriteInteger(int64(len(obj.objVal.(string))))
+	return nil
+}
+
+/*
+* HLEN LLEN SCARD ZCARD
+ */
+func respLen(s *respSession, args []string) error {
+	objType := map[string]int{"hlen": RDB_TYPE_HASH, "llen": RDB_TYPE_LIST, "scard": RDB_TYPE_SET, "zcard": RDB_TYPE_ZSET}[strings.ToLower(args[0])]
+	obj, err := s.typedObject(args[1], objType)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteInteger(0)
+		return nil
+	}
+
+	s.conn.WriteInteger(elementCount(obj))
+	return nil
+}
+
+func respHget(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_HASH)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	value, ok := obj.objVal.(map[string]string)[args[2]]
+	if !ok {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteBulk(value)
+	return nil
+}
+
+func respHmget(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_HASH)
+	if err != nil {
+		return err
+	}
+
+	s.conn.WriteArray(len(args) - 2)
+	for _, field := range args[2:] {
+		if obj == nil {
+			s.conn.WriteNil()
+			continue
+		}
+		if value, ok := obj.objVal.(map[string]string)[field]; ok {
+			s.conn.WriteBulk(value)
+		} else {
+			s.conn.WriteNil()
+		}
+	}
+
+	return nil
+}
+
+func respHexists(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_HASH)
+	if err != nil {
+		return err
+	}
+
+	exists := int64(0)
+	if obj != nil {
+		if _, ok := obj.objVal.(map[string]string)[args[2]]; ok {
+			exists = 1
+		}
+	}
+
+	s.conn.WriteInteger(exists)
+	return nil
+}
+
+/*
+* HGETALL HKEYS HVALS
+ */
+func respHgetall(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_HASH)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteArray(0)
+		return nil
+	}
+
+	name := strings.ToLower(args[0])
+	elements := s.elements(args[1], obj)
+	if name == "hgetall" {
+		s.conn.WriteArray(len(elements) * 2)
+	} else {
+		s.conn.WriteArray(len(elements))
+	}
+	for _, elem := range elements {
+		if name != "hvals" {
+			s.conn.WriteBulk(elem.Field)
+		}
+		if name != "hkeys" {
+			s.conn.WriteBulk(elem.Value)
+		}
+	}
+
+	return nil
+}
+
+func respLrange(s *respSession, args []string) error {
+	start, err1 := strconv.ParseInt(args[2], 10, 64)
+	stop, err2 := strconv.ParseInt(args[3], 10, 64)
+	if err1 != nil || err2 != nil {
+		return errors.New(RESP_NOT_INTEGER)
+	}
+
+	obj, err := s.typedObject(args[1], RDB_TYPE_LIST)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteArray(0)
+		return nil
+	}
+
+	list := obj.objVal.([]string)
+	from, to := rankRange(start, stop, len(list))
+	s.conn.WriteBulks(list[from:to])
+	return nil
+}
+
+func respLindex(s *respSession, args []string) error {
+	index, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errors.New(RESP_NOT_INTEGER)
+	}
+
+	obj, err := s.typedObject(args[1], RDB_TYPE_LIST)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	list := obj.objVal.([]string)
+	if index < 0 {
+		index += int64(len(list))
+	}
+	if index < 0 || index >= int64(len(list)) {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteBulk(list[index])
+	return nil
+}
+
+func respSmembers(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_SET)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteArray(0)
+		return nil
+	}
+
+	elements := s.elements(args[1], obj)
+	s.conn.WriteArray(len(elements))
+	for _, elem := range elements {
+		s.conn.WriteBulk(elem.Value)
+	}
+
+	return nil
+}
+
+func respSismember(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_SET)
+	if err != nil {
+		return err
+	}
+
+	exists := int64(0)
+	if obj != nil {
+		if _, ok := obj.objVal.(map[string]int)[args[2]]; ok {
+			exists = 1
+		}
+	}
+
+	s.conn.WriteInteger(exists)
+	return nil
+}
+
+func respZscore(s *respSession, args []string) error {
+	obj, err := s.typedObject(args[1], RDB_TYPE_ZSET)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	score, ok := obj.objVal.(map[string]float64)[args[2]]
+	if !ok {
+		s.conn.WriteNil()
+		return nil
+	}
+
+	s.conn.WriteBulk(formatScore(score))
+	return nil
+}
+
+/*
+* ZRANGE key start stop [BYSCORE] [REV] [LIMIT offset count] [WITHSCORES]
+* 以及 ZREVRANGE ZRANGEBYSCORE ZREVRANGEBYSCORE
+* REV 且 BYSCORE 时 start 为最大值，stop 为最小值
+ */
+func respZrange(s *respSession, args []string) error {
+	name := strings.ToLower(args[0])
+	byScore := name == "zrangebyscore" || name == "zrevrangebyscore"
+	rev := name == "zrevrange" || name == "zrevrangebyscore"
+	withScores, limit := false, false
+	offset, count := 0, -1
+
+	opts := args[4:]
+	for i := 0; i < len(opts); i++ {
+		switch strings.ToLower(opts[i]) {
+		case "withscores":
+			withScores = true
+		case "byscore":
+			byScore = byScore || name == "zrange"
+		case "rev":
+			rev = rev || name == "zrange"
+		case "limit":
+			if i+2 >= len(opts) {
+				return errors.New(RESP_SYNTAX)
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(opts[i+1])
+			count, err2 = strconv.Atoi(opts[i+2])
+			if err1 != nil || err2 != nil {
+				return errors.New(RESP_NOT_INTEGER)
+			}
+			limit = true
+			i += 2
+		default:
+			return errors.New(RESP_SYNTAX)
+		}
+	}
+	if limit && !byScore {
+		return errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+
+	var selected []*Element
+	obj, err := s.typedObject(args[1], RDB_TYPE_ZSET)
+	if err != nil {
+		return err
+	}
+	if obj != nil {
+		elements := s.elements(args[1], obj)
+		if byScore {
+			minArg, maxArg := args[2], args[3]
+			if rev {
+				minArg, maxArg = maxArg, minArg
+			}
+			min, err := parseScoreBound(minArg)
+			if err != nil {
+				return errors.New("ERR min or max is not a float")
+			}
+			max, err := parseScoreBound(maxArg)
+			if err != nil {
+				return errors.New("ERR min or max is not a float")
+			}
+			for _, elem := range elements {
+				if min.below(*elem.Score) && max.above(*elem.Score) {
+					selected = append(selected, elem)
+				}
+			}
+			if rev {
+				selected = reverseElements(selected)
+			}
+		} else {
+			start, err1 := strconv.ParseInt(args[2], 10, 64)
+			stop, err2 := strconv.ParseInt(args[3], 10, 64)
+			if err1 != nil || err2 != nil {
+				return errors.New(RESP_NOT_INTEGER)
+			}
+			if rev {
+				elements = reverseElements(elements)
+			}
+			from, to := rankRange(start, stop, len(elements))
+			selected = elements[from:to]
+		}
+	}
+
+	if offset > 0 || count >= 0 {
+		if offset < 0 || offset > len(selected) {
+			offset = len(selected)
+		}
+		selected = selected[offset:]
+		if count >= 0 && count < len(selected) {
+			selected = selected[:count]
+		}
+	}
+
+	if withScores {
+		s.conn.WriteArray(len(selected) * 2)
+	} else {
+		s.conn.WriteArray(len(selected))
+	}
+	for _, elem := range selected {
+		s.conn.WriteBulk(elem.Value)
+		if withScores {
+			s.conn.WriteBulk(formatScore(*elem.Score))
+		}
+	}
+
+	return nil
+}
+
+func reverseElements(elements []*Element) []*Element {
+	reversed := make([]*Element, len(elements))
+	for i, elem := range elements {
+		reversed[len(elements)-1-i] = elem
+	}
+
+	return reversed
+}
+
+/*
+* HSCAN SSCAN ZSCAN，游标为元素排序后的位置
+ */
+func respElementScan(s *respSession, args []string) error {
+	objType := map[string]int{"hscan": RDB_TYPE_HASH, "sscan": RDB_TYPE_SET, "zscan": RDB_TYPE_ZSET}[strings.ToLower(args[0])]
+	cursor, err := parseCursor(args[2])
+	if err != nil {
+		return err
+	}
+	match, count, _, err := parseScanOpts(args[3:])
+	if err != nil {
+		return err
+	}
+
+	obj, err := s.typedObject(args[1], objType)
+	if err != nil {
+		return err
+	}
+
+	var elements []*Element
+	if obj != nil {
+		elements = s.elements(args[1], obj)
+	}
+
+	found := []string{}
+	pos := cursor
+	for ; pos < len(elements) && pos < cursor+count; pos++ {
+		elem := elements[pos]
+		switch objType {
+		case RDB_TYPE_HASH:
+			if match == "" || globMatch(match, elem.Field) {
+				found = append(found, elem.Field, elem.Value)
+			}
+		case RDB_TYPE_SET:
+			if match == "" || globMatch(match, elem.Value) {
+				found = append(found, elem.Value)
+			}
+		case RDB_TYPE_ZSET:
+			if match == "" || globMatch(match, elem.Value) {
+				found = append(found, elem.Value, formatScore(*elem.Score))
+			}
+		}
+	}
+	if pos >= len(elements) {
+		pos = 0
+	}
+
+	s.conn.WriteArray(2)
+	s.conn.WriteBulk(strconv.Itoa(pos))
+	s.conn.WriteBulks(found)
+	return nil
+}
+
+/*
+* 以 redis 协议提供备份文件的只读访问
+ */
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	respAddr := fs.String("resp", "127.0.0.1:6380", "listen address of the redis protocol server")
+	password := fs.String("requirepass", "", "password clients must send with AUTH")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || *respAddr == "" {
+		return errors.New("usage: decode " + serveUsage)
+	}
+
+	server, err := NewRespServer(files[0])
+	if err != nil {
+		return err
+	}
+	if server.index != nil {
+		defer server.index.Close()
+	}
+	server.password = *password
+
+	meta := server.meta
+	fmt.Printf("Rdb version: %d, keys: %d, expires: %d\n", meta.Version, meta.Keys, meta.Expires)
+
+	return server.Serve(*respAddr)
+}
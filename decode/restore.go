@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const restoreUsage = "restore dump.rdb -target host:port [-auth password] [-mode restore|commands] [-replace] [-match user:*] [-db 0] [-target-db 0] [-concurrency 4] [-pipeline 100] [-rate 1000]"
+
+const RESTORE_PAYLOAD = "restore"
+const RESTORE_COMMANDS = "commands"
+
+/* 集合类型每条命令最多携带的元素个数 */
+const COMMAND_BATCH = 1000
+
+/*
+* 一个key的命令，checkExists 为 true 时先检查key是否存在，已存在时不发送命令
+ */
+type restoreJob struct {
+	dbId        int
+	key         string
+	cmds        [][]string
+	checkExists bool
+}
+
+type restoreStats struct {
+	keys    int64
+	failed  int64
+	skipped int64
+}
+
+/*
+* 把一个对象转换为可以重建它的命令
+* 集合类型按 batch 个元素一条命令，expireTime 为毫秒时间戳，-1 表示不过期
+ */
+func objectCommands(key string, obj *RedisObject, expireTime int64, batch int) [][]string {
+	var cmds [][]string
+	if obj == nil {
+		// stream 和 module 类型没有解析
+		return cmds
+	}
+	appendBatched := func(cmd string, args []string, step int) {
+		for len(args) > 0 {
+			n := batch * step
+			if n > len(args) {
+				n = len(args)
+			}
+			cmds = append(cmds, append([]string{cmd, key}, args[:n]...))
+			args = args[n:]
+		}
+	}
+
+	switch val := obj.objVal.(type) {
+	case string:
+		cmds = append(cmds, []string{"SET", key, val})
+	case []string:
+		appendBatched("RPUSH", val, 1)
+	case map[string]int:
+		members := make([]string, 0, len(val))
+		for member := range val {
+			members = append(members, member)
+		}
+		appendBatched("SADD", members, 1)
+	case map[string]float64:
+		args := make([]string, 0, len(val)*2)
+		for member, score := range val {
+			args = append(args, formatScore(score), member)
+		}
+		appendBatched("ZADD", args, 2)
+	case map[string]string:
+		args := make([]string, 0, len(val)*2)
+		for field, value := range val {
+			args = append(args, field, value)
+		}
+		appendBatched("HSET", args, 2)
+	}
+
+	if expireTime >= 0 && len(cmds) > 0 {
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(expireTime, 10)})
+	}
+
+	return cmds
+}
+
+/*
+* 浮点数转换为 redis 可识别的字符串
+ */
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(score, 'g', 17, 64)
+}
+
+/*
+* 一个连接，批量发送命令
+ */
+func restoreWorker(addr string, auth string, targetDb int, pipeline int, jobs <-chan *restoreJob, stats *restoreStats) error {
+	conn, err := DialResp(addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if auth != "" {
+		_, err = conn.Do("AUTH", auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	curDb := -1
+	selectDb := func(job *restoreJob) bool {
+		dbId := job.dbId
+		if targetDb >= 0 {
+			dbId = targetDb
+		}
+		if dbId == curDb {
+			return false
+		}
+		conn.WriteCommand("SELECT", strconv.Itoa(dbId))
+		curDb = dbId
+		return true
+	}
+	checkReply := func(reply interface{}) {
+		if respErr, ok := reply.(RespError); ok {
+			if atomic.AddInt64(&stats.failed, 1) <= 10 {
+				fmt.Fprintf(os.Stderr, "\nrestore failed: %s\n", respErr)
+			}
+		}
+	}
+
+	batch := make([]*restoreJob, 0, pipeline)
+	for job := range jobs {
+		batch = append(batch[:0], job)
+	collect:
+		for len(batch) < pipeline {
+			select {
+			case next, ok := <-jobs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		// 不覆盖已存在的key时先用 EXISTS 检查这一批key，owners 记录每个回复对应的key，SELECT 的回复为 -1
+		exists := make([]bool, len(batch))
+		var owners []int
+		for i, job := range batch {
+			if !job.checkExists {
+				continue
+			}
+			if selectDb(job) {
+				owners = append(owners, -1)
+			}
+			conn.WriteCommand("EXISTS", job.key)
+			owners = append(owners, i)
+		}
+		if len(owners) > 0 {
+			err = conn.Flush()
+			if err != nil {
+				return err
+			}
+			for _, owner := range owners {
+				reply, err := conn.ReadReply()
+				if err != nil {
+					return err
+				}
+				if n, ok := reply.(int64); ok && owner >= 0 {
+					exists[owner] = n > 0
+				} else {
+					checkReply(reply)
+				}
+			}
+		}
+
+		pending := 0
+		restored := int64(0)
+		for i, job := range batch {
+			if exists[i] {
+				atomic.AddInt64(&stats.skipped, 1)
+				continue
+			}
+			if selectDb(job) {
+				pending++
+			}
+
+			for _, cmd := range job.cmds {
+				conn.WriteCommand(cmd...)
+				pending++
+			}
+			restored++
+		}
+
+		err = conn.Flush()
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < pending; i++ {
+			reply, err := conn.ReadReply()
+			if err != nil {
+				return err
+			}
+			checkReply(reply)
+		}
+
+		atomic.AddInt64(&stats.keys, restored)
+	}
+
+	return nil
+}
+
+/*
+* 把rdb文件中的数据导入到运行中的redis
+ */
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	target := fs.String("target", "", "redis address, eg: 127.0.0.1:6379")
+	auth := fs.String("auth", "", "redis password")
+	mode := fs.String("mode", RESTORE_PAYLOAD, "restore: RESTORE serialized values, commands: rebuild keys with SET/RPUSH/SADD/ZADD/HSET")
+	replace := fs.Bool("replace", false, "overwrite existing keys")
+	match := fs.String("match", "", "comma separated glob patterns of keys to restore, default all keys")
+	dbFilter := fs.Int("db", -1, "only restore keys of this db")
+	targetDb := fs.Int("target-db", -1, "restore all keys into this db, default the source db")
+	concurrency := fs.Int("concurrency", 4, "number of connections")
+	pipeline := fs.Int("pipeline", 100, "max keys sent per round trip")
+	rate := fs.Int("rate", 0, "max keys per second, 0 means unlimited")
+	showProgress := fs.Bool("progress", true, "show progress bar on stderr")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *target == "" || len(files) != 1 {
+		return errors.New("usage: decode " + restoreUsage)
+	}
+	if *mode != RESTORE_PAYLOAD && *mode != RESTORE_COMMANDS {
+		return fmt.Errorf("unknown mode: %s", *mode)
+	}
+	if *concurrency < 1 || *pipeline < 1 {
+		return errors.New("concurrency and pipeline must be positive")
+	}
+	keyRules := splitList(*match)
+
+	rdb, file, err := openRdbFile(files[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	stats := &restoreStats{}
+	jobs := make(chan *restoreJob, *concurrency**pipeline)
+	errCh := make(chan error, *concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := restoreWorker(*target, *auth, *targetDb, *pipeline, jobs, stats)
+			if err != nil {
+				errCh <- err
+			}
+		}()
+	}
+
+	var progress *Progress
+	if *showProgress {
+		progress = NewProgress(fileInfo.Size())
+		progress.Start(200 * time.Millisecond)
+	}
+
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Second / time.Duration(*rate)
+	}
+	next := time.Now()
+	visited := int64(0)
+	rdb.visitor = func(entry *KeyEntry) error {
+		defer delete(rdb.mapObj, entry.key)
+
+		visited++
+		if progress != nil {
+			progress.Update(rdb.curIndex, visited)
+		}
+
+		if (*dbFilter >= 0 && entry.dbId != *dbFilter) || !matchRules(keyRules, entry.key) {
+			atomic.AddInt64(&stats.skipped, 1)
+			return nil
+		}
+
+		job := &restoreJob{dbId: entry.dbId, key: entry.key}
+		if *mode == RESTORE_PAYLOAD {
+			ttl := int64(0)
+			if entry.expireTime >= 0 {
+				ttl = entry.expireTime - time.Now().UnixNano()/int64(time.Millisecond)
+				if ttl <= 0 {
+					// 已经过期
+					atomic.AddInt64(&stats.skipped, 1)
+					return nil
+				}
+			}
+
+			rawVal, err := entry.RawValue(rdb.fp)
+			if err != nil {
+				return err
+			}
+
+			cmd := []string{"RESTORE", entry.key, strconv.FormatInt(ttl, 10), string(CreateDumpPayload(entry.valType, rawVal, rdb.version))}
+			if *replace {
+				cmd = append(cmd, "REPLACE")
+			}
+			job.cmds = [][]string{cmd}
+		} else {
+			if entry.obj == nil {
+				// stream 和 module 类型没有解析，不能转换为命令
+				atomic.AddInt64(&stats.skipped, 1)
+				return nil
+			}
+			if *replace {
+				job.cmds = append(job.cmds, []string{"DEL", entry.key})
+			} else {
+				// 不覆盖已存在的key，否则 RPUSH SADD 等命令会追加到已有的key中
+				job.checkExists = true
+			}
+			job.cmds = append(job.cmds, objectCommands(entry.key, entry.obj, entry.expireTime, COMMAND_BATCH)...)
+		}
+
+		if interval > 0 {
+			next = next.Add(interval)
+			if wait := time.Until(next); wait > 0 {
+				time.Sleep(wait)
+			} else if wait < -time.Second {
+				next = time.Now()
+			}
+		}
+
+		select {
+		case jobs <- job:
+			return nil
+		case err := <-errCh:
+			return err
+		}
+	}
+	decodeErr := rdb.DecodeRDBFile()
+	close(jobs)
+	wg.Wait()
+
+	if progress != nil {
+		progress.Update(rdb.curIndex, visited)
+		progress.Stop()
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	default:
+	}
+
+	fmt.Printf("Restored %d keys to %s, %d commands failed, %d keys skipped\n", stats.keys, *target, stats.failed, stats.skipped)
+	return nil
+}
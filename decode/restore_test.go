@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/*
+* 测试用的 redis，只实现 restore 用到的命令
+* 集合类型的元素按命令中的顺序追加，restore 的 payload 原样保存
+ */
+type fakeRedis struct {
+	mutex    sync.Mutex
+	listener net.Listener
+	dbs      map[int]map[string][]string
+	expires  map[string]int64
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := &fakeRedis{listener: listener, dbs: map[int]map[string][]string{}, expires: map[string]int64{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(NewRespConn(conn))
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.listener.Addr().String()
+}
+
+func (fr *fakeRedis) db(dbId int) map[string][]string {
+	if fr.dbs[dbId] == nil {
+		fr.dbs[dbId] = map[string][]string{}
+	}
+
+	return fr.dbs[dbId]
+}
+
+func (fr *fakeRedis) serve(conn *RespConn) {
+	defer conn.Close()
+
+	dbId := 0
+	for {
+		args, err := conn.ReadCommand(RESP_MAX_ARGS, RESP_MAX_ARG_LEN)
+		if err != nil {
+			return
+		}
+
+		fr.mutex.Lock()
+		fr.commands = append(fr.commands, strings.ToUpper(args[0]))
+		db := fr.db(dbId)
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			conn.WriteStatus("OK")
+		case "SELECT":
+			dbId, _ = strconv.Atoi(args[1])
+			conn.WriteStatus("OK")
+		case "EXISTS":
+			_, ok := db[args[1]]
+			if ok {
+				conn.WriteInteger(1)
+			} else {
+				conn.WriteInteger(0)
+			}
+		case "DEL":
+			delete(db, args[1])
+			conn.WriteInteger(1)
+		case "SET":
+			db[args[1]] = []string{args[2]}
+			conn.WriteStatus("OK")
+		case "RPUSH", "SADD", "ZADD", "HSET":
+			db[args[1]] = append(db[args[1]], args[2:]...)
+			conn.WriteInteger(int64(len(db[args[1]])))
+		case "PEXPIREAT":
+			fr.expires[args[1]], _ = strconv.ParseInt(args[2], 10, 64)
+			conn.WriteInteger(1)
+		case "RESTORE":
+			if _, ok := db[args[1]]; ok && (len(args) < 5 || strings.ToUpper(args[4]) != "REPLACE") {
+				conn.WriteError("BUSYKEY Target key name already exists.")
+			} else {
+				db[args[1]] = []string{args[3]}
+				conn.WriteStatus("OK")
+			}
+		default:
+			conn.WriteError("ERR unknown command '" + args[0] + "'")
+		}
+		fr.mutex.Unlock()
+
+		if conn.Flush() != nil {
+			return
+		}
+	}
+}
+
+/*
+* 写一个测试用的 rdb 文件
+ */
+func writeTestRdb(t *testing.T, keys []string, objs []*RedisObject) string {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rw := NewRdbWriter(file, 9)
+	rw.WriteHeader()
+	rw.WriteSelectDb(0)
+	for i, key := range keys {
+		rw.WriteObject(key, objs[i])
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func restoreTestRdb(t *testing.T) string {
+	str := NewRedisObject(RDB_TYPE_STRING, 1, "hello")
+	str.expireTime = 4102444800000
+	list := NewRedisObject(RDB_TYPE_LIST, 3, []string{"a", "b", "c"})
+	hash := NewRedisObject(RDB_TYPE_HASH, 1, map[string]string{"field": "value"})
+
+	return writeTestRdb(t, []string{"str", "list", "hash"}, []*RedisObject{str, list, hash})
+}
+
+func TestRestoreCommandsSkipsExistingKeys(t *testing.T) {
+	fr := newFakeRedis(t)
+	fr.db(0)["list"] = []string{"old"}
+
+	err := runRestore([]string{restoreTestRdb(t), "-target", fr.addr(), "-mode", RESTORE_COMMANDS, "-progress=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := fr.db(0)
+	if !reflect.DeepEqual(db["list"], []string{"old"}) {
+		t.Errorf("existing key was modified: %v", db["list"])
+	}
+	if !reflect.DeepEqual(db["str"], []string{"hello"}) || !reflect.DeepEqual(db["hash"], []string{"field", "value"}) {
+		t.Errorf("keys not restored: %v", db)
+	}
+	if fr.expires["str"] != 4102444800000 {
+		t.Errorf("expire time not restored: %v", fr.expires)
+	}
+	if _, ok := fr.expires["list"]; ok {
+		t.Errorf("expire time set on a skipped key")
+	}
+}
+
+func TestRestoreCommandsReplace(t *testing.T) {
+	fr := newFakeRedis(t)
+	fr.db(0)["list"] = []string{"old"}
+
+	err := runRestore([]string{restoreTestRdb(t), "-target", fr.addr(), "-mode", RESTORE_COMMANDS, "-replace", "-target-db", "2", "-progress=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fr.db(0)["list"], []string{"old"}) {
+		t.Errorf("key of another db was modified: %v", fr.db(0)["list"])
+	}
+	if !reflect.DeepEqual(fr.db(2)["list"], []string{"a", "b", "c"}) {
+		t.Errorf("list not restored into target db: %v", fr.db(2))
+	}
+}
+
+func TestRestorePayload(t *testing.T) {
+	for _, replace := range []bool{false, true} {
+		fr := newFakeRedis(t)
+		fr.db(0)["list"] = []string{"old"}
+
+		args := []string{restoreTestRdb(t), "-target", fr.addr(), "-progress=false"}
+		if replace {
+			args = append(args, "-replace")
+		}
+		err := runRestore(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db := fr.db(0)
+		if replace == (db["list"][0] == "old") {
+			t.Errorf("replace=%v, list: %q", replace, db["list"])
+		}
+
+		obj, err := ParseDumpPayload([]byte(db["hash"][0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(obj.objVal, map[string]string{"field": "value"}) {
+			t.Errorf("unexpected restored hash: %v", obj.objVal)
+		}
+	}
+}
+
+func TestObjectCommandsNilObject(t *testing.T) {
+	if cmds := objectCommands("stream", nil, 100, COMMAND_BATCH); len(cmds) != 0 {
+		t.Errorf("unexpected commands for nil object: %v", cmds)
+	}
+}
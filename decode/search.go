@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+/* 每次搜索默认返回的key数量和最大数量 */
+const SEARCH_COUNT = 20
+const SEARCH_MAX_COUNT = 1000
+
+/* 每次搜索最多检查的key数量，和 SCAN 一样可能返回少于 count 个结果 */
+const SEARCH_MAX_SCAN = 100000
+
+/*
+* 搜索条件，db 小于0时不限制 db
+ */
+type SearchQuery struct {
+	match    string
+	typeName string
+	db       int
+	minMem   int64
+	cursor   int
+	count    int
+}
+
+type SearchItem struct {
+	Db         int    `json:"db"`
+	Key        string `json:"key"`
+	Type       string `json:"type"`
+	Encoding   string `json:"encoding"`
+	ExpireTime int64  `json:"expireTime"`
+	Memory     int64  `json:"memory"`
+}
+
+/*
+* 搜索结果，cursor 为下次搜索的游标，为0表示已经遍历完
+ */
+type SearchResult struct {
+	Cursor int           `json:"cursor"`
+	Keys   []*SearchItem `json:"keys"`
+}
+
+/*
+* 解析搜索参数：match type db minMem cursor count
+ */
+func parseSearchQuery(values url.Values) (*SearchQuery, error) {
+	q := &SearchQuery{match: values.Get("match"), typeName: values.Get("type"), db: -1, count: SEARCH_COUNT}
+	if q.match == "" {
+		q.match = "*"
+	}
+
+	var err error
+	if v := values.Get("db"); v != "" {
+		q.db, err = strconv.Atoi(v)
+		if err != nil || q.db < 0 {
+			return nil, errors.New("invalid db: " + v)
+		}
+	}
+	if v := values.Get("minMem"); v != "" {
+		q.minMem, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid minMem: " + v)
+		}
+	}
+	if v := values.Get("cursor"); v != "" {
+		q.cursor, err = strconv.Atoi(v)
+		if err != nil || q.cursor < 0 {
+			return nil, errors.New("invalid cursor: " + v)
+		}
+	}
+	if v := values.Get("count"); v != "" {
+		q.count, err = strconv.Atoi(v)
+		if err != nil || q.count < 1 || q.count > SEARCH_MAX_COUNT {
+			return nil, errors.New("invalid count: " + v)
+		}
+	}
+	if q.typeName != "" {
+		valid := false
+		for _, name := range typeMap {
+			valid = valid || name == q.typeName
+		}
+		if !valid {
+			return nil, errors.New("invalid type: " + q.typeName)
+		}
+	}
+
+	return q, nil
+}
+
+func (q *SearchQuery) matches(entry *IndexEntry) bool {
+	if q.db >= 0 && entry.Db != q.db {
+		return false
+	}
+	if entry.Memory < q.minMem {
+		return false
+	}
+	if q.typeName != "" && typeMap[rdbObjType[int(entry.Type)]] != q.typeName {
+		return false
+	}
+
+	return globMatch(q.match, entry.Key)
+}
+
+/*
+* 从游标位置开始按顺序查找，游标是 key 在排序后列表中的位置
+* 找到 count 个或者检查了 SEARCH_MAX_SCAN 个key后返回
+ */
+func searchEntries(entries []*IndexEntry, q *SearchQuery) *SearchResult {
+	result := &SearchResult{Keys: []*SearchItem{}}
+	pos := q.cursor
+	for scanned := 0; pos < len(entries) && len(result.Keys) < q.count && scanned < SEARCH_MAX_SCAN; scanned++ {
+		entry := entries[pos]
+		pos++
+		if !q.matches(entry) {
+			continue
+		}
+
+		result.Keys = append(result.Keys, &SearchItem{
+			Db:         entry.Db,
+			Key:        entry.Key,
+			Type:       typeMap[rdbObjType[int(entry.Type)]],
+			Encoding:   encodingMap[int(entry.Type)],
+			ExpireTime: entry.ExpireTime,
+			Memory:     entry.Memory,
+		})
+	}
+
+	if pos < len(entries) {
+		result.Cursor = pos
+	}
+
+	return result
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 )
@@ -15,6 +18,14 @@ import (
 const PageSize = 5
 const Success = 0
 const KeyNotExists = 1000
+const InvalidParams = 1001
+const ValueNotParsed = 1006
+
+/* 全局选项：web服务的监听地址、https 证书和私钥、反向代理时的路径前缀 */
+var serverListen = ":5763"
+var serverTlsCert = ""
+var serverTlsKey = ""
+var serverBasePath = ""
 
 /*
 * 判断路径是否存在
@@ -30,8 +41,31 @@ func PathExists(path string) bool {
 	return false
 }
 
+var typeMap = map[int]string{
+	0: "string",
+	1: "list",
+	2: "set",
+	3: "zset",
+	4: "hash",
+	5: "zset",
+}
+
+/*
+* 一个已加载的文件，name 为多个文件同时加载时的名称
+* entries 为按名称排序的所有key，用于搜索和汇总
+* elements 缓存最近分页访问的key
+* 不使用索引时 objs 按 db 保存所有的key，不同 db 中的同名key不会互相覆盖
+* unparsed 记录没有解析的 stream 和 module 类型的key
+ */
 type RdbHandler struct {
-	rdb *Rdb
+	name     string
+	path     string
+	rdb      *Rdb
+	index    *RdbIndex
+	entries  []*IndexEntry
+	objs     map[int]map[string]*RedisObject
+	unparsed map[int]map[string]byte
+	elements elementsCache
 }
 
 type RetData struct {
@@ -39,6 +73,23 @@ type RetData struct {
 	TypeName string      `json:"typeName"`
 	Length   int64       `json:"length"`
 	Val      interface{} `json:"val"`
+	Encoding string      `json:"encoding"`
+	Nodes    int64       `json:"nodes,omitempty"`
+	// rdb 中记录的 LRU 空闲时间(秒)和 LFU 访问频率
+	Idle *int64 `json:"idle,omitempty"`
+	Freq *int   `json:"freq,omitempty"`
+}
+
+func newRetData(obj *RedisObject) *RetData {
+	data := &RetData{Type: obj.objType, TypeName: typeMap[obj.objType], Length: obj.objLen, Val: obj.objVal, Encoding: obj.encoding(), Nodes: obj.nodes}
+	if obj.lruIdle >= 0 {
+		data.Idle = &obj.lruIdle
+	}
+	if obj.lfuFreq >= 0 {
+		data.Freq = &obj.lfuFreq
+	}
+
+	return data
 }
 
 /*
@@ -55,14 +106,19 @@ type ReturnResult struct {
  */
 func (rh *RdbHandler) getAllKeys(w http.ResponseWriter, r *http.Request) {
 	var keysArr []string
-	rdb := rh.rdb
-	cNum := 0
-	for k, _ := range rdb.mapObj {
-		keysArr = append(keysArr, k)
-		cNum = cNum + 1
-	}
+	if rh.index != nil {
+		// 索引中的key已经排好序
+		keysArr = rh.index.Keys()
+	} else {
+		rdb := rh.rdb
+		cNum := 0
+		for k, _ := range rdb.mapObj {
+			keysArr = append(keysArr, k)
+			cNum = cNum + 1
+		}
 
-	sort.Strings(keysArr)
+		sort.Strings(keysArr)
+	}
 
 	var page int = 1
 	var err error = nil
@@ -71,7 +127,7 @@ func (rh *RdbHandler) getAllKeys(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		page, err = strconv.Atoi(pageVar)
 		if err != nil {
-			fmt.Printf("convert string to int failed, page: %s", page)
+			fmt.Printf("convert string to int failed, page: %s\n", pageVar)
 			return
 		}
 	}
@@ -99,6 +155,32 @@ func (rh *RdbHandler) getAllKeys(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(response))
 }
 
+/*
+* 查找key，有索引时从 rdb 文件中读取，db 为 -1 时不限制 db
+ */
+func (rh *RdbHandler) loadObject(key string, db int) (*RedisObject, bool) {
+	if rh.index == nil {
+		if db < 0 {
+			obj, ok := rh.rdb.mapObj[key]
+			return obj, ok
+		}
+		obj, ok := rh.objs[db][key]
+		return obj, ok
+	}
+
+	entry := rh.index.Lookup(key, db)
+	if entry == nil {
+		return nil, false
+	}
+	obj, err := rh.index.LoadObject(entry)
+	if err != nil {
+		fmt.Printf("load key %s failed, errmsg: %s\n", key, err)
+		return nil, false
+	}
+
+	return obj, true
+}
+
 /*
 * 获取某个key
 * @param key
@@ -111,19 +193,11 @@ func (rh *RdbHandler) getKey(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var result *ReturnResult
-	rdb := rh.rdb
-	ret, ok := rdb.mapObj[keyVar]
+	ret, ok := rh.loadObject(keyVar, -1)
 	if ok {
-		typeMap := map[int]string{
-			0: "string",
-			1: "list",
-			2: "set",
-			3: "zset",
-			4: "hash",
-			5: "zset",
-		}
-		retData := &RetData{ret.objType, typeMap[ret.objType], ret.objLen, ret.objVal}
-		result = &ReturnResult{Success, "", retData}
+		result = &ReturnResult{Success, "", newRetData(ret)}
+	} else if valType, ok := rh.unparsedType(keyVar, -1); ok {
+		result = &ReturnResult{ValueNotParsed, unparsedMessage(keyVar, valType), nil}
 	} else {
 		result = &ReturnResult{KeyNotExists, fmt.Sprintf("key %s not exists", keyVar), nil}
 	}
@@ -136,48 +210,300 @@ func (rh *RdbHandler) getKey(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, string(response))
 }
 
+/*
+* 获取rdb文件的元数据
+ */
+func (rh *RdbHandler) getInfo(w http.ResponseWriter, r *http.Request) {
+	result := &ReturnResult{Success, "", rh.rdb.meta}
+	response, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+/*
+* 获取元素个数和元素大小的分布统计
+ */
+func (rh *RdbHandler) getStats(w http.ResponseWriter, r *http.Request) {
+	result := &ReturnResult{Success, "", rh.rdb.stats}
+	response, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+/*
+* 解析时记录每个key，解析完成后需要排序
+ */
+func (rh *RdbHandler) collectEntries(rdb *Rdb) {
+	rh.objs = make(map[int]map[string]*RedisObject)
+	rh.unparsed = make(map[int]map[string]byte)
+	rdb.visitor = func(entry *KeyEntry) error {
+		if entry.obj == nil {
+			rh.addUnparsed(entry.dbId, entry.key, entry.valType)
+			return nil
+		}
+
+		rh.entries = append(rh.entries, newIndexEntry(entry))
+		if rh.objs[entry.dbId] == nil {
+			rh.objs[entry.dbId] = make(map[string]*RedisObject)
+		}
+		rh.objs[entry.dbId][entry.key] = entry.obj
+		return nil
+	}
+}
+
+func (rh *RdbHandler) addUnparsed(dbId int, key string, valType byte) {
+	if rh.unparsed == nil {
+		rh.unparsed = make(map[int]map[string]byte)
+	}
+	if rh.unparsed[dbId] == nil {
+		rh.unparsed[dbId] = make(map[string]byte)
+	}
+	rh.unparsed[dbId][key] = valType
+}
+
+/*
+* 没有解析的key的类型字节，db 为 -1 时不限制 db
+ */
+func (rh *RdbHandler) unparsedType(key string, db int) (byte, bool) {
+	for dbId, keys := range rh.unparsed {
+		if valType, ok := keys[key]; ok && (db < 0 || db == dbId) {
+			return valType, true
+		}
+	}
+
+	return 0, false
+}
+
+func unparsedMessage(key string, valType byte) string {
+	if isStreamType(valType) {
+		return fmt.Sprintf("key %s is a stream, stream values are not parsed", key)
+	}
+	if isHashTtlType(valType) {
+		return fmt.Sprintf("key %s is a hash with field expiration, these values are not parsed", key)
+	}
+
+	return fmt.Sprintf("key %s is a module value, module values are not parsed", key)
+}
+
+/*
+* 按 glob、类型、db 和内存大小搜索key，使用游标分页
+ */
+func (rh *RdbHandler) getSearch(w http.ResponseWriter, r *http.Request) {
+	var result *ReturnResult
+	query, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		result = &ReturnResult{InvalidParams, err.Error(), nil}
+	} else {
+		result = &ReturnResult{Success, "", searchEntries(rh.entries, query)}
+	}
+
+	response, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
 func main() {
-	// 获取文件路径
-	argLen := len(os.Args)
-	if argLen != 2 {
-		fmt.Println("Wrong params, use decode path[eg:/home/root/dump.rdb]")
+	// 全局选项
+	args, err := parseGlobalArgs(os.Args[1:])
+	if err != nil {
 		os.Exit(-1)
 	}
 
-	// 检查文件路径合法性
-	rdbFile := os.Args[1]
-	if !PathExists(rdbFile) {
-		fmt.Errorf("File: %s not exists, please check your file path")
+	// 获取文件路径，允许上传时可以不指定文件，启动后在web页面上传
+	argLen := len(args)
+	if argLen < 1 && !uploadEnabled {
+		printUsage()
 		os.Exit(-1)
 	}
 
-	// 开始解析文件
-	file, err := os.Open(rdbFile)
+	// 子命令
+	if argLen > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			err := cmd.run(args[1:])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(-1)
+			}
+			return
+		}
+	}
+
+	dumps := NewDumpSet()
+	var jobs []*LoadJob
+	for _, arg := range args {
+		name, path := parseDumpArg(arg)
+		jobs = append(jobs, dumps.NewJob(name, path, path, rdbFileSize(path), false))
+	}
+
+	// 服务立即启动，文件在后台依次解析，通过 /status 查看进度
+	go func() {
+		for _, job := range jobs {
+			dumps.Load(job, true)
+		}
+	}()
+
+	err = startServer(dumps)
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Printf("start server failed, errmsg: %s\n", err)
+	}
+}
+
+/*
+* 加载一个 rdb 或 aof 文件，rdb 文件有索引时直接使用索引
+* 解析 rdb 文件时通过 progress 报告读取的字节数和key数量
+ */
+func loadDump(path string, progress *Progress) (*RdbHandler, error) {
+	// aof 文件回放命令得到相同的数据
+	var rdb *Rdb
+	rh := &RdbHandler{path: path}
+	if isAofPath(path) {
+		aof := NewAof()
+		err := aof.LoadPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		aof.printSummary()
+		rdb = aof.ToRdb()
+		rh.objs = aof.dbs
+		rdb.stats = NewStats(STATS_TOP)
+		for dbId, db := range aof.dbs {
+			for key, obj := range db {
+				rdb.stats.Add(dbId, key, obj)
+				rh.entries = append(rh.entries, newIndexEntry(&KeyEntry{dbId, key, obj.expireTime, byte(obj.encType), 0, 0, obj, obj.lruIdle, obj.lfuFreq, 0}))
+			}
+		}
+		rdb.stats.Finish()
+		sortIndexEntries(rh.entries)
+	} else if index, err := LoadIndex(path); index != nil {
+		// 有索引时不需要解析整个文件，rdb 文件在服务退出前保持打开
+		fmt.Printf("Using index %s\n", indexPath(path))
+		rdb = index.Rdb()
+		rh.index = index
+		rh.entries = index.entries
+		for _, entry := range index.unparsed {
+			rh.addUnparsed(entry.Db, entry.Key, entry.Type)
+		}
+	} else {
+		if err != nil {
+			fmt.Printf("Ignore index, errmsg: %s\n", err)
+		}
+
+		// 检查文件路径合法性，开始解析文件
+		var file *os.File
+		rdb, file, err = openRdbFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer file.Close()
+		reader := &progressReaderAt{fp: file}
+		rdb.fp = reader
+		rdb.stats = NewStats(STATS_TOP)
+		rh.collectEntries(rdb)
+		collect := rdb.visitor
+		rdb.visitor = func(entry *KeyEntry) error {
+			err := collect(entry)
+			progress.Update(atomic.LoadInt64(&reader.offset), int64(len(rh.entries)))
+			return err
+		}
+
+		err = rdb.DecodeRDBFile()
+		if err != nil {
+			return nil, err
+		}
+		sortIndexEntries(rh.entries)
+	}
+	rh.rdb = rdb
+	progress.Update(rdb.meta.FileSize, int64(len(rh.entries)))
+
+	meta := rdb.meta
+	fmt.Printf("%s: rdb version: %d, keys: %d, expires: %d, parse time: %dms\n", path, meta.Version, meta.Keys, meta.Expires, meta.ParseMs)
+	if meta.Checksum != "" && !meta.ChecksumOk {
+		fmt.Printf("Warning: checksum mismatch, file may be corrupted\n")
 	}
 
-	mapObj := make(map[string]*RedisObject)
-	defer file.Close()
-	rdb := &Rdb{int64(0), 0, 0, 0, 0, 0, file, 0, mapObj, 0}
-	rdb.DecodeRDBFile()
-	rh := &RdbHandler{rdb}
+	return rh, nil
+}
+
+/*
+* 启动web服务，展示解析后的数据
+* 设置了 basePath 时所有路径都在 basePath 之下，用于反向代理
+ */
+func startServer(ds *DumpSet) error {
+	if (serverTlsCert == "") != (serverTlsKey == "") {
+		return errors.New("both -tls-cert and -tls-key are required for https")
+	}
+	base := normalizeBasePath(serverBasePath)
+	auth, err := NewAuthenticator(serverAuth, serverToken, base)
+	if err != nil {
+		return err
+	}
+	www, err := wwwFileSystem()
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("Listening on 5763...")
-	// 设置路由函数规则
-	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/keys/{page}", rh.getAllKeys)
-	router.HandleFunc("/key/{key}", rh.getKey)
+	// 设置路由函数规则，不带前缀时访问第一个文件
+	root := mux.NewRouter().StrictSlash(true)
+	router := root
+	if base != "" {
+		router = root.PathPrefix(base).Subrouter()
+	}
+	for _, prefix := range []string{"", "/dumps/{name}"} {
+		router.HandleFunc(prefix+"/keys/{page}", ds.handle((*RdbHandler).getAllKeys))
+		router.HandleFunc(prefix+"/key/{key}", ds.handle((*RdbHandler).getKey))
+		router.HandleFunc(prefix+"/key/{key}/elements", ds.handle((*RdbHandler).getElements))
+		router.HandleFunc(prefix+"/info", ds.handle((*RdbHandler).getInfo))
+		router.HandleFunc(prefix+"/stats", ds.handle((*RdbHandler).getStats))
+		router.HandleFunc(prefix+"/search", ds.handle((*RdbHandler).getSearch))
+	}
+	router.HandleFunc("/dumps", ds.getDumps)
+	router.HandleFunc("/aggregate/top", ds.getAggregateTop)
+	router.HandleFunc("/aggregate/prefixes", ds.getAggregatePrefixes)
+	router.HandleFunc("/status", ds.getStatus)
+	if uploadEnabled {
+		ds.upload = true
+		uploader := NewUploader(ds, uploadDir, uploadLimitMb)
+		router.HandleFunc("/upload", uploader.postUpload).Methods("POST")
+	}
 
 	// 静态资源路由
-	router.Handle("/", http.FileServer(http.Dir("./www")))
-	router.Handle("/css/{rest}", http.StripPrefix("/css/", http.FileServer(http.Dir("./www/css/"))))
-	router.Handle("/js/{rest}", http.StripPrefix("/js/", http.FileServer(http.Dir("./www/js/"))))
+	static := http.StripPrefix(base, http.FileServer(www))
+	router.Handle("/", static)
+	router.Handle("/css/{rest}", static)
+	router.Handle("/js/{rest}", static)
+	if base != "" {
+		root.Handle(base, http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	}
 
 	// 启动服务，监听请求
-	err = http.ListenAndServe(":5763", router)
-	if err != nil {
-		fmt.Printf("start server failed, errmsg: %s\n", err)
+	fmt.Printf("Listening on %s%s/ ...\n", serverListen, base)
+	server := &http.Server{Addr: serverListen, Handler: auth.Wrap(root)}
+	if serverTlsCert != "" {
+		return server.ListenAndServeTLS(serverTlsCert, serverTlsKey)
+	}
+
+	return server.ListenAndServe()
+}
+
+/*
+* basePath 以 / 开头，不以 / 结尾，根路径为空
+ */
+func normalizeBasePath(base string) string {
+	base = strings.Trim(base, "/")
+	if base == "" {
+		return ""
 	}
+
+	return "/" + base
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const splitUsage = "split dump.rdb [-slots] [-nodes a=0-5460;b=5461-10922;c=10923-16383 -o outdir]"
+
+const CLUSTER_SLOTS = 16384
+
+/*
+* 计算key所在的slot，如果key中包含 {hashtag} 则只对 hashtag 计算
+ */
+func keyHashSlot(key string) int {
+	start := strings.IndexByte(key, '{')
+	if start >= 0 {
+		end := strings.IndexByte(key[start+1:], '}')
+		if end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16([]byte(key)) & (CLUSTER_SLOTS - 1))
+}
+
+/*
+* 一个节点，bytes 为 key 在 rdb 中的字节数，memory 为估算的内存占用
+ */
+type clusterNode struct {
+	name   string
+	keys   int64
+	bytes  int64
+	memory int64
+	rw     *RdbWriter
+	out    *os.File
+}
+
+/*
+* 解析 slot 分配，格式 "a=0-5460;b=5461-10922,16000;c=..."
+* 返回每个slot所属的节点，未分配的slot为nil
+ */
+func parseSlotMap(str string) ([]*clusterNode, []*clusterNode, error) {
+	slotNodes := make([]*clusterNode, CLUSTER_SLOTS)
+	var nodes []*clusterNode
+	for _, nodeStr := range strings.Split(str, ";") {
+		if nodeStr == "" {
+			continue
+		}
+
+		parts := strings.SplitN(nodeStr, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("invalid node slots: %s", nodeStr)
+		}
+
+		for _, other := range nodes {
+			if other.name == parts[0] {
+				return nil, nil, fmt.Errorf("duplicate node: %s", parts[0])
+			}
+		}
+		node := &clusterNode{name: parts[0]}
+		nodes = append(nodes, node)
+		for _, rangeStr := range strings.Split(parts[1], ",") {
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			first, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid slot range: %s", rangeStr)
+			}
+			last := first
+			if len(bounds) == 2 {
+				last, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, nil, fmt.Errorf("invalid slot range: %s", rangeStr)
+				}
+			}
+			if first < 0 || last >= CLUSTER_SLOTS || first > last {
+				return nil, nil, fmt.Errorf("invalid slot range: %s", rangeStr)
+			}
+
+			for slot := first; slot <= last; slot++ {
+				if slotNodes[slot] != nil {
+					return nil, nil, fmt.Errorf("slot %d assigned to both %s and %s", slot, slotNodes[slot].name, node.name)
+				}
+				slotNodes[slot] = node
+			}
+		}
+	}
+
+	return slotNodes, nodes, nil
+}
+
+/*
+* 按 cluster slot 统计key数量、rdb 字节数和估算内存的分布，指定 -nodes 时为每个节点生成一个rdb文件
+* -slots 时输出每个slot的统计，否则只输出汇总
+ */
+func runSplit(args []string) error {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	slots := fs.Bool("slots", false, "show keys, rdb bytes and memory of each hash slot")
+	nodesStr := fs.String("nodes", "", "slot ranges of each node, eg: a=0-5460;b=5461-10922;c=10923-16383")
+	outDir := fs.String("o", ".", "output directory of the node rdb files")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if (!*slots && *nodesStr == "") || len(files) != 1 {
+		return errors.New("usage: decode " + splitUsage)
+	}
+
+	var slotNodes, nodes []*clusterNode
+	if *nodesStr != "" {
+		slotNodes, nodes, err = parseSlotMap(*nodesStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	rdb, file, err := openRdbFile(files[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 每个节点都生成一个rdb文件，没有key的节点也是合法的空rdb，出错时关闭已经打开的文件
+	defer func() {
+		for _, node := range nodes {
+			if node.out != nil {
+				node.out.Close()
+			}
+		}
+	}()
+	for _, node := range nodes {
+		node.out, err = os.Create(filepath.Join(*outDir, node.name+".rdb"))
+		if err != nil {
+			return err
+		}
+	}
+
+	slotKeys := make([]int64, CLUSTER_SLOTS)
+	slotBytes := make([]int64, CLUSTER_SLOTS)
+	slotMemory := make([]int64, CLUSTER_SLOTS)
+	var skipped, unassigned int64
+	rdb.visitor = func(entry *KeyEntry) error {
+		delete(rdb.mapObj, entry.key)
+
+		// cluster 模式只有 db0
+		if entry.dbId != 0 {
+			skipped++
+			return nil
+		}
+
+		slot := keyHashSlot(entry.key)
+		size := int64(len(entry.key)) + entry.endOffset - entry.valOffset
+		// stream 和 module 类型没有解析，按 rdb 中的字节数计算
+		memory := size
+		if entry.obj != nil {
+			memory = estimateMemory(entry.key, entry.obj)
+		}
+		slotKeys[slot]++
+		slotBytes[slot] += size
+		slotMemory[slot] += memory
+
+		if slotNodes == nil {
+			return nil
+		}
+
+		node := slotNodes[slot]
+		if node == nil {
+			unassigned++
+			return nil
+		}
+		node.keys++
+		node.bytes += size
+		node.memory += memory
+
+		if node.rw == nil {
+			node.rw = NewRdbWriter(node.out, rdb.version)
+			node.rw.WriteHeader()
+			node.rw.WriteSelectDb(0)
+		}
+
+		rawVal, err := entry.RawValue(rdb.fp)
+		if err != nil {
+			return err
+		}
+
+		return node.rw.WriteRawKey(entry.key, entry.valType, rawVal, entry.expireTime)
+	}
+	err = rdb.DecodeRDBFile()
+	if err != nil {
+		return err
+	}
+
+	var totalKeys, totalBytes, totalMemory int64
+	usedSlots := 0
+	if *slots {
+		fmt.Printf("%-8s %12s %14s %14s\n", "slot", "keys", "rdb bytes", "memory")
+	}
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if slotKeys[slot] == 0 {
+			continue
+		}
+
+		usedSlots++
+		totalKeys += slotKeys[slot]
+		totalBytes += slotBytes[slot]
+		totalMemory += slotMemory[slot]
+		if *slots {
+			fmt.Printf("%-8d %12d %14d %14d\n", slot, slotKeys[slot], slotBytes[slot], slotMemory[slot])
+		}
+	}
+	fmt.Printf("total: %d keys, %d bytes, %d bytes memory in %d slots\n", totalKeys, totalBytes, totalMemory, usedSlots)
+	if skipped > 0 {
+		fmt.Printf("warning: %d keys not in db 0 were skipped\n", skipped)
+	}
+
+	if nodes == nil {
+		return nil
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	fmt.Printf("\n%-16s %12s %14s %14s %8s\n", "node", "keys", "rdb bytes", "memory", "share")
+	for _, node := range nodes {
+		share := 0.0
+		if totalMemory > 0 {
+			share = float64(node.memory) * 100 / float64(totalMemory)
+		}
+		fmt.Printf("%-16s %12d %14d %14d %7.2f%%\n", node.name, node.keys, node.bytes, node.memory, share)
+
+		if node.rw == nil {
+			node.rw = NewRdbWriter(node.out, rdb.version)
+			node.rw.WriteHeader()
+		}
+		err = node.rw.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if unassigned > 0 {
+		return fmt.Errorf("%d keys belong to slots not assigned to any node", unassigned)
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+const statsUsage = "stats file [-top 10] [-json]"
+
+/* 每个分布保留的样本数，用来估算分位数 */
+const STATS_SAMPLES = 10000
+
+/* 默认保留的最大key和最大元素个数 */
+const STATS_TOP = 10
+
+/* 输出元素名称时最多保留的字节数 */
+const STATS_FIELD_LEN = 64
+
+type HistogramBucket struct {
+	Upper int64 `json:"upper"`
+	Count int64 `json:"count"`
+}
+
+/*
+* 数值分布，边解析边统计
+* 直方图按 2 的幂分段，分位数由蓄水池采样估算，最小值、最大值和平均值是精确的
+ */
+type Distribution struct {
+	Count     int64              `json:"count"`
+	Sum       int64              `json:"sum"`
+	Min       int64              `json:"min"`
+	Max       int64              `json:"max"`
+	Avg       float64            `json:"avg"`
+	P50       int64              `json:"p50"`
+	P90       int64              `json:"p90"`
+	P99       int64              `json:"p99"`
+	Histogram []*HistogramBucket `json:"histogram"`
+
+	buckets [65]int64
+	samples []int64
+	rnd     *rand.Rand
+}
+
+func NewDistribution() *Distribution {
+	return &Distribution{rnd: rand.New(rand.NewSource(1))}
+}
+
+func (d *Distribution) Add(val int64) {
+	if d.Count == 0 || val < d.Min {
+		d.Min = val
+	}
+	if val > d.Max {
+		d.Max = val
+	}
+	d.Count++
+	d.Sum += val
+
+	if val < 0 {
+		val = 0
+	}
+	d.buckets[bits.Len64(uint64(val))]++
+
+	if len(d.samples) < STATS_SAMPLES {
+		d.samples = append(d.samples, val)
+	} else if pos := d.rnd.Int63n(d.Count); pos < STATS_SAMPLES {
+		d.samples[pos] = val
+	}
+}
+
+/*
+* 计算平均值、分位数和直方图
+ */
+func (d *Distribution) Finish() {
+	if d.Count == 0 {
+		return
+	}
+
+	d.Avg = float64(d.Sum) / float64(d.Count)
+	sort.Slice(d.samples, func(i, j int) bool { return d.samples[i] < d.samples[j] })
+	percentile := func(p float64) int64 {
+		return d.samples[int(float64(len(d.samples)-1)*p)]
+	}
+	d.P50, d.P90, d.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+
+	first, last := -1, 0
+	for i, count := range d.buckets {
+		if count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+
+	d.Histogram = nil
+	for i := first; i <= last; i++ {
+		upper := int64(0)
+		if i > 0 {
+			upper = int64(uint64(1)<<uint(i) - 1)
+		}
+		d.Histogram = append(d.Histogram, &HistogramBucket{upper, d.buckets[i]})
+	}
+}
+
+/*
+* 单个类型的统计：元素个数和元素字节数的分布以及最大的key
+ */
+type TypeStats struct {
+	Type       string        `json:"type"`
+	Keys       int64         `json:"keys"`
+	Size       int64         `json:"size"`
+	Elements   *Distribution `json:"elements"`
+	ValueBytes *Distribution `json:"valueBytes"`
+	Largest    []*KeySize    `json:"largest"`
+
+	top *topKeys
+}
+
+/*
+* 所有key的统计，largestElements 用来发现单个元素特别大的key
+ */
+type Stats struct {
+	Keys            int64                 `json:"keys"`
+	KeyBytes        *Distribution         `json:"keyBytes"`
+	Types           map[string]*TypeStats `json:"types"`
+	LargestElements []*KeySize            `json:"largestElements"`
+
+	topElements *topKeys
+	limit       int
+}
+
+func NewStats(limit int) *Stats {
+	return &Stats{
+		KeyBytes:    NewDistribution(),
+		Types:       make(map[string]*TypeStats),
+		topElements: newTopKeys(limit),
+		limit:       limit,
+	}
+}
+
+func truncateField(field string) string {
+	if len(field) > STATS_FIELD_LEN {
+		return field[:STATS_FIELD_LEN] + "..."
+	}
+
+	return field
+}
+
+/*
+* 统计单个元素
+ */
+func (s *Stats) addElement(ts *TypeStats, dbId int, key, field string, size int64) {
+	ts.ValueBytes.Add(size)
+	if s.topElements.wants(size) {
+		s.topElements.add(&KeySize{Db: dbId, Key: key, Type: ts.Type, Size: size, Field: truncateField(field)})
+	}
+}
+
+/*
+* 统计一个key，返回所属类型的统计
+ */
+func (s *Stats) addKey(dbId int, key string, typeName string, size int64) *TypeStats {
+	ts, ok := s.Types[typeName]
+	if !ok {
+		ts = &TypeStats{Type: typeName, Elements: NewDistribution(), ValueBytes: NewDistribution(), top: newTopKeys(s.limit)}
+		s.Types[typeName] = ts
+	}
+
+	s.Keys++
+	s.KeyBytes.Add(int64(len(key)))
+	ts.Keys++
+	ts.Size += size
+	if ts.top.wants(size) {
+		ts.top.add(&KeySize{Db: dbId, Key: key, Type: typeName, Size: size})
+	}
+
+	return ts
+}
+
+func (s *Stats) Add(dbId int, key string, obj *RedisObject) {
+	ts := s.addKey(dbId, key, typeMap[obj.objType], int64(len(key))+obj.objLen)
+
+	switch val := obj.objVal.(type) {
+	case string:
+		ts.Elements.Add(1)
+		ts.ValueBytes.Add(int64(len(val)))
+	case []string:
+		ts.Elements.Add(int64(len(val)))
+		for i, item := range val {
+			size := int64(len(item))
+			// 列表元素以下标作为名称，只有需要时才格式化
+			if s.topElements.wants(size) {
+				s.addElement(ts, dbId, key, "["+strconv.Itoa(i)+"]", size)
+			} else {
+				ts.ValueBytes.Add(size)
+			}
+		}
+	case map[string]string:
+		ts.Elements.Add(int64(len(val)))
+		for field, value := range val {
+			s.addElement(ts, dbId, key, field, int64(len(value)))
+		}
+	case map[string]int:
+		ts.Elements.Add(int64(len(val)))
+		for member := range val {
+			s.addElement(ts, dbId, key, member, int64(len(member)))
+		}
+	case map[string]float64:
+		ts.Elements.Add(int64(len(val)))
+		for member := range val {
+			s.addElement(ts, dbId, key, member, int64(len(member)))
+		}
+	}
+}
+
+/*
+* stream 不解析，只统计消息数，大小为序列化数据的字节数，没有单个元素的大小
+ */
+func (s *Stats) AddStream(dbId int, key string, entries int64, rawBytes int64) {
+	ts := s.addKey(dbId, key, "stream", int64(len(key))+rawBytes)
+	ts.Elements.Add(entries)
+}
+
+func (s *Stats) Finish() {
+	s.KeyBytes.Finish()
+	for _, ts := range s.Types {
+		ts.Elements.Finish()
+		ts.ValueBytes.Finish()
+		ts.Largest = ts.top.sorted()
+	}
+	s.LargestElements = s.topElements.sorted()
+}
+
+func (s *Stats) sortedTypes() []*TypeStats {
+	types := make([]*TypeStats, 0, len(s.Types))
+	for _, ts := range s.Types {
+		types = append(types, ts)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Type < types[j].Type })
+
+	return types
+}
+
+func printDistribution(name string, d *Distribution) {
+	fmt.Printf("  %-12s count %d, min %d, avg %.1f, p50 %d, p90 %d, p99 %d, max %d\n", name, d.Count, d.Min, d.Avg, d.P50, d.P90, d.P99, d.Max)
+	fmt.Printf("  %-12s", "")
+	for _, bucket := range d.Histogram {
+		fmt.Printf(" <=%d:%d", bucket.Upper, bucket.Count)
+	}
+	fmt.Println()
+}
+
+func (s *Stats) Print() {
+	fmt.Printf("keys: %d\n", s.Keys)
+	printDistribution("key bytes", s.KeyBytes)
+
+	for _, ts := range s.sortedTypes() {
+		fmt.Printf("\n%s: %d keys, %d bytes\n", ts.Type, ts.Keys, ts.Size)
+		printDistribution("elements", ts.Elements)
+		if ts.ValueBytes.Count > 0 {
+			printDistribution("value bytes", ts.ValueBytes)
+		}
+		fmt.Printf("  largest keys:\n")
+		for _, item := range ts.Largest {
+			fmt.Printf("  %-4d %14d  %s\n", item.Db, item.Size, item.Key)
+		}
+	}
+
+	fmt.Printf("\nlargest elements:\n")
+	fmt.Printf("%-4s %-8s %14s  %s\n", "db", "type", "bytes", "key / field")
+	for _, item := range s.LargestElements {
+		fmt.Printf("%-4d %-8s %14d  %s / %s\n", item.Db, item.Type, item.Size, item.Key, item.Field)
+	}
+}
+
+/*
+* 各类型元素个数和元素字节数的分布，以及最大的key和最大的单个元素
+ */
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := fs.Int("top", STATS_TOP, "number of largest keys and elements to show")
+	asJson := fs.Bool("json", false, "output as json")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || *top < 0 {
+		return errors.New("usage: decode " + statsUsage)
+	}
+
+	stats := NewStats(*top)
+	_, err = scanKeys(files[0], func(dbId int, key string, obj *RedisObject) error {
+		stats.Add(dbId, key, obj)
+		return nil
+	}, func(entry *KeyEntry) error {
+		if isStreamType(entry.valType) {
+			stats.AddStream(entry.dbId, entry.key, entry.streamLen, entry.endOffset-entry.valOffset)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stats.Finish()
+
+	if *asJson {
+		out, err := json.MarshalIndent(stats, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	stats.Print()
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ttlUsage = "ttl file [-delim :] [-top 20] [-json]"
+
+/*
+* 剩余过期时间的分段，upper 为分段上限（毫秒），最后一段没有上限
+ */
+var ttlBuckets = []struct {
+	name  string
+	upper int64
+}{
+	{"expired", 0},
+	{"< 1m", int64(time.Minute / time.Millisecond)},
+	{"1m - 1h", int64(time.Hour / time.Millisecond)},
+	{"1h - 1d", int64(24 * time.Hour / time.Millisecond)},
+	{"1d - 7d", int64(7 * 24 * time.Hour / time.Millisecond)},
+	{"7d - 30d", int64(30 * 24 * time.Hour / time.Millisecond)},
+	{">= 30d", -1},
+}
+
+/*
+* key 以及它的大小，大小为 key 名加上 value 在 rdb 中的字节数，过期时间分析和多文件汇总中为估算的内存
+* 统计单个元素时 field 为 hash 的字段、集合的成员或者列表的下标，size 为元素的字节数
+* 汇总多个文件时 dump 为 key 所在文件的名称
+ */
+type KeySize struct {
+	Dump  string `json:"dump,omitempty"`
+	Db    int    `json:"db"`
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Field string `json:"field,omitempty"`
+}
+
+/*
+* 保留最大的 limit 个key，内部是按大小排序的小顶堆
+ */
+type topKeys struct {
+	limit int
+	items []*KeySize
+}
+
+func newTopKeys(limit int) *topKeys {
+	return &topKeys{limit: limit}
+}
+
+func (t *topKeys) Len() int           { return len(t.items) }
+func (t *topKeys) Less(i, j int) bool { return t.items[i].Size < t.items[j].Size }
+func (t *topKeys) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topKeys) Push(x interface{}) { t.items = append(t.items, x.(*KeySize)) }
+func (t *topKeys) Pop() interface{} {
+	item := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return item
+}
+
+/*
+* 判断这个大小能否进入前 limit 个，避免为放不进去的元素创建对象
+ */
+func (t *topKeys) wants(size int64) bool {
+	return t.limit > 0 && (len(t.items) < t.limit || size > t.items[0].Size)
+}
+
+func (t *topKeys) add(item *KeySize) {
+	if t.limit <= 0 {
+		return
+	}
+	if len(t.items) < t.limit {
+		heap.Push(t, item)
+		return
+	}
+	if item.Size > t.items[0].Size {
+		t.items[0] = item
+		heap.Fix(t, 0)
+	}
+}
+
+/*
+* 从大到小返回保留的key
+ */
+func (t *topKeys) sorted() []*KeySize {
+	items := make([]*KeySize, len(t.items))
+	copy(items, t.items)
+	sort.Slice(items, func(i, j int) bool { return items[i].Size > items[j].Size })
+
+	return items
+}
+
+type TtlBucket struct {
+	Name string `json:"name"`
+	Keys int64  `json:"keys"`
+	Size int64  `json:"size"`
+}
+
+/*
+* 按前缀统计没有设置过期时间的key
+ */
+type TtlPrefix struct {
+	Prefix        string  `json:"prefix"`
+	Keys          int64   `json:"keys"`
+	Size          int64   `json:"size"`
+	NoTtlKeys     int64   `json:"noTtlKeys"`
+	NoTtlSize     int64   `json:"noTtlSize"`
+	NoTtlSizeRate float64 `json:"noTtlSizeRate"`
+}
+
+/*
+* 过期时间分析报告，剩余时间相对于 rdb 文件的生成时间计算
+* size 为估算的 redis 内存占用
+ */
+type TtlReport struct {
+	Now          int64        `json:"now"`
+	NowFrom      string       `json:"nowFrom"`
+	Keys         int64        `json:"keys"`
+	Size         int64        `json:"size"`
+	NoTtlKeys    int64        `json:"noTtlKeys"`
+	NoTtlSize    int64        `json:"noTtlSize"`
+	Buckets      []*TtlBucket `json:"buckets"`
+	Prefixes     []*TtlPrefix `json:"prefixes"`
+	LargestNoTtl []*KeySize   `json:"largestNoTtl"`
+
+	prefixMap map[string]*TtlPrefix
+	delim     string
+	top       *topKeys
+	// 设置了过期时间的key的过期时间和大小，知道参考时间后再分段
+	expires []int64
+	sizes   []int64
+}
+
+func NewTtlReport(delim string, top int) *TtlReport {
+	return &TtlReport{delim: delim, prefixMap: make(map[string]*TtlPrefix), top: newTopKeys(top)}
+}
+
+/*
+* key 的前缀，没有分隔符时整个key都作为前缀的话分组会过多，统一归到空前缀
+ */
+func keyPrefix(key, delim string) string {
+	if delim == "" {
+		return ""
+	}
+
+	pos := strings.Index(key, delim)
+	if pos < 0 {
+		return ""
+	}
+
+	return key[:pos]
+}
+
+func (report *TtlReport) Add(dbId int, key string, obj *RedisObject) {
+	size := estimateMemory(key, obj)
+	report.Keys++
+	report.Size += size
+
+	prefix := keyPrefix(key, report.delim)
+	stat, ok := report.prefixMap[prefix]
+	if !ok {
+		stat = &TtlPrefix{Prefix: prefix}
+		report.prefixMap[prefix] = stat
+	}
+	stat.Keys++
+	stat.Size += size
+
+	if obj.expireTime < 0 {
+		report.NoTtlKeys++
+		report.NoTtlSize += size
+		stat.NoTtlKeys++
+		stat.NoTtlSize += size
+		report.top.add(&KeySize{Db: dbId, Key: key, Type: typeMap[obj.objType], Size: size})
+		return
+	}
+
+	report.expires = append(report.expires, obj.expireTime)
+	report.sizes = append(report.sizes, size)
+}
+
+/*
+* 按参考时间计算剩余过期时间的分布，汇总前缀统计并按没有过期时间的大小排序
+* @param now 参考时间（毫秒时间戳）
+ */
+func (report *TtlReport) Finish(now int64, nowFrom string) {
+	report.Now, report.NowFrom = now, nowFrom
+	report.Buckets = make([]*TtlBucket, 0, len(ttlBuckets))
+	for _, bucket := range ttlBuckets {
+		report.Buckets = append(report.Buckets, &TtlBucket{Name: bucket.name})
+	}
+	for i, expireTime := range report.expires {
+		remain := expireTime - now
+		for j, bucket := range ttlBuckets {
+			if bucket.upper < 0 || remain < bucket.upper || (j == 0 && remain <= 0) {
+				report.Buckets[j].Keys++
+				report.Buckets[j].Size += report.sizes[i]
+				break
+			}
+		}
+	}
+	report.expires, report.sizes = nil, nil
+
+	report.Prefixes = make([]*TtlPrefix, 0, len(report.prefixMap))
+	for _, stat := range report.prefixMap {
+		if stat.Size > 0 {
+			stat.NoTtlSizeRate = float64(stat.NoTtlSize) * 100 / float64(stat.Size)
+		}
+		report.Prefixes = append(report.Prefixes, stat)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool {
+		if report.Prefixes[i].NoTtlSize != report.Prefixes[j].NoTtlSize {
+			return report.Prefixes[i].NoTtlSize > report.Prefixes[j].NoTtlSize
+		}
+		return report.Prefixes[i].Prefix < report.Prefixes[j].Prefix
+	})
+
+	report.LargestNoTtl = report.top.sorted()
+}
+
+func (report *TtlReport) Print(limit int) {
+	fmt.Printf("reference time: %s (%s)\n", time.Unix(report.Now/1000, 0).Format("2006-01-02 15:04:05"), report.NowFrom)
+	fmt.Printf("keys: %d, memory: %d bytes\n", report.Keys, report.Size)
+	noTtlRate := 0.0
+	if report.Size > 0 {
+		noTtlRate = float64(report.NoTtlSize) * 100 / float64(report.Size)
+	}
+	fmt.Printf("without ttl: %d keys, %d bytes (%.2f%%)\n", report.NoTtlKeys, report.NoTtlSize, noTtlRate)
+
+	fmt.Printf("\n%-12s %12s %14s\n", "remain ttl", "keys", "memory")
+	for _, bucket := range report.Buckets {
+		fmt.Printf("%-12s %12d %14d\n", bucket.Name, bucket.Keys, bucket.Size)
+	}
+
+	fmt.Printf("\n%-24s %12s %14s %12s %14s %8s\n", "prefix", "keys", "memory", "no ttl keys", "no ttl memory", "no ttl")
+	for i, stat := range report.Prefixes {
+		if i >= limit {
+			fmt.Printf("... %d more prefixes\n", len(report.Prefixes)-limit)
+			break
+		}
+		prefix := stat.Prefix
+		if prefix == "" {
+			prefix = "(none)"
+		}
+		fmt.Printf("%-24s %12d %14d %12d %14d %7.2f%%\n", prefix, stat.Keys, stat.Size, stat.NoTtlKeys, stat.NoTtlSize, stat.NoTtlSizeRate)
+	}
+
+	fmt.Printf("\nlargest keys without ttl:\n")
+	fmt.Printf("%-4s %-8s %14s  %s\n", "db", "type", "memory", "key")
+	for _, item := range report.LargestNoTtl {
+		fmt.Printf("%-4d %-8s %14d  %s\n", item.Db, item.Type, item.Size, item.Key)
+	}
+}
+
+/*
+* 过期时间分析：剩余时间分布、已过期的key、各前缀没有过期时间的占比以及最大的不过期key
+ */
+func runTtl(args []string) error {
+	fs := flag.NewFlagSet("ttl", flag.ExitOnError)
+	delim := fs.String("delim", ":", "delimiter of key prefix")
+	top := fs.Int("top", 20, "number of prefixes and largest keys to show")
+	asJson := fs.Bool("json", false, "output as json")
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 || *top < 0 {
+		return errors.New("usage: decode " + ttlUsage)
+	}
+
+	report := NewTtlReport(*delim, *top)
+	meta, err := scanObjects(files[0], func(dbId int, key string, obj *RedisObject) error {
+		report.Add(dbId, key, obj)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// aof 文件没有生成时间，使用当前时间
+	if meta.Ctime > 0 {
+		report.Finish(meta.Ctime*1000, "rdb ctime")
+	} else {
+		report.Finish(nowMs(), "current time")
+	}
+
+	if *asJson {
+		out, err := json.MarshalIndent(report, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	report.Print(*top)
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+/* 默认的上传大小上限(MB)，gzip 文件解压后的大小也不能超过上限 */
+const UPLOAD_LIMIT_MB = 1024
+
+const UploadFailed = 1004
+
+/* 全局选项：是否允许在web页面上传文件，上传大小上限和临时文件目录 */
+var uploadEnabled = false
+var uploadLimitMb int64 = UPLOAD_LIMIT_MB
+var uploadDir = ""
+
+/*
+* 接收上传的文件，保存到临时目录后交给 DumpSet 在后台解析，解析结束后删除临时文件
+ */
+type Uploader struct {
+	dumps *DumpSet
+	dir   string
+	limit int64
+}
+
+func NewUploader(dumps *DumpSet, dir string, limitMb int64) *Uploader {
+	return &Uploader{dumps: dumps, dir: dir, limit: limitMb * 1024 * 1024}
+}
+
+/*
+* 保存上传的文件，gzip 文件解压后保存，超过大小上限时返回错误
+ */
+func (u *Uploader) save(part *multipart.Part) (string, int64, error) {
+	br := bufio.NewReader(part)
+	var r io.Reader = br
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	file, err := os.CreateTemp(u.dir, "upload-*.rdb")
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := io.Copy(file, io.LimitReader(r, u.limit+1))
+	if err == nil && n > u.limit {
+		err = fmt.Errorf("file is larger than %d MB", u.limit/1024/1024)
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, err
+	}
+
+	return file.Name(), n, nil
+}
+
+/*
+* 检查是否是 rdb 文件，目前只支持上传 rdb 文件
+ */
+func checkRdbSignature(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 9)
+	_, err = io.ReadFull(file, buf)
+	if err != nil || string(buf[:5]) != "REDIS" {
+		return errors.New("not a rdb file")
+	}
+	version, err := strconv.Atoi(string(buf[5:]))
+	if err != nil {
+		return fmt.Errorf("can't handle rdb format version %s", buf[5:])
+	}
+
+	return checkRdbVersion(version)
+}
+
+/*
+* 上传文件，multipart 表单中 name 字段为可选的名称，需要在 file 字段之前，file 字段为 rdb 文件或者 gzip 压缩的 rdb 文件
+* 保存完成后立即返回任务状态，通过 /status 查看解析进度
+ */
+func (u *Uploader) postUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, u.limit+1024*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeResult(w, &ReturnResult{InvalidParams, err.Error(), nil})
+		return
+	}
+
+	var name, fileName string
+	var size int64
+	path := ""
+	for path == "" {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeResult(w, &ReturnResult{InvalidParams, "missing file", nil})
+			return
+		}
+		if err != nil {
+			writeResult(w, &ReturnResult{UploadFailed, err.Error(), nil})
+			return
+		}
+
+		switch part.FormName() {
+		case "name":
+			buf, _ := io.ReadAll(io.LimitReader(part, 256))
+			name = string(buf)
+		case "file":
+			fileName = part.FileName()
+			path, size, err = u.save(part)
+			if err == nil {
+				err = checkRdbSignature(path)
+				if err != nil {
+					os.Remove(path)
+				}
+			}
+			if err != nil {
+				writeResult(w, &ReturnResult{UploadFailed, err.Error(), nil})
+				return
+			}
+		}
+		part.Close()
+	}
+
+	fmt.Printf("Upload %s, %d bytes\n", fileName, size)
+	job := u.dumps.NewJob(name, path, fileName, size, true)
+	go func() {
+		u.dumps.Load(job, false)
+		os.Remove(path)
+	}()
+
+	writeResult(w, &ReturnResult{Success, "", u.dumps.status(job)})
+}